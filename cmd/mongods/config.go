@@ -0,0 +1,528 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	dsrpc "github.com/beeleelee/go-ds-rpc"
+	dsmongo "github.com/beeleelee/go-ds-rpc/ds-mongo"
+	log "github.com/ipfs/go-log/v2"
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the schema of the file passed to --config. TOML, YAML and JSON
+// are accepted, told apart by the file extension, and share the keys below.
+// Every key can be overridden by an environment variable named after its
+// path, e.g. DSRPC_MONGO_URI for mongo.uri, and then by the command line
+// flags. See mongods.example.toml for a documented example.
+type Config struct {
+	// Listen holds the rpc listen addresses, "host:port" or a unix socket
+	// as "unix:///run/mongods.sock"
+	Listen Addrs `json:"listen"`
+	// SocketMode is the octal file mode of unix sockets, e.g. "0660"
+	SocketMode string `json:"socket_mode"`
+	LogLevel   string `json:"log_level"`
+	ReadOnly   bool   `json:"read_only"`
+	// DrainTimeout is how long query streams may run on after a shutdown
+	// signal, mutations are always waited for
+	DrainTimeout Duration `json:"drain_timeout"`
+	// MaxMessageSize bounds rpc messages and so the values stored, in bytes
+	MaxMessageSize int `json:"max_message_size"`
+
+	Mongo     MongoConfig     `json:"mongo"`
+	TLS       TLSConfig       `json:"tls"`
+	Auth      AuthConfig      `json:"auth"`
+	RateLimit RateLimitConfig `json:"rate_limit"`
+	Audit     AuditConfig     `json:"audit"`
+	Metrics   MetricsConfig   `json:"metrics"`
+	Health    HealthConfig    `json:"health"`
+	Tracing   TracingConfig   `json:"tracing"`
+}
+
+type MongoConfig struct {
+	URI                    string   `json:"uri"`
+	Database               string   `json:"database"`
+	StoreCollection        string   `json:"store_collection"`
+	RefsCollection         string   `json:"refs_collection"`
+	MaxPoolSize            uint64   `json:"max_pool_size"`
+	MinPoolSize            uint64   `json:"min_pool_size"`
+	ConnectTimeout         Duration `json:"connect_timeout"`
+	ServerSelectionTimeout Duration `json:"server_selection_timeout"`
+	SocketTimeout          Duration `json:"socket_timeout"`
+	WriteConcern           string   `json:"write_concern"`
+	Journal                bool     `json:"journal"`
+	// Transactions is auto, always or never
+	Transactions string `json:"transactions"`
+	// Indexes is background, ensure or skip
+	Indexes string `json:"indexes"`
+	// QueryBatchSize is the number of refs whose values a query fetches at
+	// once
+	QueryBatchSize int `json:"query_batch_size"`
+	// ChunkThreshold is the largest value stored inline, in bytes
+	ChunkThreshold int64 `json:"chunk_threshold"`
+	// Compression is zstd, snappy or empty
+	Compression string `json:"compression"`
+	// KeysFile enables encryption of stored values
+	KeysFile string `json:"keys_file"`
+}
+
+type TLSConfig struct {
+	Cert     string `json:"cert"`
+	Key      string `json:"key"`
+	ClientCA string `json:"client_ca"`
+}
+
+type AuthConfig struct {
+	TokensFile string `json:"tokens_file"`
+	// AdminTokensFile holds the credentials of the Admin service
+	AdminTokensFile string `json:"admin_tokens_file"`
+}
+
+type RateLimitConfig struct {
+	RequestsPerSecond float64          `json:"requests_per_second"`
+	RequestBurst      int              `json:"request_burst"`
+	BytesPerSecond    float64          `json:"bytes_per_second"`
+	ByteBurst         int              `json:"byte_burst"`
+	NamespaceQuotas   map[string]int64 `json:"namespace_quotas"`
+}
+
+type AuditConfig struct {
+	// File is the JSONL audit log, rotated after max_size bytes
+	File       string `json:"file"`
+	MaxSize    int64  `json:"max_size"`
+	MaxBackups int    `json:"max_backups"`
+	// Collection receives the records in the mongo database
+	Collection string `json:"collection"`
+	QueueSize  int    `json:"queue_size"`
+}
+
+type MetricsConfig struct {
+	// Addr is the http listen address of /metrics, empty disables it
+	Addr string `json:"addr"`
+}
+
+type HealthConfig struct {
+	// Addr is the http listen address of /healthz and /readyz, empty
+	// disables them. It may equal metrics.addr.
+	Addr     string   `json:"addr"`
+	Interval Duration `json:"interval"`
+	Timeout  Duration `json:"timeout"`
+	// Reflection registers the grpc server reflection service
+	Reflection bool `json:"reflection"`
+}
+
+type TracingConfig struct {
+	Exporter    string  `json:"exporter"`
+	File        string  `json:"file"`
+	Endpoint    string  `json:"endpoint"`
+	Insecure    bool    `json:"insecure"`
+	SampleRatio float64 `json:"sample_ratio"`
+}
+
+// Addrs reads a single address or a list of them, and a comma separated
+// list from the environment
+type Addrs []string
+
+func (a *Addrs) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		*a = Addrs{s}
+		return nil
+	}
+	var l []string
+	if err := json.Unmarshal(b, &l); err != nil {
+		return fmt.Errorf("listen must be an address or a list of addresses: %w", err)
+	}
+	*a = l
+	return nil
+}
+
+func (a Addrs) String() string {
+	return strings.Join(a, ",")
+}
+
+// Set appends, so a repeated flag collects every address
+func (a *Addrs) Set(s string) error {
+	*a = append(*a, s)
+	return nil
+}
+
+// Duration reads "10s" style strings in config files and variables
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration must be a string like \"10s\": %w", err)
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+func DefaultConfig() Config {
+	opts := dsmongo.DefaultOptions()
+	return Config{
+		Listen:         Addrs{":1520"},
+		LogLevel:       "error",
+		DrainTimeout:   Duration(30 * time.Second),
+		MaxMessageSize: opts.MaxMessageSize,
+		Mongo: MongoConfig{
+			URI:             opts.Uri,
+			Database:        opts.DBName,
+			StoreCollection: opts.StoreName,
+			RefsCollection:  opts.StoreRefsName,
+			Transactions:    dsmongo.TxnAuto,
+			Indexes:         dsmongo.IndexBackground,
+			QueryBatchSize:  opts.QueryBatchSize,
+			ChunkThreshold:  opts.ChunkThreshold,
+		},
+		Health: HealthConfig{
+			Interval:   Duration(10 * time.Second),
+			Timeout:    Duration(5 * time.Second),
+			Reflection: true,
+		},
+		Tracing: TracingConfig{
+			File:        "mongods-traces.json",
+			SampleRatio: 1,
+		},
+	}
+}
+
+// LoadConfigFile merges the file into cfg, keys missing from the file keep
+// their current value.
+func LoadConfigFile(file string, cfg *Config) error {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	// TOML and YAML are decoded generically and re-read through the json
+	// tags, so the three formats share one schema
+	var generic map[string]interface{}
+	switch ext := strings.ToLower(filepath.Ext(file)); ext {
+	case ".json":
+		dec := json.NewDecoder(strings.NewReader(string(b)))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(cfg); err != nil {
+			return fmt.Errorf("parse %s: %w", file, err)
+		}
+		return nil
+	case ".toml":
+		if _, err := toml.Decode(string(b), &generic); err != nil {
+			return fmt.Errorf("parse %s: %w", file, err)
+		}
+	case ".yaml", ".yml":
+		if err := yaml.Unmarshal(b, &generic); err != nil {
+			return fmt.Errorf("parse %s: %w", file, err)
+		}
+	default:
+		return fmt.Errorf("unknown config format %q, want .toml, .yaml or .json", ext)
+	}
+	jb, err := json.Marshal(generic)
+	if err != nil {
+		return fmt.Errorf("parse %s: %w", file, err)
+	}
+	dec := json.NewDecoder(strings.NewReader(string(jb)))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(cfg); err != nil {
+		return fmt.Errorf("parse %s: %w", file, err)
+	}
+	return nil
+}
+
+const envPrefix = "DSRPC"
+
+// ApplyEnv overrides cfg with DSRPC_* variables, the name of a key is its
+// path in upper case joined by underscores.
+func ApplyEnv(cfg *Config) error {
+	return applyEnv(reflect.ValueOf(cfg).Elem(), envPrefix)
+}
+
+func applyEnv(v reflect.Value, prefix string) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		name := prefix + "_" + strings.ToUpper(strings.Split(t.Field(i).Tag.Get("json"), ",")[0])
+		f := v.Field(i)
+		if f.Kind() == reflect.Struct {
+			if err := applyEnv(f, name); err != nil {
+				return err
+			}
+			continue
+		}
+		s, ok := os.LookupEnv(name)
+		if !ok {
+			continue
+		}
+		if err := setValue(f, s); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+func setValue(f reflect.Value, s string) error {
+	if f.Type() == reflect.TypeOf(Duration(0)) {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		f.SetInt(int64(d))
+		return nil
+	}
+	switch f.Kind() {
+	case reflect.String:
+		f.SetString(s)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		f.SetBool(b)
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return err
+		}
+		f.SetInt(n)
+	case reflect.Uint64:
+		n, err := strconv.ParseUint(s, 10, 64)
+		if err != nil {
+			return err
+		}
+		f.SetUint(n)
+	case reflect.Float64:
+		n, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return err
+		}
+		f.SetFloat(n)
+	case reflect.Slice:
+		var l []string
+		for _, a := range strings.Split(s, ",") {
+			if a = strings.TrimSpace(a); a != "" {
+				l = append(l, a)
+			}
+		}
+		f.Set(reflect.ValueOf(l).Convert(f.Type()))
+	case reflect.Map:
+		m, err := parseQuotas(s)
+		if err != nil {
+			return err
+		}
+		f.Set(reflect.ValueOf(m))
+	default:
+		return fmt.Errorf("unsupported type %s", f.Type())
+	}
+	return nil
+}
+
+// Validate reports every invalid setting at once
+func (c Config) Validate() error {
+	var errs []string
+	if len(c.Listen) == 0 {
+		errs = append(errs, "listen must not be empty")
+	}
+	for _, a := range c.Listen {
+		if a == "" {
+			errs = append(errs, "listen: empty address")
+		}
+	}
+	if _, err := c.socketMode(); err != nil {
+		errs = append(errs, err.Error())
+	}
+	if _, err := log.LevelFromString(c.LogLevel); err != nil {
+		errs = append(errs, fmt.Sprintf("log_level: %s", err))
+	}
+	if (c.TLS.Cert == "") != (c.TLS.Key == "") {
+		errs = append(errs, "tls.cert and tls.key must be set together")
+	}
+	if c.TLS.ClientCA != "" && c.TLS.Cert == "" {
+		errs = append(errs, "tls.client_ca needs tls.cert and tls.key")
+	}
+	switch c.Tracing.Exporter {
+	case dsrpc.TraceExporterNone, dsrpc.TraceExporterStdout, dsrpc.TraceExporterOTLP:
+	case dsrpc.TraceExporterFile:
+		if c.Tracing.File == "" {
+			errs = append(errs, "tracing.file must be set for the file exporter")
+		}
+	default:
+		errs = append(errs, fmt.Sprintf("tracing.exporter: unknown exporter %q", c.Tracing.Exporter))
+	}
+	if c.DrainTimeout < 0 {
+		errs = append(errs, "drain_timeout must not be negative")
+	}
+	if c.Health.Interval < 0 || c.Health.Timeout < 0 {
+		errs = append(errs, "health.interval and health.timeout must not be negative")
+	}
+	if c.Tracing.SampleRatio < 0 || c.Tracing.SampleRatio > 1 {
+		errs = append(errs, "tracing.sample_ratio must be between 0 and 1")
+	}
+	if err := c.StoreOptions().Validate(); err != nil {
+		errs = append(errs, err.Error())
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid configuration:\n  %s", strings.Join(errs, "\n  "))
+	}
+	return nil
+}
+
+// StoreOptions maps the configuration onto dsmongo.Options
+func (c Config) StoreOptions() dsmongo.Options {
+	return dsmongo.Options{
+		Uri:                    c.Mongo.URI,
+		DBName:                 c.Mongo.Database,
+		StoreName:              c.Mongo.StoreCollection,
+		StoreRefsName:          c.Mongo.RefsCollection,
+		MaxPoolSize:            c.Mongo.MaxPoolSize,
+		MinPoolSize:            c.Mongo.MinPoolSize,
+		ConnectTimeout:         time.Duration(c.Mongo.ConnectTimeout),
+		ServerSelectionTimeout: time.Duration(c.Mongo.ServerSelectionTimeout),
+		SocketTimeout:          time.Duration(c.Mongo.SocketTimeout),
+		WriteConcern:           c.Mongo.WriteConcern,
+		Journal:                c.Mongo.Journal,
+		Transactions:           c.Mongo.Transactions,
+		Indexes:                c.Mongo.Indexes,
+		QueryBatchSize:         c.Mongo.QueryBatchSize,
+		ChunkThreshold:         c.Mongo.ChunkThreshold,
+		Compression:            c.Mongo.Compression,
+		KeysFile:               c.Mongo.KeysFile,
+		MaxMessageSize:         c.MaxMessageSize,
+		ReadOnly:               c.ReadOnly,
+		TokensFile:             c.Auth.TokensFile,
+		AdminTokensFile:        c.Auth.AdminTokensFile,
+		RateLimit: dsmongo.RateLimitOptions{
+			RequestsPerSecond: c.RateLimit.RequestsPerSecond,
+			RequestBurst:      c.RateLimit.RequestBurst,
+			BytesPerSecond:    c.RateLimit.BytesPerSecond,
+			ByteBurst:         c.RateLimit.ByteBurst,
+			NamespaceQuotas:   c.RateLimit.NamespaceQuotas,
+		},
+		Audit: dsmongo.AuditOptions{
+			File:       c.Audit.File,
+			MaxSize:    c.Audit.MaxSize,
+			MaxBackups: c.Audit.MaxBackups,
+			Collection: c.Audit.Collection,
+			QueueSize:  c.Audit.QueueSize,
+		},
+	}
+}
+
+func (c Config) socketMode() (os.FileMode, error) {
+	if c.SocketMode == "" {
+		return 0, nil
+	}
+	m, err := strconv.ParseUint(c.SocketMode, 8, 32)
+	if err != nil || m > 0777 {
+		return 0, fmt.Errorf("socket_mode: %q is not an octal file mode like 0660", c.SocketMode)
+	}
+	return os.FileMode(m), nil
+}
+
+func (c Config) HealthOptions() dsmongo.HealthOptions {
+	return dsmongo.HealthOptions{
+		Interval: time.Duration(c.Health.Interval),
+		Timeout:  time.Duration(c.Health.Timeout),
+	}
+}
+
+func (c Config) TLSOptions() dsmongo.TLSOptions {
+	return dsmongo.TLSOptions{
+		CertFile:     c.TLS.Cert,
+		KeyFile:      c.TLS.Key,
+		ClientCAFile: c.TLS.ClientCA,
+	}
+}
+
+func (c Config) TracingOptions() dsrpc.TracingOptions {
+	return dsrpc.TracingOptions{
+		Exporter:    c.Tracing.Exporter,
+		File:        c.Tracing.File,
+		Endpoint:    c.Tracing.Endpoint,
+		Insecure:    c.Tracing.Insecure,
+		SampleRatio: c.Tracing.SampleRatio,
+		ServiceName: "mongods",
+	}
+}
+
+// Print writes the effective configuration as indented JSON, with the
+// password of the Mongo URI masked.
+func (c Config) Print() error {
+	if u, err := url.Parse(c.Mongo.URI); err == nil && u.User != nil {
+		if _, has := u.User.Password(); has {
+			u.User = url.UserPassword(u.User.Username(), "xxxxx")
+			c.Mongo.URI = u.String()
+		}
+	}
+	b, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(b))
+	return nil
+}
+
+// parseQuotas reads "/blocks=1099511627776,/pins=1073741824"
+func parseQuotas(s string) (map[string]int64, error) {
+	if s == "" {
+		return nil, nil
+	}
+	quotas := map[string]int64{}
+	for _, q := range strings.Split(s, ",") {
+		kv := strings.SplitN(q, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid namespace quota %q", q)
+		}
+		n, err := strconv.ParseInt(kv[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid namespace quota %q: %w", q, err)
+		}
+		quotas[strings.TrimSpace(kv[0])] = n
+	}
+	return quotas, nil
+}
+
+// quotasValue is a flag.Value for Config.RateLimit.NamespaceQuotas
+type quotasValue struct {
+	m *map[string]int64
+}
+
+func (q quotasValue) String() string {
+	if q.m == nil {
+		return ""
+	}
+	keys := make([]string, 0, len(*q.m))
+	for k := range *q.m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	parts := make([]string, 0, len(keys))
+	for _, k := range keys {
+		parts = append(parts, fmt.Sprintf("%s=%d", k, (*q.m)[k]))
+	}
+	return strings.Join(parts, ",")
+}
+
+func (q quotasValue) Set(s string) error {
+	m, err := parseQuotas(s)
+	if err != nil {
+		return err
+	}
+	*q.m = m
+	return nil
+}
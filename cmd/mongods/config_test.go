@@ -0,0 +1,88 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLoadConfig(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"c.toml": "listen = \":1\"\n[mongo]\nuri = \"mongodb://a\"\nconnect_timeout = \"5s\"\n[rate_limit.namespace_quotas]\n\"/blocks\" = 10\n",
+		"c.yaml": "listen: \":1\"\nmongo:\n  uri: mongodb://a\n  connect_timeout: 5s\nrate_limit:\n  namespace_quotas:\n    /blocks: 10\n",
+		"c.json": `{"listen": ":1", "mongo": {"uri": "mongodb://a", "connect_timeout": "5s"}, "rate_limit": {"namespace_quotas": {"/blocks": 10}}}`,
+	}
+	for name, content := range files {
+		file := filepath.Join(dir, name)
+		if err := os.WriteFile(file, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		c := DefaultConfig()
+		if err := LoadConfigFile(file, &c); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if len(c.Listen) != 1 || c.Listen[0] != ":1" || c.Mongo.URI != "mongodb://a" || time.Duration(c.Mongo.ConnectTimeout) != 5*time.Second || c.RateLimit.NamespaceQuotas["/blocks"] != 10 {
+			t.Errorf("%s: got %+v", name, c)
+		}
+		// keys missing from the file keep their defaults
+		if c.Mongo.Database != "datastore" {
+			t.Errorf("%s: database: got %q", name, c.Mongo.Database)
+		}
+		if err := c.Validate(); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+
+	unknown := filepath.Join(dir, "unknown.toml")
+	os.WriteFile(unknown, []byte("[mongo]\nurl = \"x\"\n"), 0600)
+	if err := LoadConfigFile(unknown, &Config{}); err == nil {
+		t.Error("unknown key was accepted")
+	}
+	if err := LoadConfigFile("mongods.example.toml", &Config{}); err != nil {
+		t.Errorf("example config: %v", err)
+	}
+}
+
+func TestApplyEnv(t *testing.T) {
+	t.Setenv("DSRPC_LISTEN", ":2, unix:///tmp/mongods.sock")
+	t.Setenv("DSRPC_SOCKET_MODE", "0600")
+	t.Setenv("DSRPC_READ_ONLY", "true")
+	t.Setenv("DSRPC_MONGO_MAX_POOL_SIZE", "20")
+	t.Setenv("DSRPC_MONGO_SOCKET_TIMEOUT", "1m")
+	t.Setenv("DSRPC_RATE_LIMIT_REQUESTS_PER_SECOND", "2.5")
+	c := DefaultConfig()
+	if err := ApplyEnv(&c); err != nil {
+		t.Fatal(err)
+	}
+	if len(c.Listen) != 2 || c.Listen[1] != "unix:///tmp/mongods.sock" || c.SocketMode != "0600" || !c.ReadOnly || c.Mongo.MaxPoolSize != 20 || time.Duration(c.Mongo.SocketTimeout) != time.Minute || c.RateLimit.RequestsPerSecond != 2.5 {
+		t.Errorf("got %+v", c)
+	}
+
+	t.Setenv("DSRPC_MONGO_JOURNAL", "maybe")
+	if err := ApplyEnv(&c); err == nil {
+		t.Error("invalid bool was accepted")
+	}
+
+	c = DefaultConfig()
+	c.Mongo.WriteConcern = "most"
+	c.Mongo.MinPoolSize, c.Mongo.MaxPoolSize = 5, 2
+	c.SocketMode = "rw"
+	if err := c.Validate(); err == nil {
+		t.Error("invalid config passed validation")
+	}
+
+	// inline values must stay below the 16 MB document limit
+	c = DefaultConfig()
+	c.Mongo.ChunkThreshold = 16 << 20
+	if err := c.Validate(); err == nil {
+		t.Error("chunk threshold above the document limit passed validation")
+	}
+
+	c = DefaultConfig()
+	c.Mongo.Compression = "gzip"
+	if err := c.Validate(); err == nil {
+		t.Error("unknown compression passed validation")
+	}
+}
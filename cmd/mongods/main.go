@@ -9,68 +9,214 @@ import (
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	dsrpc "github.com/beeleelee/go-ds-rpc"
 	dsmongo "github.com/beeleelee/go-ds-rpc/ds-mongo"
 	log "github.com/ipfs/go-log/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/otel"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/reflection"
 )
 
 var logging = log.Logger("mongods")
 
 var (
-	listenPort uint
-	dbUri      string
-	dbName     string
-	storeName  string
-	refName    string
+	configFile  string
+	printConfig bool
+	listenPort  uint
+	listenAddrs Addrs
+	ensureIdx   bool
+	skipIdx     bool
+	cfg         = DefaultConfig()
 )
 
-func init() {
-	log.SetLogLevel("*", "error")
+func bindFlags() {
+	flag.StringVar(&configFile, "config", "", "config file (.toml, .yaml or .json), see mongods.example.toml")
+	flag.BoolVar(&printConfig, "print-config", false, "print the effective configuration and exit")
+	flag.Var(&listenAddrs, "listen", "rpc listen address, host:port or unix:///path.sock, repeat to listen on several (default :1520)")
+	flag.UintVar(&listenPort, "port", 0, "rpc listen port, shorthand of --listen :PORT")
+	flag.StringVar(&cfg.SocketMode, "socket-mode", "", "octal file mode of unix sockets, e.g. 0660")
+	flag.StringVar(&cfg.LogLevel, "log-level", cfg.LogLevel, "log level: debug, info, warn or error")
+	flag.StringVar(&cfg.Mongo.URI, "db-uri", cfg.Mongo.URI, "db connection address")
+	flag.StringVar(&cfg.Mongo.Database, "db-name", cfg.Mongo.Database, "db name")
+	flag.StringVar(&cfg.Mongo.StoreCollection, "store-name", cfg.Mongo.StoreCollection, "db store name")
+	flag.StringVar(&cfg.Mongo.RefsCollection, "ref-name", cfg.Mongo.RefsCollection, "db ref name")
+	flag.Uint64Var(&cfg.Mongo.MaxPoolSize, "db-max-pool-size", 0, "max connections to mongo (driver default if 0)")
+	flag.Uint64Var(&cfg.Mongo.MinPoolSize, "db-min-pool-size", 0, "connections to mongo kept open")
+	flag.StringVar(&cfg.Mongo.WriteConcern, "db-write-concern", "", "write concern: majority or a number of nodes")
+	flag.StringVar(&cfg.Mongo.Transactions, "db-transactions", cfg.Mongo.Transactions, "run put and delete in transactions: auto, always or never")
+	flag.BoolVar(&ensureIdx, "ensure-indexes", false, "build missing indexes before serving, instead of in the background")
+	flag.BoolVar(&skipIdx, "skip-indexes", false, "do not build missing indexes")
+	flag.IntVar(&cfg.MaxMessageSize, "max-message-size", cfg.MaxMessageSize, "largest rpc message in bytes, bounds the values stored")
+	flag.IntVar(&cfg.Mongo.QueryBatchSize, "query-batch-size", cfg.Mongo.QueryBatchSize, "refs whose values a query fetches at once")
+	flag.StringVar(&cfg.Mongo.Compression, "db-compression", cfg.Mongo.Compression, "compress stored values: zstd, snappy or none")
+	flag.StringVar(&cfg.Mongo.KeysFile, "db-keys-file", cfg.Mongo.KeysFile, "json file of the keys values are encrypted with, enables encryption")
+	flag.Int64Var(&cfg.Mongo.ChunkThreshold, "db-chunk-threshold", cfg.Mongo.ChunkThreshold, "values above this many bytes are stored in chunks")
+	flag.StringVar(&cfg.TLS.Cert, "tls-cert", "", "server certificate file, enables TLS together with --tls-key")
+	flag.StringVar(&cfg.TLS.Key, "tls-key", "", "server private key file")
+	flag.StringVar(&cfg.TLS.ClientCA, "tls-client-ca", "", "CA bundle verifying client certificates, enables mutual TLS")
+	flag.StringVar(&cfg.Auth.TokensFile, "auth-tokens", "", "json file of bearer tokens and their grants, enables authentication")
+	flag.StringVar(&cfg.Auth.AdminTokensFile, "admin-tokens", "", "json file of the tokens allowed to use the Admin service, separate from --auth-tokens; without either the Admin service refuses every call")
+	flag.Float64Var(&cfg.RateLimit.RequestsPerSecond, "rate-limit-rps", 0, "requests per second allowed per client (unlimited if 0)")
+	flag.Float64Var(&cfg.RateLimit.BytesPerSecond, "rate-limit-bps", 0, "value bytes per second allowed per client (unlimited if 0)")
+	flag.Var(quotasValue{&cfg.RateLimit.NamespaceQuotas}, "namespace-quotas", "stored bytes per namespace, e.g. /blocks=1099511627776,/pins=1073741824")
+	flag.StringVar(&cfg.Audit.File, "audit-file", "", "jsonl file recording every put and delete (disabled if empty)")
+	flag.StringVar(&cfg.Audit.Collection, "audit-collection", "", "mongo collection recording every put and delete (disabled if empty)")
+	flag.BoolVar(&cfg.ReadOnly, "read-only", false, "reject Put and Delete with PermissionDenied")
+	flag.StringVar(&cfg.Metrics.Addr, "metrics-addr", "", "http listen address of the /metrics endpoint, e.g. :9520 (disabled if empty)")
+	flag.DurationVar((*time.Duration)(&cfg.DrainTimeout), "drain-timeout", time.Duration(cfg.DrainTimeout), "time given to query streams on shutdown before they are cancelled")
+	flag.StringVar(&cfg.Health.Addr, "health-addr", "", "http listen address of /healthz and /readyz, may equal --metrics-addr (disabled if empty)")
+	flag.DurationVar((*time.Duration)(&cfg.Health.Interval), "health-interval", time.Duration(cfg.Health.Interval), "interval of the mongo ping behind the health status")
+	flag.BoolVar(&cfg.Health.Reflection, "reflection", cfg.Health.Reflection, "register the grpc server reflection service")
+	flag.StringVar(&cfg.Tracing.Exporter, "trace-exporter", "", "span exporter: stdout, file or otlp (disabled if empty)")
+	flag.StringVar(&cfg.Tracing.File, "trace-file", cfg.Tracing.File, "output of the file span exporter")
+	flag.StringVar(&cfg.Tracing.Endpoint, "trace-endpoint", "", "otlp collector address, e.g. localhost:4317")
+	flag.BoolVar(&cfg.Tracing.Insecure, "trace-insecure", false, "connect to the otlp collector without TLS")
+	flag.Float64Var(&cfg.Tracing.SampleRatio, "trace-sample-ratio", cfg.Tracing.SampleRatio, "fraction of traces to sample")
+}
+
+// loadConfig layers defaults, the config file, DSRPC_* variables and the
+// flags given on the command line, later ones win
+func loadConfig() error {
+	// the first pass only finds --config
+	flag.Parse()
+	cfg = DefaultConfig()
+	if configFile != "" {
+		if err := LoadConfigFile(configFile, &cfg); err != nil {
+			return err
+		}
+	}
+	if err := ApplyEnv(&cfg); err != nil {
+		return err
+	}
+	listenAddrs = nil
+	if err := flag.CommandLine.Parse(os.Args[1:]); err != nil {
+		return err
+	}
+	if listenPort != 0 {
+		listenAddrs = append(listenAddrs, fmt.Sprintf(":%d", listenPort))
+	}
+	if len(listenAddrs) > 0 {
+		cfg.Listen = listenAddrs
+	}
+	switch {
+	case ensureIdx && skipIdx:
+		return fmt.Errorf("--ensure-indexes and --skip-indexes exclude each other")
+	case ensureIdx:
+		cfg.Mongo.Indexes = dsmongo.IndexEnsure
+	case skipIdx:
+		cfg.Mongo.Indexes = dsmongo.IndexSkip
+	}
+	return cfg.Validate()
 }
 
 func main() {
+	bindFlags()
+	if err := loadConfig(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if printConfig {
+		if err := cfg.Print(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+	log.SetLogLevel("*", cfg.LogLevel)
 	logging.Info("### 启动中... ###")
-	flag.UintVar(&listenPort, "port", 1520, "rpc listen port")
-	flag.StringVar(&dbUri, "db-uri", "", "db connection address")
-	flag.StringVar(&dbName, "db-name", "", "db name")
-	flag.StringVar(&storeName, "store-name", "", "db store name")
-	flag.StringVar(&refName, "ref-name", "", "db ref name")
-	flag.Parse()
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	ms, err := dsmongo.NewMongoStore(dsmongo.Options{
-		Uri:           dbUri,
-		DBName:        dbName,
-		StoreName:     storeName,
-		StoreRefsName: refName,
-	})
+	tp, err := dsrpc.NewTracerProvider(ctx, cfg.TracingOptions())
 	if err != nil {
 		logging.Fatal(err)
 	}
-	defer ms.Close(ctx)
+	if tp != nil {
+		otel.SetTracerProvider(tp)
+		defer tp.Shutdown(context.Background())
+	}
 
-	// 启动 pinner rpc服务
-	lis, err := net.Listen("tcp", fmt.Sprintf(":%d", listenPort))
+	storeOpts := cfg.StoreOptions()
+	storeOpts.Registerer = prometheus.DefaultRegisterer
+	ms, err := dsmongo.NewMongoStore(storeOpts)
 	if err != nil {
-		logging.Fatalf("failed to listen: %v", err)
+		logging.Fatal(err)
+	}
+
+	// 启动 pinner rpc服务
+	mode, _ := cfg.socketMode()
+	var listeners []net.Listener
+	for _, addr := range cfg.Listen {
+		lis, err := dsmongo.Listen(addr, mode)
+		if err != nil {
+			logging.Fatalf("failed to listen on %s: %v", addr, err)
+		}
+		listeners = append(listeners, lis)
 	}
 
-	// TODO 使用https证书建立安全通道
-	rpcSrv := grpc.NewServer()
+	srvOpts := ms.ServerOptions()
+	if cfg.TLS.Cert != "" {
+		tlsCfg, err := dsmongo.ServerTLSConfig(cfg.TLSOptions())
+		if err != nil {
+			logging.Fatal(err)
+		}
+		srvOpts = append(srvOpts, grpc.Creds(credentials.NewTLS(tlsCfg)))
+		logging.Infof("tls enabled, mutual tls: %v", cfg.TLS.ClientCA != "")
+	}
+	rpcSrv := grpc.NewServer(srvOpts...)
 	dsrpc.RegisterKVStoreServer(rpcSrv, ms)
-	go func() {
-		if err := rpcSrv.Serve(lis); err != nil && err != http.ErrServerClosed {
-			logging.Fatalf("rpc listen: %s\n", err)
+	dsrpc.RegisterAdminServer(rpcSrv, ms.Admin())
+	hc := ms.Health(cfg.HealthOptions())
+	healthpb.RegisterHealthServer(rpcSrv, hc.Server())
+	go hc.Run(ctx)
+	if cfg.Health.Reflection {
+		reflection.Register(rpcSrv)
+	}
+	for _, lis := range listeners {
+		go func(lis net.Listener) {
+			if err := rpcSrv.Serve(lis); err != nil && err != grpc.ErrServerStopped {
+				logging.Fatalf("rpc listen: %s\n", err)
+			}
+		}(lis)
+		logging.Infof("rpc listen address: %s", lis.Addr())
+	}
+
+	// metrics and health may share one http server
+	muxes := map[string]*http.ServeMux{}
+	mux := func(addr string) *http.ServeMux {
+		if muxes[addr] == nil {
+			muxes[addr] = http.NewServeMux()
 		}
-	}()
-	logging.Infof("rpc listen port: %d", listenPort)
+		return muxes[addr]
+	}
+	if cfg.Metrics.Addr != "" {
+		mux(cfg.Metrics.Addr).Handle("/metrics", promhttp.Handler())
+		logging.Infof("metrics listen address: %s", cfg.Metrics.Addr)
+	}
+	if cfg.Health.Addr != "" {
+		hc.RegisterHTTP(mux(cfg.Health.Addr))
+		logging.Infof("health listen address: %s", cfg.Health.Addr)
+	}
+	var httpSrvs []*http.Server
+	for addr, m := range muxes {
+		httpSrv := &http.Server{Addr: addr, Handler: m}
+		httpSrvs = append(httpSrvs, httpSrv)
+		go func() {
+			if err := httpSrv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				logging.Fatalf("http listen: %s\n", err)
+			}
+		}()
+	}
 
-	// Wait for interrupt signal to gracefully shutdown the server with
-	// a timeout of 5 seconds.
+	// Wait for interrupt signal to gracefully shutdown the server, query
+	// streams are given cfg.DrainTimeout to finish.
 	quit := make(chan os.Signal, 1)
 	// kill (no param) default send syscall.SIGTERM
 	// kill -2 is syscall.SIGINT
@@ -79,7 +225,29 @@ func main() {
 	<-quit
 	logging.Info("Shutdown Server ...")
 
-	rpcSrv.GracefulStop()
+	hc.Shutdown()
+	drainCtx, drainCancel := context.WithTimeout(context.Background(), time.Duration(cfg.DrainTimeout))
+	if err := ms.Drain(drainCtx); err != nil {
+		logging.Warnf("drain: %s", err)
+	}
+	drainCancel()
+	// only health watches and reflection streams may be left
+	stopped := make(chan struct{})
+	go func() {
+		rpcSrv.GracefulStop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		rpcSrv.Stop()
+	}
+	if err := ms.Close(context.Background()); err != nil {
+		logging.Warnf("close mongo: %s", err)
+	}
+	for _, httpSrv := range httpSrvs {
+		httpSrv.Close()
+	}
 
 	logging.Info("Server exiting")
 }
@@ -0,0 +1,275 @@
+package dsmongo
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	dsrpc "github.com/beeleelee/go-ds-rpc"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// isMutation reports whether fullMethod changes the store
+func isMutation(fullMethod string) bool {
+	return fullMethod == methodPut || fullMethod == methodDelete
+}
+
+// writeFence decides whether mutations are currently accepted. A read-only
+// fence is permanent, a temporary one is raised through the Admin service.
+type writeFence struct {
+	readOnly bool
+
+	mu     sync.Mutex
+	fenced bool
+	until  time.Time // zero when the fence has no expiry
+	reason string
+}
+
+func (f *writeFence) set(ttl time.Duration, reason string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.fenced = true
+	f.reason = reason
+	f.until = time.Time{}
+	if ttl > 0 {
+		f.until = time.Now().Add(ttl)
+	}
+}
+
+func (f *writeFence) clear() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.fenced = false
+	f.reason = ""
+	f.until = time.Time{}
+}
+
+// state returns whether writes are fenced, the reason and the remaining time
+func (f *writeFence) state() (bool, string, time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !f.fenced {
+		return false, "", 0
+	}
+	if f.until.IsZero() {
+		return true, f.reason, 0
+	}
+	remaining := time.Until(f.until)
+	if remaining <= 0 {
+		f.fenced = false
+		f.reason = ""
+		f.until = time.Time{}
+		return false, "", 0
+	}
+	return true, f.reason, remaining
+}
+
+// check returns the status error a mutation is rejected with, if any
+func (f *writeFence) check() error {
+	if f.readOnly {
+		return status.Error(codes.PermissionDenied, "mongods is read-only")
+	}
+	if fenced, reason, _ := f.state(); fenced {
+		return status.Errorf(codes.Unavailable, "writes are fenced: %s", reason)
+	}
+	return nil
+}
+
+func (f *writeFence) reply() *dsrpc.FenceReply {
+	fenced, reason, remaining := f.state()
+	return &dsrpc.FenceReply{
+		Fenced:           fenced,
+		Reason:           reason,
+		RemainingSeconds: int64((remaining + time.Second - 1) / time.Second),
+		ReadOnly:         f.readOnly,
+	}
+}
+
+// UnaryServerInterceptor rejects mutations while the fence is up
+func (f *writeFence) UnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if isMutation(info.FullMethod) {
+			if err := f.check(); err != nil {
+				return nil, err
+			}
+		}
+		return handler(ctx, req)
+	}
+}
+
+// AdminServer implements the Admin service of a MongoStore
+type AdminServer struct {
+	dsrpc.UnimplementedAdminServer
+	store *MongoStore
+}
+
+var _ dsrpc.AdminServer = (*AdminServer)(nil)
+
+// Admin returns the Admin service of ms, to be registered next to the
+// KVStore service with dsrpc.RegisterAdminServer. A server created with
+// ServerOptions refuses every Admin call unless TokensFile or AdminTokensFile
+// is set.
+func (ms *MongoStore) Admin() *AdminServer {
+	return &AdminServer{store: ms}
+}
+
+// adminGuard rejects the Admin calls no token can authenticate
+func (ms *MongoStore) adminGuard() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if ms.auth == nil && ms.admin == nil && strings.HasPrefix(info.FullMethod, "/dsrpc.Admin/") {
+			return nil, status.Error(codes.Unauthenticated, "the Admin service needs --auth-tokens or --admin-tokens")
+		}
+		return handler(ctx, req)
+	}
+}
+
+func (a *AdminServer) FenceWrites(ctx context.Context, req *dsrpc.FenceRequest) (*dsrpc.FenceReply, error) {
+	if req.GetTtlSeconds() < 0 {
+		return nil, status.Error(codes.InvalidArgument, "ttl_seconds must not be negative")
+	}
+	reason := req.GetReason()
+	if reason == "" {
+		reason = "maintenance"
+	}
+	a.store.fence.set(time.Duration(req.GetTtlSeconds())*time.Second, reason)
+	logging.Warnf("writes fenced for %ds: %s", req.GetTtlSeconds(), reason)
+	return a.store.fence.reply(), nil
+}
+
+func (a *AdminServer) UnfenceWrites(ctx context.Context, req *dsrpc.FenceRequest) (*dsrpc.FenceReply, error) {
+	a.store.fence.clear()
+	logging.Warn("writes unfenced")
+	return a.store.fence.reply(), nil
+}
+
+func (a *AdminServer) WriteFence(ctx context.Context, req *dsrpc.FenceRequest) (*dsrpc.FenceReply, error) {
+	return a.store.fence.reply(), nil
+}
+
+func (a *AdminServer) Stats(ctx context.Context, req *dsrpc.StatsRequest) (*dsrpc.StatsReply, error) {
+	st, err := a.store.client.Stats(ctx, req.GetPrefixes())
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "stats: %s", err)
+	}
+	r := &dsrpc.StatsReply{
+		Refs:          st.Refs,
+		Blocks:        st.Blocks,
+		LogicalBytes:  st.LogicalBytes,
+		PhysicalBytes: st.PhysicalBytes,
+		StorageBytes:  st.StorageBytes,
+	}
+	if st.PhysicalBytes > 0 {
+		r.DedupRatio = float64(st.LogicalBytes) / float64(st.PhysicalBytes)
+	}
+	for _, idx := range st.Indexes {
+		r.Indexes = append(r.Indexes, &dsrpc.IndexStatus{
+			Collection: idx.Collection,
+			Name:       idx.Name,
+			Present:    idx.Present,
+		})
+	}
+	r.IndexBuild = st.IndexBuild
+	for _, p := range st.Prefixes {
+		r.Prefixes = append(r.Prefixes, &dsrpc.PrefixStats{
+			Prefix:       p.Prefix,
+			Keys:         p.Keys,
+			LogicalBytes: p.LogicalBytes,
+		})
+	}
+	return r, nil
+}
+
+func (a *AdminServer) Connections(ctx context.Context, req *dsrpc.ConnectionsRequest) (*dsrpc.ConnectionsReply, error) {
+	r := &dsrpc.ConnectionsReply{}
+	for _, c := range a.store.conns.list() {
+		r.Connections = append(r.Connections, &dsrpc.Connection{
+			RemoteAddr:    c.remote,
+			LocalAddr:     c.local,
+			ConnectedUnix: c.since.Unix(),
+		})
+	}
+	calls, streams := a.store.drain.active()
+	r.ActiveCalls, r.ActiveStreams = int64(calls), int64(streams)
+	return r, nil
+}
+
+func (a *AdminServer) EnsureIndexes(ctx context.Context, req *dsrpc.MaintenanceRequest) (*dsrpc.MaintenanceReply, error) {
+	start := time.Now()
+	n, err := a.store.client.EnsureIndexes(ctx, req.GetDryRun())
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "ensure indexes: %s", err)
+	}
+	msg := fmt.Sprintf("%d indexes created", n)
+	if req.GetDryRun() {
+		msg = fmt.Sprintf("%d indexes missing", n)
+	}
+	logging.Infof("admin: %s", msg)
+	return &dsrpc.MaintenanceReply{
+		Task:       "ensure-indexes",
+		Affected:   int64(n),
+		Msg:        msg,
+		DurationMs: time.Since(start).Milliseconds(),
+	}, nil
+}
+
+func (a *AdminServer) CleanupOrphans(ctx context.Context, req *dsrpc.MaintenanceRequest) (*dsrpc.MaintenanceReply, error) {
+	if req.GetMinAgeSeconds() < 0 {
+		return nil, status.Error(codes.InvalidArgument, "min_age_seconds must not be negative")
+	}
+	minAge := time.Duration(req.GetMinAgeSeconds()) * time.Second
+	if minAge == 0 {
+		minAge = time.Hour
+	}
+	if !req.GetDryRun() {
+		if err := a.store.fence.check(); err != nil {
+			return nil, err
+		}
+	}
+	start := time.Now()
+	n, err := a.store.client.CleanupOrphans(ctx, minAge, req.GetDryRun())
+	msg := fmt.Sprintf("%d orphaned blocks removed", n)
+	if req.GetDryRun() {
+		msg = fmt.Sprintf("%d orphaned blocks found", n)
+	}
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cleanup orphans after %s: %s", msg, err)
+	}
+	logging.Infof("admin: %s", msg)
+	return &dsrpc.MaintenanceReply{
+		Task:       "cleanup-orphans",
+		Affected:   n,
+		Msg:        msg,
+		DurationMs: time.Since(start).Milliseconds(),
+	}, nil
+}
+
+func (a *AdminServer) RewrapKeys(ctx context.Context, req *dsrpc.MaintenanceRequest) (*dsrpc.MaintenanceReply, error) {
+	if a.store.client.keys == nil {
+		return nil, status.Error(codes.FailedPrecondition, "encryption is not configured")
+	}
+	if !req.GetDryRun() {
+		if err := a.store.fence.check(); err != nil {
+			return nil, err
+		}
+	}
+	start := time.Now()
+	n, err := a.store.client.RewrapKeys(ctx, req.GetDryRun())
+	msg := fmt.Sprintf("%d data keys rewrapped", n)
+	if req.GetDryRun() {
+		msg = fmt.Sprintf("%d data keys to rewrap", n)
+	}
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "rewrap keys after %s: %s", msg, err)
+	}
+	logging.Infof("admin: %s", msg)
+	return &dsrpc.MaintenanceReply{
+		Task:       "rewrap-keys",
+		Affected:   n,
+		Msg:        msg,
+		DurationMs: time.Since(start).Milliseconds(),
+	}, nil
+}
@@ -0,0 +1,116 @@
+package dsmongo
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	dsrpc "github.com/beeleelee/go-ds-rpc"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestWriteFence(t *testing.T) {
+	ms := &MongoStore{fence: &writeFence{}}
+	admin := ms.Admin()
+	intercept := ms.fence.UnaryServerInterceptor()
+	ok := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return &dsrpc.CommonReply{}, nil
+	}
+	call := func(method string) codes.Code {
+		_, err := intercept(context.Background(), &dsrpc.CommonRequest{}, &grpc.UnaryServerInfo{FullMethod: method}, ok)
+		return status.Code(err)
+	}
+
+	if c := call(methodPut); c != codes.OK {
+		t.Fatalf("unfenced put: got %v", c)
+	}
+	r, err := admin.FenceWrites(context.Background(), &dsrpc.FenceRequest{TtlSeconds: 60, Reason: "reindex"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !r.GetFenced() || r.GetReason() != "reindex" || r.GetRemainingSeconds() != 60 {
+		t.Fatalf("unexpected fence state: %v", r)
+	}
+	if c := call(methodPut); c != codes.Unavailable {
+		t.Fatalf("fenced put: got %v", c)
+	}
+	if c := call(methodDelete); c != codes.Unavailable {
+		t.Fatalf("fenced delete: got %v", c)
+	}
+	if c := call("/dsrpc.KVStore/Get"); c != codes.OK {
+		t.Fatalf("fenced get: got %v", c)
+	}
+	if _, err := admin.UnfenceWrites(context.Background(), &dsrpc.FenceRequest{}); err != nil {
+		t.Fatal(err)
+	}
+	if c := call(methodDelete); c != codes.OK {
+		t.Fatalf("unfenced delete: got %v", c)
+	}
+
+	// temporary fences expire on their own
+	ms.fence.set(time.Millisecond, "short")
+	time.Sleep(5 * time.Millisecond)
+	if c := call(methodPut); c != codes.OK {
+		t.Fatalf("expired fence: got %v", c)
+	}
+
+	ms.fence.readOnly = true
+	if c := call(methodPut); c != codes.PermissionDenied {
+		t.Fatalf("read-only put: got %v", c)
+	}
+}
+
+func TestAdminConnections(t *testing.T) {
+	ms := &MongoStore{fence: &writeFence{}, conns: newConnTracker(), drain: newDrainer()}
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := grpc.NewServer(grpc.StatsHandler(ms.conns))
+	dsrpc.RegisterAdminServer(srv, ms.Admin())
+	go srv.Serve(lis)
+	defer srv.Stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := grpc.DialContext(ctx, lis.Addr().String(), grpc.WithInsecure(), grpc.WithBlock())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	r, err := dsrpc.NewAdminClient(conn).Connections(ctx, &dsrpc.ConnectionsRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Connections) != 1 || r.Connections[0].LocalAddr != lis.Addr().String() {
+		t.Errorf("connections: got %v", r.Connections)
+	}
+}
+
+func TestAdminGuard(t *testing.T) {
+	ms := &MongoStore{}
+	intercept := ms.adminGuard()
+	ok := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return &dsrpc.CommonReply{}, nil
+	}
+	call := func(method string) codes.Code {
+		_, err := intercept(context.Background(), &dsrpc.StatsRequest{}, &grpc.UnaryServerInfo{FullMethod: method}, ok)
+		return status.Code(err)
+	}
+	if c := call("/dsrpc.Admin/Stats"); c != codes.Unauthenticated {
+		t.Errorf("admin without tokens: got %v", c)
+	}
+	if c := call(methodGet); c != codes.OK {
+		t.Errorf("kvstore without tokens: got %v", c)
+	}
+	var err error
+	if ms.admin, err = NewAuthenticator(nil); err != nil {
+		t.Fatal(err)
+	}
+	if c := call("/dsrpc.Admin/Stats"); c != codes.OK {
+		t.Errorf("admin with tokens: got %v", c)
+	}
+}
@@ -0,0 +1,355 @@
+package dsmongo
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	dsrpc "github.com/beeleelee/go-ds-rpc"
+	"golang.org/x/xerrors"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+)
+
+// AuditOptions enables the mutation audit log, to a JSONL file, a Mongo
+// collection or both. Records are written in the background, when the queue
+// is full they are dropped and counted rather than slowing calls down.
+type AuditOptions struct {
+	// File is appended one JSON record per line
+	File string
+	// MaxSize rotates File after that many bytes, 100MiB if zero
+	MaxSize int64
+	// MaxBackups is the number of rotated files kept, 10 if zero
+	MaxBackups int
+	// Collection receives the records in the database of the store
+	Collection string
+	// QueueSize is the number of records buffered, 4096 if zero
+	QueueSize int
+}
+
+// Audited operations
+const (
+	AuditPut    = "put"
+	AuditDelete = "delete"
+)
+
+// AuditRecord describes one mutation attempt, including rejected ones
+type AuditRecord struct {
+	Time   time.Time `json:"time" bson:"time"`
+	Op     string    `json:"op" bson:"op"`
+	Client string    `json:"client" bson:"client"`
+	Key    string    `json:"key" bson:"key"`
+	// Hash is the id of the block written, the sha256 of the value or its
+	// HMAC with encryption, empty for deletes
+	Hash string `json:"hash,omitempty" bson:"hash,omitempty"`
+	Size int    `json:"size,omitempty" bson:"size,omitempty"`
+	// Result is "OK" or the error code, Error its message
+	Result string `json:"result" bson:"result"`
+	Error  string `json:"error,omitempty" bson:"error,omitempty"`
+}
+
+// auditSink stores batches of records
+type auditSink interface {
+	write(recs []AuditRecord) error
+	close() error
+}
+
+// auditLog queues records for its sinks. A nil *auditLog records nothing.
+type auditLog struct {
+	sinks   []auditSink
+	queue   chan AuditRecord
+	done    chan struct{}
+	metrics *Metrics
+
+	closeOnce sync.Once
+	mu        sync.RWMutex
+	closed    bool
+}
+
+func newAuditLog(dsm *DSMongo, opts AuditOptions) (*auditLog, error) {
+	var sinks []auditSink
+	if opts.File != "" {
+		fs, err := newFileAuditSink(opts.File, opts.MaxSize, opts.MaxBackups)
+		if err != nil {
+			return nil, err
+		}
+		sinks = append(sinks, fs)
+	}
+	if opts.Collection != "" {
+		sinks = append(sinks, &mongoAuditSink{dsm: dsm, coll: opts.Collection})
+	}
+	if len(sinks) == 0 {
+		return nil, nil
+	}
+	if opts.QueueSize <= 0 {
+		opts.QueueSize = 4096
+	}
+	a := &auditLog{
+		sinks: sinks,
+		queue: make(chan AuditRecord, opts.QueueSize),
+		done:  make(chan struct{}),
+	}
+	if dsm != nil {
+		a.metrics = dsm.metrics
+	}
+	go a.run()
+	return a, nil
+}
+
+// record queues rec without blocking
+func (a *auditLog) record(rec AuditRecord) {
+	if a == nil {
+		return
+	}
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	if a.closed {
+		return
+	}
+	select {
+	case a.queue <- rec:
+	default:
+		a.metrics.auditDropped()
+		logging.Warnf("audit queue full, dropped %s %s", rec.Op, rec.Key)
+	}
+}
+
+// auditBatch bounds the records written at once
+const auditBatch = 256
+
+func (a *auditLog) run() {
+	defer close(a.done)
+	batch := make([]AuditRecord, 0, auditBatch)
+	for rec := range a.queue {
+		batch = append(batch[:0], rec)
+		// take whatever else is queued already
+	fill:
+		for len(batch) < auditBatch {
+			select {
+			case rec, ok := <-a.queue:
+				if !ok {
+					break fill
+				}
+				batch = append(batch, rec)
+			default:
+				break fill
+			}
+		}
+		for _, s := range a.sinks {
+			if err := s.write(batch); err != nil {
+				a.metrics.auditDropped()
+				logging.Errorf("write audit records: %s", err)
+			}
+		}
+	}
+}
+
+// close writes the queued records and closes the sinks
+func (a *auditLog) close() error {
+	if a == nil {
+		return nil
+	}
+	var err error
+	a.closeOnce.Do(func() {
+		a.mu.Lock()
+		a.closed = true
+		close(a.queue)
+		a.mu.Unlock()
+		<-a.done
+		for _, s := range a.sinks {
+			if cerr := s.close(); cerr != nil && err == nil {
+				err = cerr
+			}
+		}
+	})
+	return err
+}
+
+type auditKey struct{}
+
+// auditRecordFrom returns the record of the current call, for the handler to
+// add what only it knows
+func auditRecordFrom(ctx context.Context) *AuditRecord {
+	rec, _ := ctx.Value(auditKey{}).(*AuditRecord)
+	return rec
+}
+
+// UnaryServerInterceptor records Put and Delete calls with their outcome. It
+// runs before authentication so that rejected attempts are recorded too.
+func (a *auditLog) UnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if a == nil {
+			return handler(ctx, req)
+		}
+		rec := &AuditRecord{Time: time.Now().UTC()}
+		switch info.FullMethod {
+		case methodPut:
+			rec.Op = AuditPut
+		case methodDelete:
+			rec.Op = AuditDelete
+		default:
+			return handler(ctx, req)
+		}
+		if r, ok := req.(*dsrpc.CommonRequest); ok {
+			rec.Key = r.GetKey()
+			if rec.Op == AuditPut {
+				rec.Size = len(r.GetValue())
+			}
+		}
+		resp, err := handler(context.WithValue(ctx, auditKey{}, rec), req)
+		if rec.Client == "" {
+			rec.Client = ClientID(ctx)
+		}
+		rec.Result = "OK"
+		if err != nil {
+			rec.Result = status.Code(err).String()
+			rec.Error = status.Convert(err).Message()
+		} else if r, ok := resp.(*dsrpc.CommonReply); ok && r.GetCode() != dsrpc.ErrCode_None {
+			rec.Result = r.GetCode().String()
+			rec.Error = r.GetMsg()
+		}
+		a.record(*rec)
+		return resp, err
+	}
+}
+
+// fileAuditSink appends JSON lines to a file and rotates it by size
+type fileAuditSink struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+
+	f    *os.File
+	w    *bufio.Writer
+	size int64
+}
+
+func newFileAuditSink(path string, maxSize int64, maxBackups int) (*fileAuditSink, error) {
+	if maxSize <= 0 {
+		maxSize = 100 << 20
+	}
+	if maxBackups <= 0 {
+		maxBackups = 10
+	}
+	s := &fileAuditSink{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *fileAuditSink) open() error {
+	f, err := os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return xerrors.Errorf("open audit log: %w", err)
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	s.f, s.w, s.size = f, bufio.NewWriter(f), fi.Size()
+	return nil
+}
+
+func (s *fileAuditSink) write(recs []AuditRecord) error {
+	for _, rec := range recs {
+		b, err := json.Marshal(rec)
+		if err != nil {
+			return err
+		}
+		b = append(b, '\n')
+		if s.size > 0 && s.size+int64(len(b)) > s.maxSize {
+			if err := s.rotate(); err != nil {
+				return err
+			}
+		}
+		n, err := s.w.Write(b)
+		s.size += int64(n)
+		if err != nil {
+			return err
+		}
+	}
+	return s.w.Flush()
+}
+
+// rotate renames the current file to path.<timestamp> and starts a new one,
+// keeping maxBackups rotated files
+func (s *fileAuditSink) rotate() error {
+	if err := s.w.Flush(); err != nil {
+		return err
+	}
+	if err := s.f.Close(); err != nil {
+		return err
+	}
+	backup := fmt.Sprintf("%s.%s", s.path, time.Now().UTC().Format("20060102T150405.000000000"))
+	if err := os.Rename(s.path, backup); err != nil {
+		return err
+	}
+	if err := s.open(); err != nil {
+		return err
+	}
+	backups, err := filepath.Glob(s.path + ".*")
+	if err != nil {
+		return err
+	}
+	// the timestamps sort chronologically
+	sort.Strings(backups)
+	for len(backups) > s.maxBackups {
+		if err := os.Remove(backups[0]); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		backups = backups[1:]
+	}
+	return nil
+}
+
+func (s *fileAuditSink) close() error {
+	if err := s.w.Flush(); err != nil {
+		s.f.Close()
+		return err
+	}
+	return s.f.Close()
+}
+
+// mongoAuditSink inserts the records into a collection of the store database
+type mongoAuditSink struct {
+	dsm  *DSMongo
+	coll string
+}
+
+func (s *mongoAuditSink) write(recs []AuditRecord) error {
+	docs := make([]interface{}, len(recs))
+	for i := range recs {
+		docs[i] = recs[i]
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	coll := s.dsm.client.Database(s.dsm.opts.DBName).Collection(s.coll)
+	sctx, span := mongoSpan(ctx, "InsertMany", coll)
+	_, err := coll.InsertMany(sctx, docs)
+	endMongoSpan(span, err)
+	return err
+}
+
+func (s *mongoAuditSink) close() error {
+	return nil
+}
+
+// validateAudit checks AuditOptions before anything is opened
+func validateAudit(opts AuditOptions) error {
+	if opts.MaxSize < 0 || opts.MaxBackups < 0 || opts.QueueSize < 0 {
+		return xerrors.New("audit sizes must not be negative")
+	}
+	if strings.ContainsAny(opts.Collection, "$\x00") {
+		return xerrors.Errorf("invalid audit collection name %q", opts.Collection)
+	}
+	return nil
+}
@@ -0,0 +1,114 @@
+package dsmongo
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	dsrpc "github.com/beeleelee/go-ds-rpc"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func readAudit(t *testing.T, file string) []AuditRecord {
+	f, err := os.Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var recs []AuditRecord
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		rec := AuditRecord{}
+		if err := json.Unmarshal(sc.Bytes(), &rec); err != nil {
+			t.Fatal(err)
+		}
+		recs = append(recs, rec)
+	}
+	return recs
+}
+
+func TestAuditLog(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "audit.jsonl")
+	a, err := newAuditLog(nil, AuditOptions{File: file})
+	if err != nil {
+		t.Fatal(err)
+	}
+	intercept := a.UnaryServerInterceptor()
+	call := func(method, key string, value []byte, handler grpc.UnaryHandler) {
+		intercept(context.Background(), &dsrpc.CommonRequest{Key: key, Value: value}, &grpc.UnaryServerInfo{FullMethod: method}, handler)
+	}
+	call(methodPut, "/blocks/A", []byte("abc"), func(ctx context.Context, req interface{}) (interface{}, error) {
+		auditRecordFrom(ctx).Hash = sha256String([]byte("abc"))
+		return &dsrpc.CommonReply{}, nil
+	})
+	call(methodDelete, "/blocks/B", nil, func(ctx context.Context, req interface{}) (interface{}, error) {
+		return &dsrpc.CommonReply{Code: dsrpc.ErrCode_ErrNotFound, Msg: "no documents"}, nil
+	})
+	call(methodDelete, "/pins/C", nil, func(ctx context.Context, req interface{}) (interface{}, error) {
+		return nil, status.Error(codes.PermissionDenied, "denied")
+	})
+	call(methodGet, "/blocks/A", nil, func(ctx context.Context, req interface{}) (interface{}, error) {
+		return &dsrpc.CommonReply{}, nil
+	})
+	if err := a.close(); err != nil {
+		t.Fatal(err)
+	}
+	// records after close are ignored
+	call(methodPut, "/blocks/D", nil, func(ctx context.Context, req interface{}) (interface{}, error) {
+		return &dsrpc.CommonReply{}, nil
+	})
+
+	recs := readAudit(t, file)
+	if len(recs) != 3 {
+		t.Fatalf("got %d records, want 3", len(recs))
+	}
+	want := []AuditRecord{
+		{Op: AuditPut, Key: "/blocks/A", Hash: sha256String([]byte("abc")), Size: 3, Result: "OK"},
+		{Op: AuditDelete, Key: "/blocks/B", Result: "ErrNotFound", Error: "no documents"},
+		{Op: AuditDelete, Key: "/pins/C", Result: "PermissionDenied", Error: "denied"},
+	}
+	for i, w := range want {
+		got := recs[i]
+		if got.Time.IsZero() || got.Client == "" {
+			t.Errorf("record %d: missing time or client: %+v", i, got)
+		}
+		got.Time, got.Client = w.Time, w.Client
+		if got != w {
+			t.Errorf("record %d: got %+v, want %+v", i, got, w)
+		}
+	}
+}
+
+func TestAuditRotation(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "audit.jsonl")
+	s, err := newFileAuditSink(file, 200, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 20; i++ {
+		if err := s.write([]AuditRecord{{Op: AuditPut, Key: "/blocks/A", Result: "OK"}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.close(); err != nil {
+		t.Fatal(err)
+	}
+	backups, _ := filepath.Glob(file + ".*")
+	if len(backups) != 2 {
+		t.Errorf("got %d backups, want 2", len(backups))
+	}
+	for _, f := range append(backups, file) {
+		fi, err := os.Stat(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Size() > 200 {
+			t.Errorf("%s has %d bytes", f, fi.Size())
+		}
+	}
+}
@@ -0,0 +1,311 @@
+package dsmongo
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"net"
+	"os"
+	"path"
+	"strings"
+
+	dsrpc "github.com/beeleelee/go-ds-rpc"
+	"golang.org/x/xerrors"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// Operations a token can be granted.
+const (
+	OpRead   = "read"   // Get, Has, GetSize and Query
+	OpWrite  = "write"  // Put
+	OpDelete = "delete" // Delete
+	OpAdmin  = "admin"  // the Admin service
+	OpAll    = "*"
+)
+
+// TokenGrant allows Ops on keys below any of Prefixes. No prefix means every
+// key.
+type TokenGrant struct {
+	Ops      []string `json:"ops"`
+	Prefixes []string `json:"prefixes"`
+}
+
+type TokenConfig struct {
+	// Name identifies the client in logs and metrics
+	Name   string       `json:"name"`
+	Token  string       `json:"token"`
+	Grants []TokenGrant `json:"grants"`
+	// Node binds the token to a node, see WithNode: its calls act for it
+	// and may not name another one. Tokens without a node may name any.
+	Node string `json:"node,omitempty"`
+}
+
+// TokensFile is the layout of the file passed to --auth-tokens, e.g.
+//
+//	{"tokens": [{
+//	    "name": "gateway",
+//	    "token": "s3cr3t",
+//	    "node": "gateway-1",
+//	    "grants": [
+//	        {"ops": ["read"], "prefixes": ["/blocks"]},
+//	        {"ops": ["*"], "prefixes": ["/pins"]}
+//	    ]
+//	}]}
+type TokensFile struct {
+	Tokens []TokenConfig `json:"tokens"`
+}
+
+// Authenticator checks the bearer token or API key of every dsrpc call
+// against the grants of its token.
+type Authenticator struct {
+	tokens map[[sha256.Size]byte]*TokenConfig
+	// service limits the authenticator to one dsrpc service, e.g.
+	// "dsrpc.Admin", all of them if empty
+	service string
+}
+
+// LoadAuthenticator reads a TokensFile.
+func LoadAuthenticator(file string) (*Authenticator, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	tf := TokensFile{}
+	if err := json.Unmarshal(b, &tf); err != nil {
+		return nil, xerrors.Errorf("parse %s: %w", file, err)
+	}
+	return NewAuthenticator(tf.Tokens)
+}
+
+func NewAuthenticator(tokens []TokenConfig) (*Authenticator, error) {
+	a := &Authenticator{tokens: map[[sha256.Size]byte]*TokenConfig{}}
+	for i := range tokens {
+		tc := &tokens[i]
+		if tc.Token == "" {
+			return nil, xerrors.Errorf("token %q is empty", tc.Name)
+		}
+		for _, g := range tc.Grants {
+			for _, op := range g.Ops {
+				switch op {
+				case OpRead, OpWrite, OpDelete, OpAdmin, OpAll:
+				default:
+					return nil, xerrors.Errorf("token %q: unknown op %q", tc.Name, op)
+				}
+			}
+		}
+		h := sha256.Sum256([]byte(tc.Token))
+		if _, dup := a.tokens[h]; dup {
+			return nil, xerrors.Errorf("token %q is configured twice", tc.Name)
+		}
+		a.tokens[h] = tc
+	}
+	return a, nil
+}
+
+// covers reports whether calls of fullMethod need a token of a
+func (a *Authenticator) covers(fullMethod string) bool {
+	if a == nil {
+		return false
+	}
+	if a.service != "" {
+		return strings.HasPrefix(fullMethod, "/"+a.service+"/")
+	}
+	return strings.HasPrefix(fullMethod, "/dsrpc.")
+}
+
+type clientIDKey struct{}
+
+// ClientID returns the name of the token a call was authenticated with, or
+// the peer address if authentication is disabled.
+func ClientID(ctx context.Context) string {
+	if id, ok := ctx.Value(clientIDKey{}).(string); ok {
+		return id
+	}
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+		if host, _, err := net.SplitHostPort(p.Addr.String()); err == nil {
+			return host
+		}
+		return p.Addr.String()
+	}
+	return "unknown"
+}
+
+// authenticate finds the token sent in the "authorization: Bearer" or
+// "x-api-key" metadata of ctx
+func (a *Authenticator) authenticate(ctx context.Context) (*TokenConfig, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	tok := ""
+	if v := md.Get(dsrpc.MetadataAuthorization); len(v) > 0 {
+		tok = strings.TrimPrefix(v[0], "Bearer ")
+	} else if v := md.Get(dsrpc.MetadataAPIKey); len(v) > 0 {
+		tok = v[0]
+	}
+	if tok == "" {
+		return nil, status.Error(codes.Unauthenticated, "missing token")
+	}
+	tc, ok := a.tokens[sha256.Sum256([]byte(tok))]
+	if !ok {
+		return nil, status.Error(codes.Unauthenticated, "invalid token")
+	}
+	return tc, nil
+}
+
+// allowed reports whether tc grants op on every key below prefix
+func (tc *TokenConfig) allowed(op, prefix string) bool {
+	for _, g := range tc.Grants {
+		if !hasOp(g.Ops, op) {
+			continue
+		}
+		if len(g.Prefixes) == 0 {
+			return true
+		}
+		for _, p := range g.Prefixes {
+			if keyHasPrefix(prefix, p) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func hasOp(ops []string, op string) bool {
+	for _, o := range ops {
+		if o == op || o == OpAll {
+			return true
+		}
+	}
+	return false
+}
+
+// keyHasPrefix reports whether key equals prefix or lies below it, following
+// datastore key boundaries: /pins covers /pins/x but not /pinsx
+func keyHasPrefix(key, prefix string) bool {
+	key = cleanKey(key)
+	prefix = cleanKey(prefix)
+	if prefix == "/" {
+		return true
+	}
+	return key == prefix || strings.HasPrefix(key, prefix+"/")
+}
+
+func cleanKey(k string) string {
+	if k == "" || k[0] != '/' {
+		k = "/" + k
+	}
+	return path.Clean(k)
+}
+
+// authorize maps a call to the operation and key it needs a grant for
+func authorize(tc *TokenConfig, fullMethod string, req interface{}) error {
+	var op, key string
+	switch fullMethod {
+	case methodPut:
+		op = OpWrite
+	case methodDelete:
+		op = OpDelete
+	case methodGet, methodHas, methodGetSize, methodQuery:
+		op = OpRead
+	default:
+		if strings.HasPrefix(fullMethod, "/dsrpc.Admin/") {
+			op, key = OpAdmin, "/"
+		} else {
+			return status.Errorf(codes.PermissionDenied, "%s is not covered by any grant", fullMethod)
+		}
+	}
+	switch r := req.(type) {
+	case *dsrpc.CommonRequest:
+		key = r.GetKey()
+	case *dsrpc.QueryRequest:
+		q, err := dsrpc.DecodeQuery(r.GetQ())
+		if err != nil {
+			return status.Errorf(codes.InvalidArgument, "decode query: %s", err)
+		}
+		key = q.Prefix
+	}
+	if !tc.allowed(op, key) {
+		return status.Errorf(codes.PermissionDenied, "token %q may not %s %s", tc.Name, op, cleanKey(key))
+	}
+	return nil
+}
+
+// UnaryServerInterceptor authenticates and authorizes dsrpc calls, other
+// services such as health checks are passed through.
+func (a *Authenticator) UnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if !a.covers(info.FullMethod) {
+			return handler(ctx, req)
+		}
+		tc, err := a.authenticate(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if rec := auditRecordFrom(ctx); rec != nil {
+			rec.Client = tc.Name
+		}
+		if err := authorize(tc, info.FullMethod, req); err != nil {
+			return nil, err
+		}
+		ctx, err = tc.nodeContext(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return handler(context.WithValue(ctx, clientIDKey{}, tc.Name), req)
+	}
+}
+
+// nodeContext makes ctx act for the node tc is bound to
+func (tc *TokenConfig) nodeContext(ctx context.Context) (context.Context, error) {
+	if tc.Node == "" {
+		return ctx, nil
+	}
+	if nid := NodeID(ctx); nid != "" && nid != tc.Node {
+		return nil, status.Errorf(codes.PermissionDenied, "token %q may not act for node %q", tc.Name, nid)
+	}
+	return WithNode(ctx, tc.Node), nil
+}
+
+// StreamServerInterceptor authenticates query streams. The query is only
+// known after the first message, so authorization happens in RecvMsg.
+func (a *Authenticator) StreamServerInterceptor() grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if !a.covers(info.FullMethod) {
+			return handler(srv, ss)
+		}
+		tc, err := a.authenticate(ss.Context())
+		if err != nil {
+			return err
+		}
+		ctx, err := tc.nodeContext(ss.Context())
+		if err != nil {
+			return err
+		}
+		return handler(srv, &authorizingStream{
+			ServerStream: ss,
+			ctx:          context.WithValue(ctx, clientIDKey{}, tc.Name),
+			token:        tc,
+			method:       info.FullMethod,
+		})
+	}
+}
+
+type authorizingStream struct {
+	grpc.ServerStream
+	ctx    context.Context
+	token  *TokenConfig
+	method string
+}
+
+func (s *authorizingStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *authorizingStream) RecvMsg(m interface{}) error {
+	if err := s.ServerStream.RecvMsg(m); err != nil {
+		return err
+	}
+	return authorize(s.token, s.method, m)
+}
@@ -0,0 +1,165 @@
+package dsmongo
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	dsrpc "github.com/beeleelee/go-ds-rpc"
+	dsq "github.com/ipfs/go-datastore/query"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func TestAuthenticator(t *testing.T) {
+	a, err := NewAuthenticator([]TokenConfig{{
+		Name:  "gateway",
+		Token: "gw-token",
+		Grants: []TokenGrant{
+			{Ops: []string{OpRead}, Prefixes: []string{"/blocks"}},
+			{Ops: []string{OpAll}, Prefixes: []string{"/pins"}},
+		},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	intercept := a.UnaryServerInterceptor()
+	clientID := ""
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		clientID = ClientID(ctx)
+		return &dsrpc.CommonReply{}, nil
+	}
+	call := func(md metadata.MD, method, key string) codes.Code {
+		ctx := metadata.NewIncomingContext(context.Background(), md)
+		_, err := intercept(ctx, &dsrpc.CommonRequest{Key: key}, &grpc.UnaryServerInfo{FullMethod: method}, handler)
+		return status.Code(err)
+	}
+	bearer := metadata.Pairs(dsrpc.MetadataAuthorization, "Bearer gw-token")
+	apiKey := metadata.Pairs(dsrpc.MetadataAPIKey, "gw-token")
+
+	cases := []struct {
+		md     metadata.MD
+		method string
+		key    string
+		want   codes.Code
+	}{
+		{nil, methodGet, "/blocks/A", codes.Unauthenticated},
+		{metadata.Pairs(dsrpc.MetadataAPIKey, "wrong"), methodGet, "/blocks/A", codes.Unauthenticated},
+		{bearer, methodGet, "/blocks/A", codes.OK},
+		{apiKey, methodHas, "/blocks/A", codes.OK},
+		{bearer, methodPut, "/blocks/A", codes.PermissionDenied},
+		{bearer, methodDelete, "/blocks/A", codes.PermissionDenied},
+		{bearer, methodGet, "/blocksx", codes.PermissionDenied},
+		{bearer, methodGet, "/local/filesroot", codes.PermissionDenied},
+		{bearer, methodPut, "/pins/state/dirty", codes.OK},
+		{bearer, methodDelete, "/pins", codes.OK},
+		{bearer, "/dsrpc.Admin/FenceWrites", "", codes.PermissionDenied},
+		// other services are not subject to dsrpc tokens
+		{nil, "/grpc.health.v1.Health/Check", "", codes.OK},
+	}
+	for _, c := range cases {
+		if got := call(c.md, c.method, c.key); got != c.want {
+			t.Errorf("%s %s: got %v, want %v", c.method, c.key, got, c.want)
+		}
+	}
+	if call(bearer, methodGet, "/blocks/A"); clientID != "gateway" {
+		t.Errorf("client id: got %q", clientID)
+	}
+
+	tc, _ := a.authenticate(metadata.NewIncomingContext(context.Background(), bearer))
+	query := func(prefix string) codes.Code {
+		q, _ := json.Marshal(dsq.Query{Prefix: prefix})
+		return status.Code(authorize(tc, methodQuery, &dsrpc.QueryRequest{Q: q}))
+	}
+	if c := query("/blocks"); c != codes.OK {
+		t.Errorf("query /blocks: got %v", c)
+	}
+	if c := query("/"); c != codes.PermissionDenied {
+		t.Errorf("query /: got %v", c)
+	}
+}
+
+func TestTokenNode(t *testing.T) {
+	a, err := NewAuthenticator([]TokenConfig{{
+		Name:   "node-a",
+		Token:  "a-token",
+		Node:   "a",
+		Grants: []TokenGrant{{Ops: []string{OpAll}}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	intercept := a.UnaryServerInterceptor()
+	nid := ""
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		nid = NodeID(ctx)
+		return &dsrpc.CommonReply{}, nil
+	}
+	call := func(kv ...string) error {
+		md := metadata.Pairs(append([]string{dsrpc.MetadataAuthorization, "Bearer a-token"}, kv...)...)
+		ctx := metadata.NewIncomingContext(context.Background(), md)
+		_, err := intercept(ctx, &dsrpc.CommonRequest{Key: "/k"}, &grpc.UnaryServerInfo{FullMethod: methodDelete}, handler)
+		return err
+	}
+	if err := call(); err != nil || nid != "a" {
+		t.Errorf("bound token: node %q, %v", nid, err)
+	}
+	if err := call(dsrpc.MetadataNode, "a"); err != nil || nid != "a" {
+		t.Errorf("own node: node %q, %v", nid, err)
+	}
+	if err := call(dsrpc.MetadataNode, "b"); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("other node: got %v", err)
+	}
+}
+
+func TestAdminAuthenticator(t *testing.T) {
+	store, err := NewAuthenticator([]TokenConfig{{
+		Name:   "gateway",
+		Token:  "gw-token",
+		Grants: []TokenGrant{{Ops: []string{OpAll}}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	admin, err := NewAuthenticator([]TokenConfig{{
+		Name:   "operator",
+		Token:  "op-token",
+		Grants: []TokenGrant{{Ops: []string{OpAdmin}}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.service, admin.service = "dsrpc.KVStore", "dsrpc.Admin"
+	chain := []grpc.UnaryServerInterceptor{store.UnaryServerInterceptor(), admin.UnaryServerInterceptor()}
+	call := func(tok, method string) codes.Code {
+		ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(dsrpc.MetadataAPIKey, tok))
+		handler := func(ctx context.Context, req interface{}) (interface{}, error) { return nil, nil }
+		// run the chain the way grpc.ChainUnaryInterceptor does
+		h := handler
+		for i := len(chain) - 1; i >= 0; i-- {
+			next, ic := h, chain[i]
+			h = func(ctx context.Context, req interface{}) (interface{}, error) {
+				return ic(ctx, req, &grpc.UnaryServerInfo{FullMethod: method}, next)
+			}
+		}
+		_, err := h(ctx, &dsrpc.CommonRequest{Key: "/blocks/A"})
+		return status.Code(err)
+	}
+	cases := []struct {
+		tok, method string
+		want        codes.Code
+	}{
+		{"gw-token", methodGet, codes.OK},
+		{"op-token", methodGet, codes.Unauthenticated},
+		// a store token granting everything is no admin credential
+		{"gw-token", "/dsrpc.Admin/Stats", codes.Unauthenticated},
+		{"op-token", "/dsrpc.Admin/Stats", codes.OK},
+	}
+	for _, c := range cases {
+		if got := call(c.tok, c.method); got != c.want {
+			t.Errorf("%s %s: got %v, want %v", c.tok, c.method, got, c.want)
+		}
+	}
+}
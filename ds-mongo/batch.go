@@ -0,0 +1,559 @@
+package dsmongo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"golang.org/x/xerrors"
+)
+
+// BatchPut is one item of PutMany
+type BatchPut struct {
+	Key   string
+	Value []byte
+}
+
+// ErrNotAttempted is reported for the items of an ordered batch following
+// the first failed one
+var ErrNotAttempted = xerrors.New("not attempted after an earlier failure in the batch")
+
+// ErrBatchAborted is reported for the items of a transactional batch that
+// were rolled back because other items failed
+var ErrBatchAborted = xerrors.New("rolled back with the failed items of the batch")
+
+// BatchError reports the items of PutMany or DeleteMany that failed, Errs[i]
+// belongs to item i and is nil if it succeeded.
+type BatchError struct {
+	Errs []error
+}
+
+func (e *BatchError) Error() string {
+	failed, first := 0, -1
+	for i, err := range e.Errs {
+		if err != nil {
+			failed++
+			if first < 0 {
+				first = i
+			}
+		}
+	}
+	return fmt.Sprintf("%d of %d batch items failed, item %d: %s", failed, len(e.Errs), first, e.Errs[first])
+}
+
+func batchResult(errs []error) error {
+	for _, err := range errs {
+		if err != nil {
+			return &BatchError{Errs: errs}
+		}
+	}
+	return nil
+}
+
+// runBatch runs fn in a transaction if possible. A transaction is all or
+// nothing, so any failure then fails every item.
+func (dsm *DSMongo) runBatch(ctx context.Context, n int, fn func(ctx context.Context, errs []error) error) error {
+	var errs []error
+	err := dsm.withTxn(ctx, func(ctx context.Context) error {
+		errs = make([]error, n)
+		if err := fn(ctx, errs); err != nil {
+			return err
+		}
+		if inTxn(ctx) {
+			// failed items, whether a write failed or a lookup ruled them
+			// out, abort the transaction
+			return batchResult(errs)
+		}
+		return nil
+	})
+	if err != nil {
+		if !dsm.txn {
+			return err
+		}
+		be := &BatchError{}
+		if errors.As(err, &be) {
+			for i := range be.Errs {
+				if be.Errs[i] == nil {
+					be.Errs[i] = ErrBatchAborted
+				}
+			}
+			return be
+		}
+		for i := range errs {
+			errs[i] = err
+		}
+		return &BatchError{Errs: errs}
+	}
+	return batchResult(errs)
+}
+
+// PutMany stores a batch with one lookup and one bulk write for each of the
+// refs and blocks collections. If a key occurs more than once the last value
+// wins. Ordered batches stop at the first item whose ref cannot be written.
+// Item failures are returned as a *BatchError.
+func (dsm *DSMongo) PutMany(ctx context.Context, puts []BatchPut, ordered bool) error {
+	if len(puts) == 0 {
+		return nil
+	}
+	return dsm.runBatch(ctx, len(puts), func(ctx context.Context, errs []error) error {
+		return dsm.putMany(ctx, puts, ordered, errs)
+	})
+}
+
+func (dsm *DSMongo) putMany(ctx context.Context, puts []BatchPut, ordered bool, errs []error) error {
+	dstore := dsm.ds()
+	refstore := dsm.refs()
+	now := time.Now()
+
+	// idx lists the items written, the last one of every key
+	last := map[string]int{}
+	for i, p := range puts {
+		last[p.Key] = i
+	}
+	var idx []int
+	keys := bson.A{}
+	hashes := make([]string, len(puts))
+	for i, p := range puts {
+		hk, err := dsm.blockID(p.Value)
+		if err != nil {
+			return err
+		}
+		hashes[i] = hk
+		if last[p.Key] == i {
+			idx = append(idx, i)
+			keys = append(keys, p.Key)
+		}
+	}
+	defer func() {
+		for i, p := range puts {
+			errs[i] = errs[last[p.Key]]
+		}
+	}()
+
+	// 一次查出已有的引用和数据块
+	old, err := dsm.findRefs(ctx, keys)
+	if err != nil {
+		return err
+	}
+	uniq := bson.A{}
+	seen := map[string]bool{}
+	for _, i := range idx {
+		if !seen[hashes[i]] {
+			seen[hashes[i]] = true
+			uniq = append(uniq, hashes[i])
+		}
+	}
+	existing, err := dsm.findBlocks(ctx, uniq)
+	if err != nil {
+		return err
+	}
+
+	// refs first, as in put
+	nid := NodeID(ctx)
+	refOps := make([]mongo.WriteModel, len(idx))
+	for j, i := range idx {
+		set := bson.M{"ref": hashes[i], "size": int64(len(puts[i].Value))}
+		op := mongo.NewUpdateOneModel().SetUpsert(true)
+		switch o := old[puts[i].Key]; {
+		case nid == "":
+			op.SetFilter(bson.M{"_id": puts[i].Key}).SetUpdate(bson.M{
+				"$set":         set,
+				"$setOnInsert": bson.M{"nid": nil, "created_at": now},
+			})
+		case o != nil && o.NID == nil:
+			// the node claims a shared ref, which is recreated with it if
+			// deleted in between
+			set["nid"] = bson.A{nid}
+			op.SetFilter(bson.M{"_id": puts[i].Key, "nid": nil}).SetUpdate(bson.M{
+				"$set":         set,
+				"$setOnInsert": bson.M{"created_at": now},
+			})
+		default:
+			op.SetFilter(bson.M{"_id": puts[i].Key, "nid": bson.M{"$ne": nil}}).SetUpdate(bson.M{
+				"$set":         set,
+				"$addToSet":    bson.M{"nid": nid},
+				"$setOnInsert": bson.M{"created_at": now},
+			})
+		}
+		refOps[j] = op
+	}
+	_, refErrs, err := bulkWrite(ctx, refstore, refOps, ordered)
+	if err != nil {
+		return err
+	}
+
+	// then one write per distinct block, existing ones are only touched.
+	// Chunked blocks are written one by one, their data dominates anyway.
+	var groups [][]int
+	groupOf := map[string]int{}
+	for j, i := range idx {
+		if refErrs[j] != nil {
+			errs[i] = refErrs[j]
+			continue
+		}
+		if g, ok := groupOf[hashes[i]]; ok {
+			groups[g] = append(groups[g], i)
+			continue
+		}
+		groupOf[hashes[i]] = len(groups)
+		groups = append(groups, []int{i})
+	}
+	if inTxn(ctx) && batchResult(errs) != nil {
+		// the failed write aborted the transaction
+		return nil
+	}
+	blockErrs := make([]error, len(groups))
+	var blockOps []mongo.WriteModel
+	var opGroup, touched []int
+	for g, items := range groups {
+		i := items[0]
+		hk := hashes[i]
+		if dsm.chunked(puts[i].Value) {
+			created, err := dsm.writeBlock(ctx, hk, puts[i].Value, now)
+			blockErrs[g] = err
+			existing[hk] = !created
+			continue
+		}
+		if existing[hk] {
+			touched = append(touched, len(blockOps))
+			blockOps = append(blockOps, mongo.NewUpdateOneModel().
+				SetFilter(bson.M{"_id": hk}).
+				SetUpdate(bson.M{"$set": bson.M{"linked_at": now}}))
+		} else {
+			op, err := dsm.blockUpsert(hk, puts[i].Value, now)
+			if err != nil {
+				blockErrs[g] = err
+				continue
+			}
+			blockOps = append(blockOps, op)
+		}
+		opGroup = append(opGroup, g)
+	}
+	res, opErrs, err := bulkWrite(ctx, dstore, blockOps, false)
+	if err != nil {
+		return err
+	}
+	if res != nil && res.MatchedCount+res.UpsertedCount < int64(len(blockOps)) && len(touched) > 0 {
+		// a block seen by the lookup was released since, write it again
+		var retry []mongo.WriteModel
+		for _, op := range touched {
+			i := groups[opGroup[op]][0]
+			m, err := dsm.blockUpsert(hashes[i], puts[i].Value, now)
+			if err != nil {
+				return err
+			}
+			retry = append(retry, m)
+		}
+		_, retryErrs, err := bulkWrite(ctx, dstore, retry, false)
+		if err != nil {
+			return err
+		}
+		for k, op := range touched {
+			if opErrs[op] == nil {
+				opErrs[op] = retryErrs[k]
+			}
+		}
+	}
+	for op, g := range opGroup {
+		blockErrs[g] = opErrs[op]
+	}
+
+	var release []string
+	for g, items := range groups {
+		for _, i := range items {
+			if blockErrs[g] != nil {
+				errs[i] = blockErrs[g]
+				if !inTxn(ctx) {
+					dsm.restoreRef(ctx, puts[i].Key, hashes[i], nid, old[puts[i].Key])
+				}
+				continue
+			}
+			if o := old[puts[i].Key]; o != nil && o.Ref != hashes[i] {
+				release = append(release, o.Ref)
+			}
+		}
+		if blockErrs[g] == nil && existing[hashes[items[0]]] {
+			dsm.metrics.dedupHit()
+		}
+	}
+	return dsm.releaseMany(ctx, release)
+}
+
+func (dsm *DSMongo) blockUpsert(hk string, value []byte, now time.Time) (mongo.WriteModel, error) {
+	value, enc, err := dsm.encodeBlock(hk, value)
+	if err != nil {
+		return nil, err
+	}
+	return mongo.NewUpdateOneModel().
+		SetFilter(bson.M{"_id": hk}).
+		SetUpdate(bson.M{
+			"$setOnInsert": blockFields(bson.M{"value": value}, enc, now),
+			"$set":         bson.M{"linked_at": now},
+		}).
+		SetUpsert(true), nil
+}
+
+// DeleteMany removes a batch of refs with one lookup and one bulk write, and
+// releases their blocks together. Missing keys fail with
+// mongo.ErrNoDocuments, and ordered batches stop there. For a node, see
+// WithNode, refs other nodes hold are only let go of and shared ones fail
+// with ErrSharedRef, as in Delete. Without
+// a transaction a node putting a key concurrently may leave this node
+// holding it too.
+func (dsm *DSMongo) DeleteMany(ctx context.Context, keys []string, ordered bool) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	return dsm.runBatch(ctx, len(keys), func(ctx context.Context, errs []error) error {
+		return dsm.deleteMany(ctx, keys, ordered, errs)
+	})
+}
+
+func (dsm *DSMongo) deleteMany(ctx context.Context, keys []string, ordered bool, errs []error) error {
+	refstore := dsm.refs()
+
+	in := bson.A{}
+	for _, k := range keys {
+		in = append(in, k)
+	}
+	old, err := dsm.findRefs(ctx, in)
+	if err != nil {
+		return err
+	}
+
+	nid := NodeID(ctx)
+	var ops []mongo.WriteModel
+	var opItem []int
+	// kept lists the items whose ref other nodes still hold
+	kept := map[int]bool{}
+	seen := map[string]bool{}
+	for i, k := range keys {
+		o := old[k]
+		if o == nil || seen[k] || (nid != "" && !holds(o.NID, nid)) {
+			// a repeated key is gone after its first delete
+			errs[i] = mongo.ErrNoDocuments
+			if o != nil && !seen[k] && o.NID == nil {
+				errs[i] = ErrSharedRef
+			}
+			if ordered {
+				for j := i + 1; j < len(keys); j++ {
+					errs[j] = ErrNotAttempted
+				}
+				break
+			}
+			continue
+		}
+		seen[k] = true
+		switch {
+		case nid == "":
+			ops = append(ops, mongo.NewDeleteOneModel().SetFilter(bson.M{"_id": k}))
+		case len(o.NID) == 1:
+			ops = append(ops, mongo.NewDeleteOneModel().SetFilter(bson.M{"_id": k, "nid": bson.A{nid}}))
+		default:
+			ops = append(ops, mongo.NewUpdateOneModel().
+				SetFilter(bson.M{"_id": k, "nid": nid}).
+				SetUpdate(bson.M{"$pull": bson.M{"nid": nid}}))
+			kept[i] = true
+		}
+		opItem = append(opItem, i)
+	}
+	_, opErrs, err := bulkWrite(ctx, refstore, ops, ordered)
+	if err != nil {
+		return err
+	}
+	var release []string
+	for op, i := range opItem {
+		if opErrs[op] != nil {
+			errs[i] = opErrs[op]
+			continue
+		}
+		if kept[i] {
+			continue
+		}
+		release = append(release, old[keys[i]].Ref)
+	}
+	return dsm.releaseMany(ctx, release)
+}
+
+// findRefs returns the refs of keys that exist
+func (dsm *DSMongo) findRefs(ctx context.Context, keys bson.A) (map[string]*RefItem, error) {
+	refstore := dsm.refs()
+	refs := map[string]*RefItem{}
+	if len(keys) == 0 {
+		return refs, nil
+	}
+	sctx, span := mongoSpan(ctx, "Find", refstore)
+	cur, err := refstore.Find(sctx, bson.M{"_id": bson.M{"$in": keys}}, options.Find().SetProjection(bson.M{"ref": 1, "size": 1, "nid": 1}))
+	endMongoSpan(span, err)
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+	for cur.Next(ctx) {
+		r := &RefItem{}
+		if err := cur.Decode(r); err != nil {
+			return nil, err
+		}
+		refs[r.ID] = r
+	}
+	return refs, cur.Err()
+}
+
+// findBlocks returns which of hashes are stored
+func (dsm *DSMongo) findBlocks(ctx context.Context, hashes bson.A) (map[string]bool, error) {
+	dstore := dsm.ds()
+	found := map[string]bool{}
+	if len(hashes) == 0 {
+		return found, nil
+	}
+	sctx, span := mongoSpan(ctx, "Find", dstore)
+	cur, err := dstore.Find(sctx, bson.M{"_id": bson.M{"$in": hashes}}, options.Find().SetProjection(bson.M{"_id": 1}))
+	endMongoSpan(span, err)
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+	for cur.Next(ctx) {
+		b := struct {
+			ID string `bson:"_id"`
+		}{}
+		if err := cur.Decode(&b); err != nil {
+			return nil, err
+		}
+		found[b.ID] = true
+	}
+	return found, cur.Err()
+}
+
+// releaseMany is release for many blocks, with a constant number of round
+// trips
+func (dsm *DSMongo) releaseMany(ctx context.Context, hashes []string) error {
+	dstore := dsm.ds()
+	if len(hashes) == 0 {
+		return nil
+	}
+	in := bson.A{}
+	for _, hk := range hashes {
+		in = append(in, hk)
+	}
+	referenced, err := dsm.referenced(ctx, in)
+	if err != nil {
+		return err
+	}
+	candidates := bson.A{}
+	for _, hk := range hashes {
+		if !referenced[hk] {
+			referenced[hk] = true // once
+			candidates = append(candidates, hk)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+	// the blocks are read first for their chunks and, without a transaction,
+	// so that those a concurrent put referenced meanwhile can be written
+	// back, see release
+	find := options.Find()
+	if inTxn(ctx) {
+		find.SetProjection(bson.M{"chunk_gen": 1})
+	}
+	sctx, span := mongoSpan(ctx, "Find", dstore)
+	cur, err := dstore.Find(sctx, bson.M{"_id": bson.M{"$in": candidates}}, find)
+	endMongoSpan(span, err)
+	if err != nil {
+		return err
+	}
+	var blocks []bson.M
+	if err := cur.All(ctx, &blocks); err != nil {
+		return err
+	}
+	sctx, span = mongoSpan(ctx, "DeleteMany", dstore)
+	_, err = dstore.DeleteMany(sctx, bson.M{"_id": bson.M{"$in": candidates}})
+	endMongoSpan(span, err)
+	if err != nil {
+		return err
+	}
+	again := map[string]bool{}
+	if !inTxn(ctx) {
+		again, err = dsm.referenced(ctx, candidates)
+		if err != nil {
+			return err
+		}
+	}
+	var restore []mongo.WriteModel
+	for _, b := range blocks {
+		id, _ := b["_id"].(string)
+		if !again[id] {
+			if gen, _ := b["chunk_gen"].(string); gen != "" {
+				dsm.dropChunks(ctx, id, gen)
+			}
+			continue
+		}
+		delete(b, "_id")
+		restore = append(restore, mongo.NewUpdateOneModel().
+			SetFilter(bson.M{"_id": id}).
+			SetUpdate(bson.M{"$setOnInsert": b}).
+			SetUpsert(true))
+	}
+	_, restoreErrs, err := bulkWrite(ctx, dstore, restore, false)
+	if err != nil {
+		return err
+	}
+	for _, err := range restoreErrs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// referenced returns which of hashes some ref points to
+func (dsm *DSMongo) referenced(ctx context.Context, hashes bson.A) (map[string]bool, error) {
+	refstore := dsm.refs()
+	sctx, span := mongoSpan(ctx, "Distinct", refstore)
+	refs, err := refstore.Distinct(sctx, "ref", bson.M{"ref": bson.M{"$in": hashes}})
+	endMongoSpan(span, err)
+	if err != nil {
+		return nil, err
+	}
+	out := map[string]bool{}
+	for _, r := range refs {
+		if s, ok := r.(string); ok {
+			out[s] = true
+		}
+	}
+	return out, nil
+}
+
+// bulkWrite runs ops and returns the error of every op, ops of an ordered
+// write following a failed one get ErrNotAttempted. Failures that are not
+// tied to ops, such as a write concern error, are returned as err.
+func bulkWrite(ctx context.Context, coll *mongo.Collection, ops []mongo.WriteModel, ordered bool) (*mongo.BulkWriteResult, []error, error) {
+	errs := make([]error, len(ops))
+	if len(ops) == 0 {
+		return nil, errs, nil
+	}
+	sctx, span := mongoSpan(ctx, "BulkWrite", coll)
+	res, err := coll.BulkWrite(sctx, ops, options.BulkWrite().SetOrdered(ordered))
+	endMongoSpan(span, err)
+	if err == nil {
+		return res, errs, nil
+	}
+	bwe := mongo.BulkWriteException{}
+	if !errors.As(err, &bwe) || bwe.WriteConcernError != nil || len(bwe.WriteErrors) == 0 {
+		return nil, nil, err
+	}
+	for _, we := range bwe.WriteErrors {
+		errs[we.Index] = we.WriteError
+	}
+	if ordered {
+		for i := bwe.WriteErrors[0].Index + 1; i < len(ops); i++ {
+			errs[i] = ErrNotAttempted
+		}
+	}
+	return res, errs, nil
+}
@@ -0,0 +1,238 @@
+package dsmongo
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"golang.org/x/xerrors"
+)
+
+const (
+	// DefaultChunkThreshold is the largest value stored inline by default
+	DefaultChunkThreshold = 8 << 20
+	// MaxChunkThreshold keeps inline values clear of the 16 MB BSON limit
+	MaxChunkThreshold = 15 << 20
+	chunkSize         = 4 << 20
+)
+
+// ChunkItem is a piece of a value larger than Options.ChunkThreshold. The
+// chunks of a block share a generation, so that a put recreating a released
+// block never mixes its chunks with the ones being deleted.
+type ChunkItem struct {
+	ID        string    `bson:"_id" json:"_id"` // block/gen/n
+	Block     string    `bson:"block" json:"block"`
+	Gen       string    `bson:"gen" json:"gen"`
+	N         int       `bson:"n" json:"n"`
+	Data      []byte    `bson:"data" json:"data"`
+	CreatedAt time.Time `bson:"created_at" json:"created_at"`
+}
+
+func (dsm *DSMongo) chunks() *mongo.Collection {
+	return dsm.client.Database(dsm.opts.DBName).Collection(dsm.opts.StoreName + "_chunks")
+}
+
+func (dsm *DSMongo) chunked(value []byte) bool {
+	return int64(len(value)) > dsm.opts.ChunkThreshold
+}
+
+// chunkRange matches the chunks of one generation, which sort by n
+func chunkRange(hk, gen string) bson.M {
+	prefix := hk + "/" + gen + "/"
+	return bson.M{"_id": bson.M{"$gte": prefix, "$lt": hk + "/" + gen + "0"}}
+}
+
+// writeBlock stores the block hk, linking it if it exists, and reports if it
+// was created. Values are compressed and encrypted as the options ask, large
+// ones are then split into chunks, which are only sent when the block is
+// missing.
+func (dsm *DSMongo) writeBlock(ctx context.Context, hk string, value []byte, now time.Time) (bool, error) {
+	dstore := dsm.ds()
+	upsert := func(fields bson.M) (*mongo.UpdateResult, error) {
+		var res *mongo.UpdateResult
+		err := retryUpsert(ctx, func() error {
+			sctx, span := mongoSpan(ctx, "UpdateOne", dstore)
+			var err error
+			res, err = dstore.UpdateOne(sctx, bson.M{"_id": hk}, bson.M{
+				"$setOnInsert": fields,
+				"$set":         bson.M{"linked_at": now},
+			}, options.Update().SetUpsert(true))
+			endMongoSpan(span, err)
+			return err
+		})
+		return res, err
+	}
+	value, enc, err := dsm.encodeBlock(hk, value)
+	if err != nil {
+		return false, err
+	}
+	if !dsm.chunked(value) {
+		res, err := upsert(blockFields(bson.M{"value": value}, enc, now))
+		if err != nil {
+			return false, err
+		}
+		return res.UpsertedCount > 0, nil
+	}
+
+	sctx, span := mongoSpan(ctx, "UpdateOne", dstore)
+	res, err := dstore.UpdateOne(sctx, bson.M{"_id": hk}, bson.M{"$set": bson.M{"linked_at": now}})
+	endMongoSpan(span, err)
+	if err != nil {
+		return false, err
+	}
+	if res.MatchedCount > 0 {
+		return false, nil
+	}
+	gen, n, err := dsm.writeChunks(ctx, hk, value, now)
+	if err != nil {
+		return false, err
+	}
+	res, err = upsert(blockFields(bson.M{"chunks": n, "chunk_gen": gen}, enc, now))
+	if err != nil {
+		if !inTxn(ctx) {
+			dsm.dropChunks(ctx, hk, gen)
+		}
+		return false, err
+	}
+	if res.UpsertedCount == 0 {
+		// a concurrent put created the block first
+		dsm.dropChunks(ctx, hk, gen)
+		return false, nil
+	}
+	return true, nil
+}
+
+// blockFields completes the fields of a new block holding its value as
+// fields says, encoded as enc says
+func blockFields(fields, enc bson.M, now time.Time) bson.M {
+	fields["ref_count"] = 1
+	fields["created_at"] = now
+	for k, v := range enc {
+		fields[k] = v
+	}
+	return fields
+}
+
+// writeChunks stores value under a new generation of hk
+func (dsm *DSMongo) writeChunks(ctx context.Context, hk string, value []byte, now time.Time) (string, int, error) {
+	cstore := dsm.chunks()
+	gen := primitive.NewObjectID().Hex()
+	var docs []interface{}
+	for n := 0; n*chunkSize < len(value); n++ {
+		end := (n + 1) * chunkSize
+		if end > len(value) {
+			end = len(value)
+		}
+		docs = append(docs, &ChunkItem{
+			ID:        fmt.Sprintf("%s/%s/%06d", hk, gen, n),
+			Block:     hk,
+			Gen:       gen,
+			N:         n,
+			Data:      value[n*chunkSize : end],
+			CreatedAt: now,
+		})
+	}
+	sctx, span := mongoSpan(ctx, "InsertMany", cstore)
+	_, err := cstore.InsertMany(sctx, docs)
+	endMongoSpan(span, err)
+	return gen, len(docs), err
+}
+
+// dropChunks deletes a generation of chunks, failures are left to
+// CleanupOrphans
+func (dsm *DSMongo) dropChunks(ctx context.Context, hk, gen string) {
+	cstore := dsm.chunks()
+	sctx, span := mongoSpan(ctx, "DeleteMany", cstore)
+	_, err := cstore.DeleteMany(sctx, chunkRange(hk, gen))
+	endMongoSpan(span, err)
+	if err != nil {
+		logging.Errorf("delete chunks of %s: %s", hk, err)
+	}
+}
+
+// blockValue returns the value of b, reading its chunks if it has any
+func (dsm *DSMongo) blockValue(ctx context.Context, b *StoreItem) ([]byte, error) {
+	if b.Chunks == 0 {
+		return dsm.decodeBlock(b, b.Value)
+	}
+	cstore := dsm.chunks()
+	sctx, span := mongoSpan(ctx, "Find", cstore)
+	cur, err := cstore.Find(sctx, chunkRange(b.ID, b.ChunkGen), options.Find().SetSort(bson.M{"_id": 1}))
+	endMongoSpan(span, err)
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+	var value []byte
+	n := 0
+	for cur.Next(ctx) {
+		c := &ChunkItem{}
+		if err := cur.Decode(c); err != nil {
+			return nil, err
+		}
+		if c.N != n {
+			break
+		}
+		value = append(value, c.Data...)
+		n++
+	}
+	if err := cur.Err(); err != nil {
+		return nil, err
+	}
+	if n != b.Chunks {
+		return nil, xerrors.Errorf("block %s has %d of %d chunks", b.ID, n, b.Chunks)
+	}
+	return dsm.decodeBlock(b, value)
+}
+
+// decodeBlock restores the value of b from the bytes stored
+func (dsm *DSMongo) decodeBlock(b *StoreItem, data []byte) ([]byte, error) {
+	data, err := dsm.open(b, data)
+	if err != nil {
+		return nil, err
+	}
+	return decodeValue(data, b.Codec)
+}
+
+// cleanupChunks removes chunk generations no block points to, such as those
+// of failed puts or of blocks deleted by CleanupOrphans. Generations younger
+// than cutoff may belong to puts in progress.
+func (dsm *DSMongo) cleanupChunks(ctx context.Context, cutoff time.Time, dryRun bool) (int64, error) {
+	cstore := dsm.chunks()
+	dstore := dsm.ds()
+	sctx, span := mongoSpan(ctx, "Aggregate", cstore)
+	cur, err := cstore.Aggregate(sctx, mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"n": 0, "created_at": bson.M{"$lt": cutoff}}}},
+		{{Key: "$lookup", Value: bson.M{"from": dstore.Name(), "localField": "block", "foreignField": "_id", "as": "blocks"}}},
+		{{Key: "$match", Value: bson.M{"$expr": bson.M{"$not": bson.A{bson.M{"$in": bson.A{"$gen", "$blocks.chunk_gen"}}}}}}},
+		{{Key: "$project", Value: bson.M{"block": 1, "gen": 1}}},
+	})
+	endMongoSpan(span, err)
+	if err != nil {
+		return 0, err
+	}
+	defer cur.Close(ctx)
+
+	var removed int64
+	for cur.Next(ctx) {
+		c := &ChunkItem{}
+		if err := cur.Decode(c); err != nil {
+			return removed, err
+		}
+		removed++
+		if dryRun {
+			continue
+		}
+		sctx, span := mongoSpan(ctx, "DeleteMany", cstore)
+		_, err := cstore.DeleteMany(sctx, chunkRange(c.Block, c.Gen))
+		endMongoSpan(span, err)
+		if err != nil {
+			return removed, err
+		}
+	}
+	return removed, cur.Err()
+}
@@ -3,20 +3,54 @@ package dsmongo
 import (
 	dsrpc "github.com/beeleelee/go-ds-rpc"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
 )
 
 var _ dsrpc.KVStoreClient = (*MongoStoreClient)(nil)
 
+// DefaultMaxMessageSize bounds the grpc messages of servers and clients,
+// and so the values they exchange, grpc's own default is 4 MiB
+const DefaultMaxMessageSize = 64 << 20
+
 type MongoStoreClient struct {
 	conn *grpc.ClientConn
 	dsrpc.KVStoreClient
 }
 
+type ClientOptions struct {
+	// TLS enables transport security, nil dials without it
+	TLS *ClientTLSOptions
+	// MaxMessageSize is DefaultMaxMessageSize if 0
+	MaxMessageSize int
+}
+
 func NewMongoStoreClient(srv string) (*MongoStoreClient, error) {
+	return NewMongoStoreClientWithOptions(srv, ClientOptions{})
+}
+
+// NewMongoStoreClientWithOptions dials srv, a "host:port" address or a unix
+// socket as "unix:///run/mongods.sock" or "/run/mongods.sock".
+func NewMongoStoreClientWithOptions(srv string, opts ClientOptions) (*MongoStoreClient, error) {
 	if srv == "" {
 		logging.Fatal("mongostore rpc server address is missing")
 	}
-	conn, err := grpc.Dial(srv, grpc.WithInsecure(), grpc.WithBlock())
+	if opts.MaxMessageSize == 0 {
+		opts.MaxMessageSize = DefaultMaxMessageSize
+	}
+	dialOpts := []grpc.DialOption{
+		grpc.WithBlock(),
+		grpc.WithDefaultCallOptions(grpc.MaxCallRecvMsgSize(opts.MaxMessageSize), grpc.MaxCallSendMsgSize(opts.MaxMessageSize)),
+	}
+	if opts.TLS != nil {
+		cfg, err := ClientTLSConfig(*opts.TLS)
+		if err != nil {
+			return nil, err
+		}
+		dialOpts = append(dialOpts, grpc.WithTransportCredentials(credentials.NewTLS(cfg)))
+	} else {
+		dialOpts = append(dialOpts, grpc.WithInsecure())
+	}
+	conn, err := grpc.Dial(dialTarget(srv), dialOpts...)
 	if err != nil {
 		return nil, err
 	}
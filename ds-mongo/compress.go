@@ -0,0 +1,91 @@
+package dsmongo
+
+import (
+	"sync"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+	"golang.org/x/xerrors"
+)
+
+// Codecs of Options.Compression and StoreItem.Codec
+const (
+	CodecNone   = ""
+	CodecZstd   = "zstd"
+	CodecSnappy = "snappy"
+)
+
+// minCompressSize is the smallest value worth compressing
+const minCompressSize = 64
+
+func validCodec(codec string) error {
+	switch codec {
+	case CodecNone, "none", CodecZstd, CodecSnappy:
+		return nil
+	}
+	return xerrors.Errorf("invalid compression %q, want zstd, snappy or none", codec)
+}
+
+var (
+	zstdOnce sync.Once
+	zstdEnc  *zstd.Encoder
+	zstdDec  *zstd.Decoder
+	zstdErr  error
+)
+
+// zstdCodec returns an encoder and decoder shared by all stores, both are
+// safe for concurrent EncodeAll and DecodeAll calls
+func zstdCodec() (*zstd.Encoder, *zstd.Decoder, error) {
+	zstdOnce.Do(func() {
+		zstdEnc, zstdErr = zstd.NewWriter(nil)
+		if zstdErr == nil {
+			zstdDec, zstdErr = zstd.NewReader(nil)
+		}
+	})
+	return zstdEnc, zstdDec, zstdErr
+}
+
+// encodeValue compresses value with the codec of Options.Compression and
+// returns the bytes to store with their codec. Values that don't shrink are
+// stored as they are.
+func (dsm *DSMongo) encodeValue(value []byte) ([]byte, string) {
+	if len(value) < minCompressSize {
+		return value, CodecNone
+	}
+	var out []byte
+	switch dsm.opts.Compression {
+	case CodecZstd:
+		enc, _, err := zstdCodec()
+		if err != nil {
+			logging.Errorf("zstd: %s", err)
+			return value, CodecNone
+		}
+		out = enc.EncodeAll(value, nil)
+	case CodecSnappy:
+		out = snappy.Encode(nil, value)
+	default:
+		return value, CodecNone
+	}
+	if len(out) >= len(value) {
+		return value, CodecNone
+	}
+	return out, dsm.opts.Compression
+}
+
+// decodeValue restores a value stored with codec, blocks written before
+// compression have none
+func decodeValue(stored []byte, codec string) ([]byte, error) {
+	switch codec {
+	case CodecNone:
+		return stored, nil
+	case CodecZstd:
+		_, dec, err := zstdCodec()
+		if err != nil {
+			return nil, err
+		}
+		return dec.DecodeAll(stored, nil)
+	case CodecSnappy:
+		return snappy.Decode(nil, stored)
+	}
+	return nil, xerrors.Errorf("unknown codec %q", codec)
+}
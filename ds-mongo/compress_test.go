@@ -0,0 +1,33 @@
+package dsmongo
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+func TestCompressValues(t *testing.T) {
+	text := bytes.Repeat([]byte("compressible "), 100)
+	noise := make([]byte, 1000)
+	rand.Read(noise)
+	for _, codec := range []string{CodecZstd, CodecSnappy} {
+		dsm := &DSMongo{opts: Options{Compression: codec}}
+		stored, got := dsm.encodeValue(text)
+		if got != codec || len(stored) >= len(text) {
+			t.Errorf("%s: got codec %q and %d bytes", codec, got, len(stored))
+		}
+		v, err := decodeValue(stored, got)
+		if err != nil || !bytes.Equal(v, text) {
+			t.Errorf("%s: roundtrip failed: %v", codec, err)
+		}
+		// values that don't shrink and tiny ones are stored as they are
+		for _, raw := range [][]byte{noise, []byte("tiny")} {
+			if stored, got := dsm.encodeValue(raw); got != CodecNone || !bytes.Equal(stored, raw) {
+				t.Errorf("%s: %d bytes stored with codec %q", codec, len(raw), got)
+			}
+		}
+	}
+	if _, err := decodeValue(text, "lz4"); err == nil {
+		t.Error("unknown codec decoded")
+	}
+}
@@ -0,0 +1,73 @@
+package dsmongo
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/stats"
+)
+
+type connInfo struct {
+	remote, local string
+	since         time.Time
+}
+
+type connKey struct{}
+
+// connTracker is a grpc stats.Handler keeping the open client connections
+type connTracker struct {
+	mu    sync.Mutex
+	conns map[*connInfo]struct{}
+}
+
+var _ stats.Handler = (*connTracker)(nil)
+
+func newConnTracker() *connTracker {
+	return &connTracker{conns: map[*connInfo]struct{}{}}
+}
+
+func (t *connTracker) TagConn(ctx context.Context, info *stats.ConnTagInfo) context.Context {
+	ci := &connInfo{since: time.Now()}
+	if info.RemoteAddr != nil {
+		ci.remote = info.RemoteAddr.String()
+	}
+	if info.LocalAddr != nil {
+		ci.local = info.LocalAddr.String()
+	}
+	return context.WithValue(ctx, connKey{}, ci)
+}
+
+func (t *connTracker) HandleConn(ctx context.Context, s stats.ConnStats) {
+	ci, ok := ctx.Value(connKey{}).(*connInfo)
+	if !ok {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	switch s.(type) {
+	case *stats.ConnBegin:
+		t.conns[ci] = struct{}{}
+	case *stats.ConnEnd:
+		delete(t.conns, ci)
+	}
+}
+
+func (t *connTracker) TagRPC(ctx context.Context, _ *stats.RPCTagInfo) context.Context {
+	return ctx
+}
+
+func (t *connTracker) HandleRPC(context.Context, stats.RPCStats) {}
+
+// list returns the open connections, oldest first
+func (t *connTracker) list() []connInfo {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	out := make([]connInfo, 0, len(t.conns))
+	for ci := range t.conns {
+		out = append(out, *ci)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].since.Before(out[j].since) })
+	return out
+}
@@ -0,0 +1,359 @@
+package dsmongo
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"golang.org/x/xerrors"
+)
+
+// KeyProvider supplies the master keys wrapping the data key of every
+// encrypted block, and the key of the hash identifying blocks.
+type KeyProvider interface {
+	// CurrentKey returns the id and the key new data keys are wrapped with
+	CurrentKey() (string, []byte, error)
+	// Key returns the master key id, which may no longer be current
+	Key(id string) ([]byte, error)
+	// HashKey keys the block ids. Blocks stored under another hash key are
+	// still read, but new puts no longer deduplicate against them.
+	HashKey() ([]byte, error)
+}
+
+// DataKey is the key a block is encrypted with, wrapped by a master key
+type DataKey struct {
+	KeyID   string `bson:"kid"`
+	Wrapped []byte `bson:"wrapped"`
+}
+
+// keySize of master, hash and data keys, for AES-256
+const keySize = 32
+
+// KeysFile is the layout of the file passed to --db-keys-file, keys are 32
+// bytes encoded with base64, e.g.
+//
+//	{
+//	    "hash_key": "q83vEjRWeJq83vEjRWeJq83vEjRWeJq83vEjRWeJq80=",
+//	    "current": "2024-06",
+//	    "keys": {
+//	        "2024-01": "3q2+7wAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=",
+//	        "2024-06": "yv66vgAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA="
+//	    }
+//	}
+//
+// To rotate, add a key, make it current and call the Admin RewrapKeys rpc.
+// The old key can go once a dry run reports nothing left to rewrap.
+type KeysFile struct {
+	HashKey string            `json:"hash_key"`
+	Current string            `json:"current"`
+	Keys    map[string]string `json:"keys"`
+}
+
+type keyRing struct {
+	hashKey []byte
+	current string
+	keys    map[string][]byte
+}
+
+func decodeKey(name, s string) ([]byte, error) {
+	k, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, xerrors.Errorf("%s: %w", name, err)
+	}
+	if len(k) != keySize {
+		return nil, xerrors.Errorf("%s has %d bytes, want %d", name, len(k), keySize)
+	}
+	return k, nil
+}
+
+func loadKeyRing(file string) (*keyRing, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	kf := KeysFile{}
+	if err := json.Unmarshal(b, &kf); err != nil {
+		return nil, xerrors.Errorf("parse %s: %w", file, err)
+	}
+	kr := &keyRing{current: kf.Current, keys: map[string][]byte{}}
+	if kr.hashKey, err = decodeKey("hash_key", kf.HashKey); err != nil {
+		return nil, err
+	}
+	for id, s := range kf.Keys {
+		if kr.keys[id], err = decodeKey("key "+id, s); err != nil {
+			return nil, err
+		}
+	}
+	if kr.keys[kf.Current] == nil {
+		return nil, xerrors.Errorf("current key %q is missing from %s", kf.Current, file)
+	}
+	return kr, nil
+}
+
+// FileKeyProvider reads a KeysFile, reloading it when its modification time
+// changes. A changed hash key is refused.
+type FileKeyProvider struct {
+	file string
+
+	mu   sync.Mutex
+	ring *keyRing
+	mod  time.Time
+}
+
+var _ KeyProvider = (*FileKeyProvider)(nil)
+
+func NewFileKeyProvider(file string) (*FileKeyProvider, error) {
+	p := &FileKeyProvider{file: file}
+	if _, err := p.get(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func (p *FileKeyProvider) get() (*keyRing, error) {
+	mod, err := modTime(p.file)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.ring != nil && (err != nil || mod.Equal(p.mod)) {
+		return p.ring, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	ring, err := loadKeyRing(p.file)
+	if err == nil && p.ring != nil && !hmac.Equal(ring.hashKey, p.ring.hashKey) {
+		err = xerrors.New("hash_key changed, which would stop deduplication")
+	}
+	if err != nil {
+		if p.ring != nil {
+			// keep the old keys while the file is half written
+			logging.Warnf("reload keys %s: %s", p.file, err)
+			return p.ring, nil
+		}
+		return nil, err
+	}
+	if p.ring != nil {
+		logging.Infof("reloaded keys %s, current key %s", p.file, ring.current)
+	}
+	p.ring = ring
+	p.mod = mod
+	return p.ring, nil
+}
+
+func (p *FileKeyProvider) CurrentKey() (string, []byte, error) {
+	ring, err := p.get()
+	if err != nil {
+		return "", nil, err
+	}
+	return ring.current, ring.keys[ring.current], nil
+}
+
+func (p *FileKeyProvider) Key(id string) ([]byte, error) {
+	ring, err := p.get()
+	if err != nil {
+		return nil, err
+	}
+	k := ring.keys[id]
+	if k == nil {
+		return nil, xerrors.Errorf("unknown key %q", id)
+	}
+	return k, nil
+}
+
+func (p *FileKeyProvider) HashKey() ([]byte, error) {
+	ring, err := p.get()
+	if err != nil {
+		return nil, err
+	}
+	return ring.hashKey, nil
+}
+
+// blockID identifies the block of value, by its sha256 or, with encryption,
+// by its HMAC-SHA256 so ids reveal nothing about the values
+func (dsm *DSMongo) blockID(value []byte) (string, error) {
+	if dsm.keys == nil {
+		return sha256String(value), nil
+	}
+	hk, err := dsm.keys.HashKey()
+	if err != nil {
+		return "", err
+	}
+	mac := hmac.New(sha256.New, hk)
+	mac.Write(value)
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+// gcmSeal encrypts data with key, the nonce leads the result. The block id
+// is authenticated with it so stored values can't be swapped.
+func gcmSeal(key, data []byte, hk string) ([]byte, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(data)+aead.Overhead())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, data, []byte(hk)), nil
+}
+
+func gcmOpen(key, sealed []byte, hk string) ([]byte, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, xerrors.New("ciphertext too short")
+	}
+	n := aead.NonceSize()
+	return aead.Open(nil, sealed[:n], sealed[n:], []byte(hk))
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// seal encrypts data of block hk with a new data key, wrapped by the
+// current master key
+func (dsm *DSMongo) seal(hk string, data []byte) ([]byte, *DataKey, error) {
+	kid, master, err := dsm.keys.CurrentKey()
+	if err != nil {
+		return nil, nil, err
+	}
+	dk := make([]byte, keySize)
+	if _, err := io.ReadFull(rand.Reader, dk); err != nil {
+		return nil, nil, err
+	}
+	sealed, err := gcmSeal(dk, data, hk)
+	if err != nil {
+		return nil, nil, err
+	}
+	wrapped, err := gcmSeal(master, dk, hk)
+	if err != nil {
+		return nil, nil, err
+	}
+	return sealed, &DataKey{KeyID: kid, Wrapped: wrapped}, nil
+}
+
+// open decrypts the stored data of b, blocks stored in the clear have no
+// data key
+func (dsm *DSMongo) open(b *StoreItem, data []byte) ([]byte, error) {
+	if b.Key == nil {
+		return data, nil
+	}
+	if dsm.keys == nil {
+		return nil, xerrors.Errorf("block %s is encrypted and no keys are configured", b.ID)
+	}
+	dk, err := dsm.unwrap(b.ID, b.Key)
+	if err != nil {
+		return nil, err
+	}
+	v, err := gcmOpen(dk, data, b.ID)
+	if err != nil {
+		return nil, xerrors.Errorf("decrypt block %s: %w", b.ID, err)
+	}
+	return v, nil
+}
+
+func (dsm *DSMongo) unwrap(hk string, key *DataKey) ([]byte, error) {
+	master, err := dsm.keys.Key(key.KeyID)
+	if err != nil {
+		return nil, xerrors.Errorf("block %s: %w", hk, err)
+	}
+	dk, err := gcmOpen(master, key.Wrapped, hk)
+	if err != nil {
+		return nil, xerrors.Errorf("unwrap data key of block %s: %w", hk, err)
+	}
+	return dk, nil
+}
+
+// encodeBlock compresses and encrypts value as the options ask, it returns
+// the bytes to store and the fields telling how to read them back
+func (dsm *DSMongo) encodeBlock(hk string, value []byte) ([]byte, bson.M, error) {
+	data, codec := dsm.encodeValue(value)
+	enc := bson.M{}
+	if codec != CodecNone {
+		enc["codec"] = codec
+	}
+	if dsm.keys != nil {
+		var key *DataKey
+		var err error
+		data, key, err = dsm.seal(hk, data)
+		if err != nil {
+			return nil, nil, err
+		}
+		enc["key"] = key
+	}
+	return data, enc, nil
+}
+
+// RewrapKeys wraps the data keys of blocks wrapped by a master key that is
+// no longer current with the current one, the blocks themselves are not
+// rewritten. It returns how many were rewrapped, or found with dryRun.
+func (dsm *DSMongo) RewrapKeys(ctx context.Context, dryRun bool) (int64, error) {
+	if dsm.keys == nil {
+		return 0, xerrors.New("encryption is not configured")
+	}
+	kid, master, err := dsm.keys.CurrentKey()
+	if err != nil {
+		return 0, err
+	}
+	dstore := dsm.ds()
+	filter := bson.M{"key.kid": bson.M{"$exists": true, "$ne": kid}}
+	if dryRun {
+		sctx, span := mongoSpan(ctx, "CountDocuments", dstore)
+		n, err := dstore.CountDocuments(sctx, filter)
+		endMongoSpan(span, err)
+		return n, err
+	}
+	sctx, span := mongoSpan(ctx, "Find", dstore)
+	cur, err := dstore.Find(sctx, filter, options.Find().SetProjection(bson.M{"key": 1}))
+	endMongoSpan(span, err)
+	if err != nil {
+		return 0, err
+	}
+	defer cur.Close(ctx)
+	var n int64
+	for cur.Next(ctx) {
+		b := &StoreItem{}
+		if err := cur.Decode(b); err != nil {
+			return n, err
+		}
+		dk, err := dsm.unwrap(b.ID, b.Key)
+		if err != nil {
+			return n, err
+		}
+		wrapped, err := gcmSeal(master, dk, b.ID)
+		if err != nil {
+			return n, err
+		}
+		// a block released and stored again meanwhile has a new data key
+		sctx, span := mongoSpan(ctx, "UpdateOne", dstore)
+		res, err := dstore.UpdateOne(sctx,
+			bson.M{"_id": b.ID, "key.kid": b.Key.KeyID, "key.wrapped": b.Key.Wrapped},
+			bson.M{"$set": bson.M{"key": &DataKey{KeyID: kid, Wrapped: wrapped}}})
+		endMongoSpan(span, err)
+		if err != nil {
+			return n, err
+		}
+		n += res.ModifiedCount
+	}
+	return n, cur.Err()
+}
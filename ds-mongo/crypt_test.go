@@ -0,0 +1,87 @@
+package dsmongo
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeKeysFile(t *testing.T, file string, kf KeysFile, mod time.Time) {
+	b, err := json.Marshal(kf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(file, b, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(file, mod, mod); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testKey(b byte) string {
+	return base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{b}, keySize))
+}
+
+func TestEncryptValues(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "keys.json")
+	kf := KeysFile{HashKey: testKey(1), Current: "a", Keys: map[string]string{"a": testKey(2)}}
+	now := time.Now()
+	writeKeysFile(t, file, kf, now)
+	keys, err := NewFileKeyProvider(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dsm := &DSMongo{opts: Options{Compression: CodecZstd}, keys: keys}
+
+	value := bytes.Repeat([]byte("secret "), 100)
+	hk, err := dsm.blockID(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := dsm.blockID(value); again != hk || hk == sha256String(value) {
+		t.Errorf("block id %s is not a stable keyed hash", hk)
+	}
+	data, enc, err := dsm.encodeBlock(hk, value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(data, []byte("secret")) || enc["codec"] != CodecZstd {
+		t.Fatalf("stored %d bytes with %v", len(data), enc)
+	}
+	b := &StoreItem{ID: hk, Codec: CodecZstd, Key: enc["key"].(*DataKey)}
+	if v, err := dsm.decodeBlock(b, data); err != nil || !bytes.Equal(v, value) {
+		t.Fatalf("roundtrip failed: %v", err)
+	}
+	// the block id is authenticated
+	if _, err := dsm.decodeBlock(&StoreItem{ID: "other", Codec: CodecZstd, Key: b.Key}, data); err == nil {
+		t.Error("value decrypted under another block id")
+	}
+
+	// a rotation keeps the old key readable
+	kf.Keys["b"], kf.Current = testKey(3), "b"
+	writeKeysFile(t, file, kf, now.Add(time.Second))
+	if kid, _, err := keys.CurrentKey(); err != nil || kid != "b" {
+		t.Fatalf("current key %q after reload: %v", kid, err)
+	}
+	if v, err := dsm.decodeBlock(b, data); err != nil || !bytes.Equal(v, value) {
+		t.Fatalf("decrypt with the old key: %v", err)
+	}
+
+	// a new hash key is refused
+	kf.HashKey = testKey(4)
+	writeKeysFile(t, file, kf, now.Add(2*time.Second))
+	if again, _ := dsm.blockID(value); again != hk {
+		t.Error("hash key changed on reload")
+	}
+
+	kf.Current = "missing"
+	writeKeysFile(t, file, kf, now)
+	if _, err := NewFileKeyProvider(file); err == nil {
+		t.Error("keys file without its current key loaded")
+	}
+}
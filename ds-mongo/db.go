@@ -2,14 +2,17 @@ package dsmongo
 
 import (
 	"context"
+	"strconv"
+	"sync"
 	"time"
 
 	dsq "github.com/ipfs/go-datastore/query"
 	log "github.com/ipfs/go-log/v2"
+	"github.com/prometheus/client_golang/prometheus"
 	"go.mongodb.org/mongo-driver/bson"
-	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/writeconcern"
 	"golang.org/x/xerrors"
 )
 
@@ -26,20 +29,78 @@ type Options struct {
 	DBName        string
 	StoreName     string
 	StoreRefsName string
+	// Mongo driver settings, zero values keep the driver defaults
+	MaxPoolSize            uint64
+	MinPoolSize            uint64
+	ConnectTimeout         time.Duration
+	ServerSelectionTimeout time.Duration
+	SocketTimeout          time.Duration
+	// WriteConcern is "majority", a number of nodes like "1", or empty for
+	// the default of the deployment
+	WriteConcern string
+	// Journal requires writes to be acknowledged after the journal commit
+	Journal bool
+	// Transactions is TxnAuto, TxnAlways or TxnNever, auto if empty
+	Transactions string
+	// Indexes is IndexBackground, IndexEnsure or IndexSkip, background if
+	// empty
+	Indexes string
+	// Registerer receives the server metrics, nil disables them
+	Registerer prometheus.Registerer
+	// ReadOnly makes MongoStore reject mutations with PermissionDenied
+	ReadOnly bool
+	// TokensFile enables token authentication, see TokensFile
+	TokensFile string
+	// AdminTokensFile gives the Admin service its own tokens, which need the
+	// admin op. Tokens of TokensFile then only cover KVStore.
+	AdminTokensFile string
+	// RateLimit bounds requests and bytes per client and bytes per namespace
+	RateLimit RateLimitOptions
+	// Audit records every mutation attempt, see AuditOptions
+	Audit AuditOptions
+	// Compression is CodecZstd or CodecSnappy to compress values before
+	// they are stored, empty for none. Blocks record their codec, so it can
+	// change at any time.
+	Compression string
+	// KeysFile enables encryption of stored values, see KeysFile
+	KeysFile string
+	// KeyProvider enables encryption with other keys than a KeysFile
+	KeyProvider KeyProvider
+	// ChunkThreshold is the largest value stored inside its block document,
+	// larger ones are split into a chunk collection. DefaultChunkThreshold
+	// if 0, at most MaxChunkThreshold.
+	ChunkThreshold int64
+	// QueryBatchSize is the number of refs whose blocks Query fetches at
+	// once, DefaultQueryBatchSize if 0
+	QueryBatchSize int
+	// MaxMessageSize bounds the grpc messages of MongoStore, and so the
+	// values it accepts. DefaultMaxMessageSize if 0.
+	MaxMessageSize int
 }
 
 func DefaultOptions() Options {
 	return Options{
-		Uri:           "mongodb://localhost:27017",
-		DBName:        db_name,
-		StoreName:     store_name,
-		StoreRefsName: store_refs_name,
+		Uri:            "mongodb://localhost:27017",
+		DBName:         db_name,
+		StoreName:      store_name,
+		StoreRefsName:  store_refs_name,
+		ChunkThreshold: DefaultChunkThreshold,
+		MaxMessageSize: DefaultMaxMessageSize,
+		QueryBatchSize: DefaultQueryBatchSize,
 	}
 }
 
 type DSMongo struct {
-	client *mongo.Client
-	opts   Options
+	client  *mongo.Client
+	opts    Options
+	metrics *Metrics
+	// txn is set when Put and Delete run in transactions
+	txn bool
+	// keys is set when values are encrypted
+	keys KeyProvider
+
+	indexMu    sync.Mutex
+	indexBuild string
 }
 
 func NewDSMongo(opts Options) (*DSMongo, error) {
@@ -56,8 +117,35 @@ func NewDSMongo(opts Options) (*DSMongo, error) {
 	if opts.StoreRefsName == "" {
 		opts.StoreRefsName = defaultOpts.StoreRefsName
 	}
+	if opts.ChunkThreshold == 0 {
+		opts.ChunkThreshold = defaultOpts.ChunkThreshold
+	}
+	if opts.MaxMessageSize == 0 {
+		opts.MaxMessageSize = defaultOpts.MaxMessageSize
+	}
+	if opts.QueryBatchSize == 0 {
+		opts.QueryBatchSize = defaultOpts.QueryBatchSize
+	}
 	var err error
-	mgoClient, err := mongo.NewClient(options.Client().ApplyURI(opts.Uri))
+	keys := opts.KeyProvider
+	if keys == nil && opts.KeysFile != "" {
+		keys, err = NewFileKeyProvider(opts.KeysFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+	var metrics *Metrics
+	if opts.Registerer != nil {
+		metrics, err = NewMetrics(opts.Registerer)
+		if err != nil {
+			return nil, err
+		}
+	}
+	clientOpts, err := opts.clientOptions()
+	if err != nil {
+		return nil, err
+	}
+	mgoClient, err := mongo.NewClient(clientOpts)
 	if err != nil {
 		return nil, err
 	}
@@ -69,24 +157,133 @@ func NewDSMongo(opts Options) (*DSMongo, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &DSMongo{
-		client: mgoClient,
-		opts:   opts,
-	}, nil
+	dsm := &DSMongo{
+		client:  mgoClient,
+		opts:    opts,
+		metrics: metrics,
+		keys:    keys,
+	}
+	if err := dsm.setupTxn(ctx); err != nil {
+		mgoClient.Disconnect(context.Background())
+		return nil, err
+	}
+	if err := dsm.setupIndexes(); err != nil {
+		mgoClient.Disconnect(context.Background())
+		return nil, err
+	}
+	return dsm, nil
+}
+
+func (opts Options) clientOptions() (*options.ClientOptions, error) {
+	co := options.Client().ApplyURI(opts.Uri)
+	if opts.MaxPoolSize > 0 {
+		co.SetMaxPoolSize(opts.MaxPoolSize)
+	}
+	if opts.MinPoolSize > 0 {
+		co.SetMinPoolSize(opts.MinPoolSize)
+	}
+	if opts.ConnectTimeout > 0 {
+		co.SetConnectTimeout(opts.ConnectTimeout)
+	}
+	if opts.ServerSelectionTimeout > 0 {
+		co.SetServerSelectionTimeout(opts.ServerSelectionTimeout)
+	}
+	if opts.SocketTimeout > 0 {
+		co.SetSocketTimeout(opts.SocketTimeout)
+	}
+	wc, err := writeConcern(opts.WriteConcern, opts.Journal)
+	if err != nil {
+		return nil, err
+	}
+	if wc != nil {
+		co.SetWriteConcern(wc)
+	}
+	return co, nil
+}
+
+// writeConcern parses Options.WriteConcern, nil keeps the deployment default
+func writeConcern(w string, journal bool) (*writeconcern.WriteConcern, error) {
+	var wopts []writeconcern.Option
+	switch w {
+	case "":
+	case "majority":
+		wopts = append(wopts, writeconcern.WMajority())
+	default:
+		n, err := strconv.Atoi(w)
+		if err != nil || n < 0 {
+			return nil, xerrors.Errorf("invalid write concern %q, want \"majority\" or a number of nodes", w)
+		}
+		wopts = append(wopts, writeconcern.W(n))
+	}
+	if journal {
+		wopts = append(wopts, writeconcern.J(true))
+	}
+	if len(wopts) == 0 {
+		return nil, nil
+	}
+	return writeconcern.New(wopts...), nil
+}
+
+// Validate checks the settings NewDSMongo and NewMongoStore would reject
+// late, such as a malformed write concern.
+func (opts Options) Validate() error {
+	if _, err := writeConcern(opts.WriteConcern, opts.Journal); err != nil {
+		return err
+	}
+	if err := validTxnMode(opts.Transactions); err != nil {
+		return err
+	}
+	if err := validIndexMode(opts.Indexes); err != nil {
+		return err
+	}
+	if err := validCodec(opts.Compression); err != nil {
+		return err
+	}
+	if opts.MaxPoolSize > 0 && opts.MinPoolSize > opts.MaxPoolSize {
+		return xerrors.Errorf("min pool size %d exceeds max pool size %d", opts.MinPoolSize, opts.MaxPoolSize)
+	}
+	if opts.ChunkThreshold < 0 || opts.ChunkThreshold > MaxChunkThreshold {
+		return xerrors.Errorf("chunk threshold must be between 0 and %d", MaxChunkThreshold)
+	}
+	if opts.MaxMessageSize < 0 || opts.QueryBatchSize < 0 {
+		return xerrors.New("max message size and query batch size must not be negative")
+	}
+	rl := opts.RateLimit
+	if rl.RequestsPerSecond < 0 || rl.BytesPerSecond < 0 || rl.RequestBurst < 0 || rl.ByteBurst < 0 {
+		return xerrors.New("rate limits must not be negative")
+	}
+	for ns, q := range rl.NamespaceQuotas {
+		if q < 0 {
+			return xerrors.Errorf("quota of %s must not be negative", ns)
+		}
+	}
+	return validateAudit(opts.Audit)
 }
 
 type StoreItem struct {
-	ID        string    `bson:"_id" json:"_id"`             // sha256 hash
-	Value     []byte    `bson:"value" json:"value"`         // value
+	ID    string `bson:"_id" json:"_id"`     // sha256 hash
+	Value []byte `bson:"value" json:"value"` // value
+	// Codec compressed Value, or the chunks, CodecNone for blocks stored
+	// as they are
+	Codec string `bson:"codec,omitempty" json:"codec,omitempty"`
+	// Key encrypted Value, or the chunks, nil for blocks stored in the
+	// clear
+	Key *DataKey `bson:"key,omitempty" json:"-"`
+	// Chunks counts the chunks of a value above Options.ChunkThreshold,
+	// which is then stored in the chunk collection, see ChunkItem
+	Chunks    int       `bson:"chunks,omitempty" json:"chunks,omitempty"`
+	ChunkGen  string    `bson:"chunk_gen,omitempty" json:"chunk_gen,omitempty"`
 	RefCount  int       `bson:"ref_count" json:"ref_count"` // deprecated
 	CreatedAt time.Time `bson:"created_at" json:"created_at"`
+	// LinkedAt is the last time a put referenced the block
+	LinkedAt time.Time `bson:"linked_at,omitempty" json:"linked_at,omitempty"`
 }
 
 type RefItem struct {
 	ID        string    `bson:"_id" json:"_id"` // key
 	Ref       string    `bson:"ref" json:"ref"` // value
 	Size      int64     `bson:"size" json:"size"`
-	NID       []string  `bson:"nid" json:"nid"`
+	NID       []string  `bson:"nid" json:"nid"` // nodes holding the ref, nil if shared, see WithNode
 	CreatedAt time.Time `bson:"created_at" json:"created_at"`
 }
 
@@ -95,16 +292,17 @@ type RefItem struct {
 // 	Size int64  `bson:"size" json:"size"`
 // }
 
-type onlyRefCount struct {
-	RefCount int `bson:"ref_count" json:"ref_count"`
-}
-
 func (dsm *DSMongo) Close() error {
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 	return dsm.client.Disconnect(ctx)
 }
 
+// Ping checks that the deployment answers
+func (dsm *DSMongo) Ping(ctx context.Context) error {
+	return dsm.client.Ping(ctx, nil)
+}
+
 func (dsm *DSMongo) ds() *mongo.Collection {
 	return dsm.client.Database(dsm.opts.DBName).Collection(dsm.opts.StoreName)
 }
@@ -112,79 +310,277 @@ func (dsm *DSMongo) refs() *mongo.Collection {
 	return dsm.client.Database(dsm.opts.DBName).Collection(dsm.opts.StoreRefsName)
 }
 
+// Put stores the block of item and points ref to it, releasing the block
+// ref pointed to before. It runs in a transaction if the deployment supports
+// them.
 func (dsm *DSMongo) Put(ctx context.Context, item *StoreItem, ref *RefItem) error {
-	dstore := dsm.ds()
-	refstore := dsm.refs()
-
-	// 先看 refs 里是否存在记录
-	hasref, _ := dsm.hasRef(ctx, ref.ID)
+	return dsm.withTxn(ctx, func(ctx context.Context) error {
+		return dsm.put(ctx, item, ref)
+	})
+}
 
-	// 再看 blocks 里是否有记录
-	refCount := &onlyRefCount{}
-	err := dstore.FindOne(ctx, bson.M{"_id": item.ID}).Decode(refCount)
-	if err != nil && err != mongo.ErrNoDocuments {
-		return err
-	}
-	if err == mongo.ErrNoDocuments { // 初次保存数据块
-		item.RefCount = 1
-		item.CreatedAt = time.Now()
-		_, err := dstore.InsertOne(ctx, item)
-		if err != nil {
+// put costs two idempotent writes, one more round trip and the release of
+// the old block when a key is overwritten with new content
+func (dsm *DSMongo) put(ctx context.Context, item *StoreItem, ref *RefItem) error {
+	refstore := dsm.refs()
+	now := time.Now()
+	size := int64(len(item.Value))
+
+	// 先保存引用, the block is written after it, so that a delete releasing
+	// the same block concurrently either sees the ref or is undone by the
+	// block write below
+	old := &RefItem{}
+	nid := NodeID(ctx)
+	set := bson.M{"ref": item.ID, "size": size}
+	findOpts := options.FindOneAndUpdate().
+		SetReturnDocument(options.Before).
+		SetProjection(bson.M{"ref": 1, "size": 1, "nid": 1})
+	upsertOpts := options.MergeFindOneAndUpdateOptions(findOpts).SetUpsert(true)
+	err := retryUpsert(ctx, func() error {
+		if nid == "" {
+			sctx, span := mongoSpan(ctx, "FindOneAndUpdate", refstore)
+			err := refstore.FindOneAndUpdate(sctx, bson.M{"_id": ref.ID}, bson.M{
+				"$set":         set,
+				"$setOnInsert": bson.M{"nid": ref.NID, "created_at": now},
+			}, upsertOpts).Decode(old)
+			endMongoSpan(span, err)
+			return err
+		}
+		// the node claims a shared ref, $addToSet would fail on its null nid
+		claim := bson.M{"nid": bson.A{nid}}
+		for k, v := range set {
+			claim[k] = v
+		}
+		sctx, span := mongoSpan(ctx, "FindOneAndUpdate", refstore)
+		err := refstore.FindOneAndUpdate(sctx, bson.M{"_id": ref.ID, "nid": nil}, bson.M{"$set": claim}, findOpts).Decode(old)
+		endMongoSpan(span, err)
+		if err != mongo.ErrNoDocuments {
 			return err
 		}
+		// a shared ref inserted meanwhile fails this with a duplicate key
+		sctx, span = mongoSpan(ctx, "FindOneAndUpdate", refstore)
+		err = refstore.FindOneAndUpdate(sctx, bson.M{"_id": ref.ID, "nid": bson.M{"$ne": nil}}, bson.M{
+			"$set":         set,
+			"$addToSet":    bson.M{"nid": nid},
+			"$setOnInsert": bson.M{"created_at": now},
+		}, upsertOpts).Decode(old)
+		endMongoSpan(span, err)
+		return err
+	})
+	if err == mongo.ErrNoDocuments {
+		old = nil
+	} else if err != nil {
+		return err
 	}
 
-	// 保存引用
-	if !hasref {
-		ref.Size = int64(len(item.Value))
-		ref.CreatedAt = time.Now()
-		ref.Ref = item.ID
-		_, err = refstore.InsertOne(ctx, ref)
-		if err != nil {
-			return err
+	// 再保存数据块. linked_at is written even if the block exists, so that a
+	// transaction deleting the block conflicts with this one
+	created, err := dsm.writeBlock(ctx, item.ID, item.Value, now)
+	if err != nil {
+		if !inTxn(ctx) {
+			dsm.restoreRef(ctx, ref.ID, item.ID, nid, old)
 		}
+		return err
+	}
+	if !created {
+		dsm.metrics.dedupHit()
 	}
 
-	//logging.Infof("mdb inserted id: %v", r.InsertedID)
+	// the key pointed to other content before, which may be unused now
+	if old != nil && old.Ref != item.ID {
+		return dsm.release(ctx, old.Ref)
+	}
 	return nil
 }
 
-func (dsm *DSMongo) Delete(ctx context.Context, id string) error {
-	dstore := dsm.ds()
-	refstore := dsm.refs()
+// retryUpsert retries an upsert that lost the race to insert the same _id,
+// which servers before 4.2 report as a duplicate key error. Transactions are
+// retried as a whole instead.
+func retryUpsert(ctx context.Context, upsert func() error) error {
+	err := upsert()
+	if err != nil && mongo.IsDuplicateKeyError(err) && !inTxn(ctx) {
+		err = upsert()
+	}
+	return err
+}
 
+// restoreRef undoes the ref write of a put by node nid whose block write
+// failed, unless another put changed the ref since
+func (dsm *DSMongo) restoreRef(ctx context.Context, id, hk, nid string, old *RefItem) {
+	refstore := dsm.refs()
 	var err error
-	refItem := &RefItem{}
-
-	err = refstore.FindOne(ctx, bson.M{"_id": id}).Decode(refItem)
+	update := bson.M{}
+	set := bson.M{}
+	if old != nil && old.Ref != hk {
+		set["ref"], set["size"] = old.Ref, old.Size
+	}
+	if old != nil && nid != "" && old.NID == nil {
+		// the put claimed a shared ref
+		set["nid"] = nil
+	} else if old != nil && nid != "" && !holds(old.NID, nid) {
+		update["$pull"] = bson.M{"nid": nid}
+	}
+	if len(set) > 0 {
+		update["$set"] = set
+	}
+	if old == nil {
+		_, err = refstore.DeleteOne(ctx, bson.M{"_id": id, "ref": hk})
+	} else if len(update) > 0 {
+		_, err = refstore.UpdateOne(ctx, bson.M{"_id": id, "ref": hk}, update)
+	}
 	if err != nil {
-		// if err == mongo.ErrNoDocuments {
-		// 	return nil
-		// }
+		logging.Errorf("restore ref %s after a failed put: %s", id, err)
+	}
+}
+
+// Delete removes the ref id and its block if no other ref points to it, in
+// a transaction if the deployment supports them. For a node, see WithNode,
+// the ref is only removed once no other node holds it, and shared refs fail
+// with ErrSharedRef.
+func (dsm *DSMongo) Delete(ctx context.Context, id string) error {
+	_, err := dsm.deleteRef(ctx, id)
+	return err
+}
+
+// deleteRef is Delete, it reports whether the ref was removed rather than
+// only let go of by the node of ctx
+func (dsm *DSMongo) deleteRef(ctx context.Context, id string) (bool, error) {
+	removed := false
+	err := dsm.withTxn(ctx, func(ctx context.Context) error {
+		var err error
+		removed, err = dsm.delete(ctx, id)
 		return err
+	})
+	if err != nil && dsm.txn {
+		// rolled back
+		removed = false
+	}
+	return removed, err
+}
+
+func (dsm *DSMongo) delete(ctx context.Context, id string) (bool, error) {
+	refstore := dsm.refs()
+
+	nid := NodeID(ctx)
+	if nid != "" {
+		return dsm.deleteNode(ctx, id, nid)
 	}
 
 	// 删除 refstore 上的记录
-	_, err = refstore.DeleteOne(ctx, bson.M{"_id": id})
+	refItem := &RefItem{}
+	sctx, span := mongoSpan(ctx, "FindOneAndDelete", refstore)
+	err := refstore.FindOneAndDelete(sctx, bson.M{"_id": id}).Decode(refItem)
+	endMongoSpan(span, err)
 	if err != nil {
-		return err
+		return false, err
+	}
+	return true, dsm.release(ctx, refItem.Ref)
+}
+
+// ErrSharedRef is returned when a node deletes a ref written without a
+// node, which other nodes may rely on. A node claims a shared ref by putting
+// it, calls without a node delete it.
+var ErrSharedRef = xerrors.New("ref is shared by every node, only calls without a node delete it")
+
+// deleteNode lets node nid go of the ref id, which is removed with its last
+// node, it reports whether it was
+func (dsm *DSMongo) deleteNode(ctx context.Context, id, nid string) (bool, error) {
+	refstore := dsm.refs()
+	for attempt := 0; attempt < 3; attempt++ {
+		sctx, span := mongoSpan(ctx, "UpdateOne", refstore)
+		res, err := refstore.UpdateOne(sctx,
+			bson.M{"_id": id, "nid": nid, "nid.1": bson.M{"$exists": true}},
+			bson.M{"$pull": bson.M{"nid": nid}})
+		endMongoSpan(span, err)
+		if err != nil {
+			return false, err
+		}
+		if res.MatchedCount > 0 {
+			return false, nil
+		}
+
+		refItem := &RefItem{}
+		sctx, span = mongoSpan(ctx, "FindOneAndDelete", refstore)
+		err = refstore.FindOneAndDelete(sctx, bson.M{"_id": id, "nid": bson.A{nid}}).Decode(refItem)
+		endMongoSpan(span, err)
+		if err == nil {
+			return true, dsm.release(ctx, refItem.Ref)
+		}
+		if err != mongo.ErrNoDocuments {
+			return false, err
+		}
+		// the ref is shared, missing, or another node put it in between
+		cur := &RefItem{}
+		sctx, span = mongoSpan(ctx, "FindOne", refstore)
+		err = refstore.FindOne(sctx, bson.M{"_id": id}, options.FindOne().SetProjection(bson.M{"nid": 1})).Decode(cur)
+		endMongoSpan(span, err)
+		if err != nil {
+			return false, err
+		}
+		if cur.NID == nil {
+			return false, ErrSharedRef
+		}
+		if !holds(cur.NID, nid) {
+			return false, mongo.ErrNoDocuments
+		}
 	}
+	return false, xerrors.Errorf("delete %s: the nodes holding it keep changing", id)
+}
+
+// release deletes the block hk once no ref points to it
+func (dsm *DSMongo) release(ctx context.Context, hk string) error {
+	dstore := dsm.ds()
 
 	// 查看是否有其他针对数据块的引用
-	rc, err := refstore.CountDocuments(ctx, bson.M{"ref": refItem.Ref})
+	if rc, err := dsm.countRefs(ctx, hk); err != nil || rc > 0 {
+		return err
+	}
+
+	// 不再被引用 删除数据
+	block := bson.M{}
+	sctx, span := mongoSpan(ctx, "FindOneAndDelete", dstore)
+	err := dstore.FindOneAndDelete(sctx, bson.M{"_id": hk}).Decode(&block)
+	endMongoSpan(span, err)
+	if err == mongo.ErrNoDocuments {
+		return nil
+	}
 	if err != nil {
 		return err
 	}
+	gen, _ := block["chunk_gen"].(string)
+	if inTxn(ctx) {
+		if gen != "" {
+			dsm.dropChunks(ctx, hk, gen)
+		}
+		return nil
+	}
 
-	if rc < 1 { // 不再被引用 删除数据
-		_, err = dstore.DeleteOne(ctx, bson.M{"_id": refItem.Ref})
-		if err != nil {
-			return err
+	// without a transaction a put may have referenced the block since it
+	// was counted, its block write then either follows and recreates the
+	// block, or preceded and its ref is seen here
+	rc, err := dsm.countRefs(ctx, hk)
+	if err != nil {
+		return err
+	}
+	if rc == 0 {
+		if gen != "" {
+			dsm.dropChunks(ctx, hk, gen)
 		}
 		return nil
 	}
+	delete(block, "_id")
+	sctx, span = mongoSpan(ctx, "UpdateOne", dstore)
+	_, err = dstore.UpdateOne(sctx, bson.M{"_id": hk}, bson.M{"$setOnInsert": block}, options.Update().SetUpsert(true))
+	endMongoSpan(span, err)
+	return err
+}
 
-	return nil
+func (dsm *DSMongo) countRefs(ctx context.Context, hk string) (int64, error) {
+	refstore := dsm.refs()
+	sctx, span := mongoSpan(ctx, "CountDocuments", refstore)
+	rc, err := refstore.CountDocuments(sctx, bson.M{"ref": hk}, options.Count().SetLimit(1))
+	endMongoSpan(span, err)
+	return rc, err
 }
 
 func (dsm *DSMongo) Get(ctx context.Context, id string) ([]byte, error) {
@@ -192,17 +588,21 @@ func (dsm *DSMongo) Get(ctx context.Context, id string) ([]byte, error) {
 	refstore := dsm.refs()
 
 	ref := &RefItem{}
-	err := refstore.FindOne(ctx, bson.M{"_id": id}).Decode(ref)
+	sctx, span := mongoSpan(ctx, "FindOne", refstore)
+	err := refstore.FindOne(sctx, refFilter(ctx, id)).Decode(ref)
+	endMongoSpan(span, err)
 	if err != nil {
 		return nil, err
 	}
 	b := &StoreItem{}
-	err = dstore.FindOne(ctx, bson.M{"_id": ref.Ref}).Decode(b)
+	sctx, span = mongoSpan(ctx, "FindOne", dstore)
+	err = dstore.FindOne(sctx, bson.M{"_id": ref.Ref}).Decode(b)
+	endMongoSpan(span, err)
 	if err != nil {
 		return nil, err
 	}
 
-	return b.Value, nil
+	return dsm.blockValue(ctx, b)
 }
 
 func (dsm *DSMongo) Has(ctx context.Context, id string) (bool, error) {
@@ -213,7 +613,9 @@ func (dsm *DSMongo) GetSize(ctx context.Context, id string) (int64, error) {
 	refstore := dsm.refs()
 
 	ref := &RefItem{}
-	err := refstore.FindOne(ctx, bson.M{"_id": id}).Decode(&ref)
+	sctx, span := mongoSpan(ctx, "FindOne", refstore)
+	err := refstore.FindOne(sctx, refFilter(ctx, id)).Decode(&ref)
+	endMongoSpan(span, err)
 	if err != nil {
 		return 0, err
 	}
@@ -221,36 +623,50 @@ func (dsm *DSMongo) GetSize(ctx context.Context, id string) (int64, error) {
 	return ref.Size, nil
 }
 
-func (dsm *DSMongo) Query(ctx context.Context, q dsq.Query) (chan *dsq.Entry, error) {
-	if q.Orders != nil || q.Filters != nil {
-		return nil, xerrors.Errorf("dsrpc currently not support orders or filters")
+// refSize is the size of the value of the ref id, whichever nodes hold it,
+// or 0 if there is none
+func (dsm *DSMongo) refSize(ctx context.Context, id string) (int64, error) {
+	refstore := dsm.refs()
+
+	ref := &RefItem{}
+	sctx, span := mongoSpan(ctx, "FindOne", refstore)
+	err := refstore.FindOne(sctx, bson.M{"_id": id}, options.FindOne().SetProjection(bson.M{"size": 1})).Decode(ref)
+	endMongoSpan(span, err)
+	if err == mongo.ErrNoDocuments {
+		return 0, nil
 	}
+	return ref.Size, err
+}
 
-	dstore := dsm.ds()
+// Query streams the refs matching q, see translateQuery for the part of q
+// evaluated by Mongo, and held by the node of ctx if any. A result carrying
+// an error ends the stream, which is then incomplete.
+func (dsm *DSMongo) Query(ctx context.Context, q dsq.Query) (chan dsq.Result, error) {
+	mq := translateQuery(q)
+	if nid := NodeID(ctx); nid != "" {
+		if len(mq.filter) == 0 {
+			mq.filter = nodeCond(nid)
+		} else {
+			mq.filter = bson.M{"$and": bson.A{mq.filter, nodeCond(nid)}}
+		}
+	}
 	refstore := dsm.refs()
 
-	out := make(chan *dsq.Entry)
+	out := make(chan dsq.Result)
 	closeChan := make(chan struct{})
 
-	offset := int64(q.Offset)
-	limit := int64(q.Limit)
 	opts := options.FindOptions{}
-	if offset > 0 {
-		opts.Skip = &offset
+	if mq.skip > 0 {
+		opts.Skip = &mq.skip
 	}
-	if limit > 0 {
-		opts.Limit = &limit
+	if mq.limit > 0 {
+		opts.Limit = &mq.limit
 	}
-
-	rge := primitive.Regex{Pattern: q.Prefix, Options: "i"}
-	logging.Info(rge.String())
+	opts.SetSort(mq.sort)
 	logging.Info("rlock")
-	cur, err := refstore.Find(ctx, bson.M{
-		"_id": primitive.Regex{
-			Pattern: "^" + q.Prefix,
-			Options: "i",
-		},
-	}, &opts)
+	sctx, span := mongoSpan(ctx, "Find", refstore)
+	cur, err := refstore.Find(sctx, mq.filter, &opts)
+	endMongoSpan(span, err)
 	logging.Info("un rlock")
 	if err != nil {
 		logging.Warn(err)
@@ -260,75 +676,169 @@ func (dsm *DSMongo) Query(ctx context.Context, q dsq.Query) (chan *dsq.Entry, er
 
 	//logging.Infof("cur next: %v", cur.Next(ctx))
 
-	// refList := make([]*RefItem, 0)
-	// for cur.Next(ctx) {
-	// 	ref := &RefItem{}
-	// 	err := cur.Decode(ref)
-	// 	if err != nil {
-	// 		return nil, err
-	// 	}
-	// 	logging.Infof("%v", *ref)
-	// 	refList = append(refList, ref)
-	// }
-
-	go func(ctx context.Context, cur *mongo.Cursor, out chan *dsq.Entry, closeChan chan struct{}) {
+	go func(ctx context.Context, cur *mongo.Cursor, out chan dsq.Result, closeChan chan struct{}) {
 		defer cur.Close(ctx)
 		defer close(out)
-		// if len(refList) == 0 {
-		// 	close(out)
-		// 	return
-		// }
-		// for _, ref := range refList {
-		// 	ent := &dsq.Entry{
-		// 		Key:  ref.ID,
-		// 		Size: int(ref.Size),
-		// 	}
-		// 	out <- ent
-		// }
-		// close(out)
-
-		for {
+		send := func(res dsq.Result) bool {
 			select {
+			case out <- res:
+				return true
 			case <-ctx.Done():
-				return
+				return false
 			case <-closeChan:
+				return false
+			}
+		}
+		fail := func(err error) {
+			logging.Errorf("query %s: %s", q.Prefix, err)
+			send(dsq.Result{Error: err})
+		}
+
+		// refs are read in batches whose blocks are fetched together
+		var batch []*RefItem
+		var batchBytes int64
+		more := true
+		for more {
+			more = cur.Next(ctx)
+			if more {
+				ref := &RefItem{}
+				if err := cur.Decode(ref); err != nil {
+					fail(err)
+					return
+				}
+				batch = append(batch, ref)
+				batchBytes += ref.Size
+				full := q.KeysOnly || len(batch) >= dsm.opts.QueryBatchSize || batchBytes >= queryBatchBytes
+				if !full {
+					continue
+				}
+			}
+			if !more {
+				// a cancelled ctx ends the stream as well, the caller
+				// reports it
+				if err := cur.Err(); err != nil && ctx.Err() == nil {
+					fail(err)
+					return
+				}
+			}
+			if len(batch) == 0 {
 				return
-			default:
-				if cur.Next(ctx) {
-					ref := &RefItem{}
-					err := cur.Decode(ref)
-					if err != nil {
-						return
-					}
-					ent := &dsq.Entry{
-						Key:  ref.ID,
-						Size: int(ref.Size),
+			}
+			var values map[string][]byte
+			if !q.KeysOnly {
+				var err error
+				values, err = dsm.blockValues(ctx, batch)
+				if err != nil {
+					if ctx.Err() == nil {
+						fail(err)
 					}
-					if !q.KeysOnly {
-						b := &StoreItem{}
-						err = dstore.FindOne(ctx, bson.M{"_id": ref.Ref}).Decode(&b)
-						if err != nil {
-							return
-						}
-						ent.Value = b.Value
+					return
+				}
+			}
+			for _, ref := range batch {
+				ent := dsq.Entry{
+					Key:  ref.ID,
+					Size: int(ref.Size),
+				}
+				if !q.KeysOnly {
+					v, ok := values[ref.Ref]
+					if !ok {
+						fail(xerrors.Errorf("block %s of %s is missing", ref.Ref, ref.ID))
+						return
 					}
-					logging.Infof("key: %v, size: %v", ent.Key, ent.Size)
-					out <- ent
-				} else {
+					ent.Value = v
+				}
+				if !send(dsq.Result{Entry: ent}) {
 					return
 				}
 			}
+			batch, batchBytes = batch[:0], 0
 		}
-
 	}(ctx, cur, out, closeChan)
 
-	return out, nil
+	return applyResidual(ctx, mq.residual, out), nil
+}
+
+// DefaultQueryBatchSize is the default of Options.QueryBatchSize
+const DefaultQueryBatchSize = 100
+
+// queryBatchBytes bounds the values of refs fetched at once by Query
+const queryBatchBytes = 16 << 20
+
+// blockValues fetches the values of the blocks refs point to, by block
+func (dsm *DSMongo) blockValues(ctx context.Context, refs []*RefItem) (map[string][]byte, error) {
+	dstore := dsm.ds()
+	ids := bson.A{}
+	seen := map[string]bool{}
+	for _, ref := range refs {
+		if !seen[ref.Ref] {
+			seen[ref.Ref] = true
+			ids = append(ids, ref.Ref)
+		}
+	}
+	sctx, span := mongoSpan(ctx, "Find", dstore)
+	cur, err := dstore.Find(sctx, bson.M{"_id": bson.M{"$in": ids}})
+	endMongoSpan(span, err)
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+	values := make(map[string][]byte, len(ids))
+	for cur.Next(ctx) {
+		b := &StoreItem{}
+		if err := cur.Decode(b); err != nil {
+			return nil, err
+		}
+		if values[b.ID], err = dsm.blockValue(ctx, b); err != nil {
+			return nil, err
+		}
+	}
+	return values, cur.Err()
+}
+
+// prefixRange matches the keys below prefix as go-datastore does: whole key
+// components only, case-sensitive, and every key for "/". The keys below
+// "/a" sort between "/a/" and "/a0", '0' being the byte after '/'.
+func prefixRange(prefix string) bson.M {
+	prefix = cleanKey(prefix)
+	if prefix == "/" {
+		return bson.M{}
+	}
+	return bson.M{"_id": bson.M{"$gte": prefix + "/", "$lt": prefix + "0"}}
+}
+
+// NamespaceSize sums the logical size of every ref below ns
+func (dsm *DSMongo) NamespaceSize(ctx context.Context, ns string) (int64, error) {
+	refstore := dsm.refs()
+
+	sctx, span := mongoSpan(ctx, "Aggregate", refstore)
+	cur, err := refstore.Aggregate(sctx, mongo.Pipeline{
+		{{Key: "$match", Value: prefixRange(ns)}},
+		{{Key: "$group", Value: bson.M{"_id": nil, "total": bson.M{"$sum": "$size"}}}},
+	})
+	endMongoSpan(span, err)
+	if err != nil {
+		return 0, err
+	}
+	defer cur.Close(ctx)
+
+	res := struct {
+		Total int64 `bson:"total"`
+	}{}
+	if cur.Next(ctx) {
+		if err := cur.Decode(&res); err != nil {
+			return 0, err
+		}
+	}
+	return res.Total, cur.Err()
 }
 
 func (dsm *DSMongo) hasRef(ctx context.Context, id string) (bool, error) {
 	refstore := dsm.refs()
 
-	err := refstore.FindOne(ctx, bson.M{"_id": id}).Err()
+	sctx, span := mongoSpan(ctx, "FindOne", refstore)
+	err := refstore.FindOne(sctx, refFilter(ctx, id)).Err()
+	endMongoSpan(span, err)
 
 	if err != nil {
 		return false, err
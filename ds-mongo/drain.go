@@ -0,0 +1,151 @@
+package dsmongo
+
+import (
+	"context"
+	"strings"
+	"sync"
+
+	dsrpc "github.com/beeleelee/go-ds-rpc"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var errShuttingDown = status.Error(codes.Unavailable, "server is shutting down")
+
+// drainer tracks in-flight dsrpc calls so that shutdown can wait for them. A
+// nil *drainer never drains.
+type drainer struct {
+	mu       sync.Mutex
+	draining bool
+	calls    sync.WaitGroup
+	inflight int
+	streams  map[*contextStream]context.CancelFunc
+}
+
+func newDrainer() *drainer {
+	return &drainer{streams: map[*contextStream]context.CancelFunc{}}
+}
+
+// begin registers a call, false once draining started
+func (d *drainer) begin() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.draining {
+		return false
+	}
+	d.calls.Add(1)
+	d.inflight++
+	return true
+}
+
+func (d *drainer) end() {
+	d.mu.Lock()
+	d.inflight--
+	d.mu.Unlock()
+	d.calls.Done()
+}
+
+// active returns the number of running calls, streams included, and streams
+func (d *drainer) active() (calls, streams int) {
+	if d == nil {
+		return 0, 0
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.inflight, len(d.streams)
+}
+
+// drain rejects new calls and waits for the running ones. Query streams
+// still open when ctx is done are cancelled, unary calls, and with them every
+// mutation, are always waited for.
+func (d *drainer) drain(ctx context.Context) error {
+	if d == nil {
+		return nil
+	}
+	d.mu.Lock()
+	d.draining = true
+	d.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		d.calls.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+	}
+
+	d.mu.Lock()
+	logging.Warnf("drain deadline passed, cancelling %d streams", len(d.streams))
+	for _, cancel := range d.streams {
+		cancel()
+	}
+	d.mu.Unlock()
+	<-done
+	return ctx.Err()
+}
+
+// drains reports whether drain waits for a unary call: KVStore calls and
+// the Admin maintenance runs changing the store, which Close must not cut
+func drains(fullMethod string, req interface{}) bool {
+	if strings.HasPrefix(fullMethod, "/dsrpc.KVStore/") {
+		return true
+	}
+	r, ok := req.(*dsrpc.MaintenanceRequest)
+	return ok && strings.HasPrefix(fullMethod, "/dsrpc.Admin/") && !r.GetDryRun()
+}
+
+func (d *drainer) UnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if d == nil || !drains(info.FullMethod, req) {
+			return handler(ctx, req)
+		}
+		if !d.begin() {
+			return nil, errShuttingDown
+		}
+		defer d.end()
+		return handler(ctx, req)
+	}
+}
+
+// StreamServerInterceptor gives every stream a context drain can cancel, a
+// cancelled stream ends with Unavailable rather than looking complete.
+func (d *drainer) StreamServerInterceptor() grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if d == nil || !strings.HasPrefix(info.FullMethod, "/dsrpc.KVStore/") {
+			return handler(srv, ss)
+		}
+		if !d.begin() {
+			return errShuttingDown
+		}
+		defer d.end()
+
+		ctx, cancel := context.WithCancel(ss.Context())
+		defer cancel()
+		cs := &contextStream{ServerStream: ss, ctx: ctx}
+		d.mu.Lock()
+		d.streams[cs] = cancel
+		d.mu.Unlock()
+		defer func() {
+			d.mu.Lock()
+			delete(d.streams, cs)
+			d.mu.Unlock()
+		}()
+
+		err := handler(srv, cs)
+		if ctx.Err() != nil && ss.Context().Err() == nil {
+			return errShuttingDown
+		}
+		return err
+	}
+}
+
+// Drain makes ms answer new KVStore calls and Admin maintenance runs with
+// Unavailable and waits for the running ones, cancelling query streams when ctx is done. Call it before
+// stopping the grpc server and closing ms.
+func (ms *MongoStore) Drain(ctx context.Context) error {
+	return ms.drain.drain(ctx)
+}
@@ -0,0 +1,104 @@
+package dsmongo
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	dsrpc "github.com/beeleelee/go-ds-rpc"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type testStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *testStream) Context() context.Context {
+	return s.ctx
+}
+
+func TestDrain(t *testing.T) {
+	d := newDrainer()
+	unary := d.UnaryServerInterceptor()
+	stream := d.StreamServerInterceptor()
+	putInfo := &grpc.UnaryServerInfo{FullMethod: methodPut}
+	queryInfo := &grpc.StreamServerInfo{FullMethod: methodQuery, IsServerStream: true}
+
+	// a slow put and a query that runs until it is cancelled
+	releasePut := make(chan struct{})
+	putDone := make(chan error, 1)
+	queryDone := make(chan error, 1)
+	started := make(chan struct{}, 2)
+	go func() {
+		_, err := unary(context.Background(), nil, putInfo, func(ctx context.Context, req interface{}) (interface{}, error) {
+			started <- struct{}{}
+			<-releasePut
+			return nil, nil
+		})
+		putDone <- err
+	}()
+	go func() {
+		queryDone <- stream(nil, &testStream{ctx: context.Background()}, queryInfo, func(srv interface{}, ss grpc.ServerStream) error {
+			started <- struct{}{}
+			<-ss.Context().Done()
+			return nil
+		})
+	}()
+	<-started
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	drained := make(chan error, 1)
+	go func() { drained <- d.drain(ctx) }()
+
+	// new calls are turned away while draining
+	time.Sleep(10 * time.Millisecond)
+	_, err := unary(context.Background(), nil, &grpc.UnaryServerInfo{FullMethod: methodGet}, func(context.Context, interface{}) (interface{}, error) {
+		t.Error("handler called while draining")
+		return nil, nil
+	})
+	if status.Code(err) != codes.Unavailable {
+		t.Errorf("new call: got %v", err)
+	}
+	_, err = unary(context.Background(), &dsrpc.MaintenanceRequest{}, &grpc.UnaryServerInfo{FullMethod: "/dsrpc.Admin/CleanupOrphans"}, func(context.Context, interface{}) (interface{}, error) {
+		t.Error("maintenance started while draining")
+		return nil, nil
+	})
+	if status.Code(err) != codes.Unavailable {
+		t.Errorf("new maintenance run: got %v", err)
+	}
+	// dry runs change nothing and are left alone
+	_, err = unary(context.Background(), &dsrpc.MaintenanceRequest{DryRun: true}, &grpc.UnaryServerInfo{FullMethod: "/dsrpc.Admin/CleanupOrphans"}, func(context.Context, interface{}) (interface{}, error) {
+		return nil, nil
+	})
+	if err != nil {
+		t.Errorf("dry run: got %v", err)
+	}
+
+	// the query is cancelled at the deadline and reported as unavailable
+	select {
+	case err := <-queryDone:
+		if status.Code(err) != codes.Unavailable {
+			t.Errorf("query: got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("query was not cancelled")
+	}
+	// but the put is waited for
+	select {
+	case <-drained:
+		t.Fatal("drain returned before the put finished")
+	case <-time.After(20 * time.Millisecond):
+	}
+	close(releasePut)
+	if err := <-putDone; err != nil {
+		t.Errorf("put: %v", err)
+	}
+	if err := <-drained; err != context.DeadlineExceeded {
+		t.Errorf("drain: got %v", err)
+	}
+}
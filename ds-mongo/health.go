@@ -0,0 +1,136 @@
+package dsmongo
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// HealthOptions tunes the Mongo ping behind the health status
+type HealthOptions struct {
+	// Interval between pings, 10s if zero
+	Interval time.Duration
+	// Timeout of a single ping, 5s if zero
+	Timeout time.Duration
+}
+
+// HealthChecker serves grpc.health.v1 for the server as a whole ("") and
+// dsrpc.KVStore, reporting NOT_SERVING while Mongo does not answer pings.
+type HealthChecker struct {
+	opts HealthOptions
+	ping func(context.Context) error
+	srv  *health.Server
+
+	mu       sync.Mutex
+	err      error
+	checked  time.Time
+	shutdown bool
+}
+
+// Health returns a checker pinging the database of ms, start it with Run.
+func (ms *MongoStore) Health(opts HealthOptions) *HealthChecker {
+	return newHealthChecker(ms.client.Ping, opts)
+}
+
+func newHealthChecker(ping func(context.Context) error, opts HealthOptions) *HealthChecker {
+	if opts.Interval <= 0 {
+		opts.Interval = 10 * time.Second
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = 5 * time.Second
+	}
+	h := &HealthChecker{
+		opts: opts,
+		ping: ping,
+		srv:  health.NewServer(),
+		err:  fmt.Errorf("not checked yet"),
+	}
+	h.setStatus(healthpb.HealthCheckResponse_NOT_SERVING)
+	return h
+}
+
+// Server is the grpc.health.v1 service to register
+func (h *HealthChecker) Server() healthpb.HealthServer {
+	return h.srv
+}
+
+// Run pings right away and then every Interval until ctx is done.
+func (h *HealthChecker) Run(ctx context.Context) {
+	t := time.NewTicker(h.opts.Interval)
+	defer t.Stop()
+	for {
+		h.check(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+func (h *HealthChecker) check(ctx context.Context) {
+	pctx, cancel := context.WithTimeout(ctx, h.opts.Timeout)
+	err := h.ping(pctx)
+	cancel()
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.shutdown {
+		return
+	}
+	if (err == nil) != (h.err == nil) {
+		if err != nil {
+			logging.Errorf("mongo ping failed, reporting NOT_SERVING: %s", err)
+		} else {
+			logging.Info("mongo ping succeeded, reporting SERVING")
+		}
+	}
+	h.err, h.checked = err, time.Now()
+	if err != nil {
+		h.setStatus(healthpb.HealthCheckResponse_NOT_SERVING)
+	} else {
+		h.setStatus(healthpb.HealthCheckResponse_SERVING)
+	}
+}
+
+func (h *HealthChecker) setStatus(s healthpb.HealthCheckResponse_ServingStatus) {
+	h.srv.SetServingStatus("", s)
+	h.srv.SetServingStatus("dsrpc.KVStore", s)
+}
+
+// Shutdown reports NOT_SERVING from now on, so that load balancers drain the
+// server before it stops.
+func (h *HealthChecker) Shutdown() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.shutdown = true
+	h.err = fmt.Errorf("shutting down")
+	h.srv.Shutdown()
+}
+
+// Ready returns nil if the last ping succeeded
+func (h *HealthChecker) Ready() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.err
+}
+
+// RegisterHTTP adds /healthz, answering while the process runs, and /readyz,
+// answering 503 while Ready fails, to mux.
+func (h *HealthChecker) RegisterHTTP(mux *http.ServeMux) {
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "ok")
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		if err := h.Ready(); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+}
@@ -0,0 +1,58 @@
+package dsmongo
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+func TestHealthChecker(t *testing.T) {
+	var down int32
+	h := newHealthChecker(func(context.Context) error {
+		if atomic.LoadInt32(&down) == 1 {
+			return errors.New("no reachable servers")
+		}
+		return nil
+	}, HealthOptions{})
+	mux := http.NewServeMux()
+	h.RegisterHTTP(mux)
+
+	expect := func(want healthpb.HealthCheckResponse_ServingStatus, wantReady int) {
+		t.Helper()
+		for _, svc := range []string{"", "dsrpc.KVStore"} {
+			res, err := h.Server().Check(context.Background(), &healthpb.HealthCheckRequest{Service: svc})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res.Status != want {
+				t.Errorf("%q: got %v, want %v", svc, res.Status, want)
+			}
+		}
+		for path, code := range map[string]int{"/healthz": http.StatusOK, "/readyz": wantReady} {
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+			if w.Code != code {
+				t.Errorf("%s: got %d, want %d", path, w.Code, code)
+			}
+		}
+	}
+
+	expect(healthpb.HealthCheckResponse_NOT_SERVING, http.StatusServiceUnavailable)
+	h.check(context.Background())
+	expect(healthpb.HealthCheckResponse_SERVING, http.StatusOK)
+	atomic.StoreInt32(&down, 1)
+	h.check(context.Background())
+	expect(healthpb.HealthCheckResponse_NOT_SERVING, http.StatusServiceUnavailable)
+	atomic.StoreInt32(&down, 0)
+	h.check(context.Background())
+	expect(healthpb.HealthCheckResponse_SERVING, http.StatusOK)
+
+	h.Shutdown()
+	h.check(context.Background())
+	expect(healthpb.HealthCheckResponse_NOT_SERVING, http.StatusServiceUnavailable)
+}
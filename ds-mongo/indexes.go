@@ -0,0 +1,187 @@
+package dsmongo
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"golang.org/x/xerrors"
+)
+
+// Index modes of Options.Indexes
+const (
+	// IndexBackground builds missing indexes while the store serves
+	IndexBackground = "background"
+	// IndexEnsure builds missing indexes before NewDSMongo returns
+	IndexEnsure = "ensure"
+	// IndexSkip leaves indexes to EnsureIndexes or the operator
+	IndexSkip = "skip"
+)
+
+func validIndexMode(mode string) error {
+	switch mode {
+	case "", IndexBackground, IndexEnsure, IndexSkip:
+		return nil
+	}
+	return xerrors.Errorf("invalid index mode %q, want background, ensure or skip", mode)
+}
+
+// IndexStatus tells whether an index the store relies on exists
+type IndexStatus struct {
+	Collection string
+	Name       string
+	Present    bool
+}
+
+type collIndexes struct {
+	coll   *mongo.Collection
+	models []mongo.IndexModel
+}
+
+// indexes the store relies on, by collection
+func (dsm *DSMongo) indexModels() []collIndexes {
+	index := func(name string, keys bson.D) mongo.IndexModel {
+		opts := options.Index().SetName(name)
+		if dsm.opts.Indexes == IndexBackground {
+			// only honoured by servers before 4.2, which otherwise lock
+			// the collection during the build
+			opts.SetBackground(true)
+		}
+		return mongo.IndexModel{Keys: keys, Options: opts}
+	}
+	return []collIndexes{
+		{dsm.refs(), []mongo.IndexModel{
+			// Delete counts the refs left on a block
+			index("ref_1", bson.D{{Key: "ref", Value: 1}}),
+			index("created_at_1", bson.D{{Key: "created_at", Value: 1}}),
+		}},
+		{dsm.ds(), []mongo.IndexModel{
+			// CleanupOrphans selects blocks by age
+			index("created_at_1", bson.D{{Key: "created_at", Value: 1}}),
+			index("linked_at_1", bson.D{{Key: "linked_at", Value: 1}}),
+		}},
+		{dsm.chunks(), []mongo.IndexModel{
+			index("n_1_created_at_1", bson.D{{Key: "n", Value: 1}, {Key: "created_at", Value: 1}}),
+		}},
+	}
+}
+
+// existingIndexes lists the index names of coll
+func existingIndexes(ctx context.Context, coll *mongo.Collection) (map[string]bool, error) {
+	sctx, span := mongoSpan(ctx, "ListIndexes", coll)
+	cur, err := coll.Indexes().List(sctx)
+	endMongoSpan(span, err)
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+	existing := map[string]bool{}
+	for cur.Next(ctx) {
+		idx := struct {
+			Name string `bson:"name"`
+		}{}
+		if err := cur.Decode(&idx); err != nil {
+			return nil, err
+		}
+		existing[idx.Name] = true
+	}
+	return existing, cur.Err()
+}
+
+// IndexStatus reports the indexes the store relies on. Indexes still being
+// built are not present yet.
+func (dsm *DSMongo) IndexStatus(ctx context.Context) ([]IndexStatus, error) {
+	var out []IndexStatus
+	for _, ci := range dsm.indexModels() {
+		existing, err := existingIndexes(ctx, ci.coll)
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range ci.models {
+			name := *m.Options.Name
+			out = append(out, IndexStatus{Collection: ci.coll.Name(), Name: name, Present: existing[name]})
+		}
+	}
+	return out, nil
+}
+
+// EnsureIndexes creates the indexes the store relies on and returns how many
+// were missing. With dryRun nothing is created.
+func (dsm *DSMongo) EnsureIndexes(ctx context.Context, dryRun bool) (int, error) {
+	missing := 0
+	for _, ci := range dsm.indexModels() {
+		existing, err := existingIndexes(ctx, ci.coll)
+		if err != nil {
+			return 0, err
+		}
+		var create []mongo.IndexModel
+		for _, m := range ci.models {
+			if !existing[*m.Options.Name] {
+				create = append(create, m)
+			}
+		}
+		missing += len(create)
+		if dryRun || len(create) == 0 {
+			continue
+		}
+		sctx, span := mongoSpan(ctx, "CreateIndexes", ci.coll)
+		_, err = ci.coll.Indexes().CreateMany(sctx, create)
+		endMongoSpan(span, err)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return missing, nil
+}
+
+// setupIndexes ensures the indexes as Options.Indexes asks for
+func (dsm *DSMongo) setupIndexes() error {
+	switch dsm.opts.Indexes {
+	case IndexSkip:
+		dsm.setIndexBuild("skipped")
+		return nil
+	case IndexEnsure:
+		dsm.setIndexBuild("running")
+		n, err := dsm.EnsureIndexes(context.Background(), false)
+		if err != nil {
+			dsm.setIndexBuild("failed: " + err.Error())
+			return xerrors.Errorf("ensure indexes: %w", err)
+		}
+		dsm.setIndexBuild("done")
+		if n > 0 {
+			logging.Infof("%d indexes created", n)
+		}
+		return nil
+	}
+	dsm.setIndexBuild("running")
+	go func() {
+		start := time.Now()
+		n, err := dsm.EnsureIndexes(context.Background(), false)
+		if err != nil {
+			logging.Errorf("ensure indexes: %s", err)
+			dsm.setIndexBuild("failed: " + err.Error())
+			return
+		}
+		dsm.setIndexBuild("done")
+		if n > 0 {
+			logging.Infof("%d indexes created in %s", n, time.Since(start))
+		}
+	}()
+	return nil
+}
+
+func (dsm *DSMongo) setIndexBuild(state string) {
+	dsm.indexMu.Lock()
+	dsm.indexBuild = state
+	dsm.indexMu.Unlock()
+}
+
+// IndexBuild is the state of the index build started by NewDSMongo:
+// running, done, skipped or failed with the error
+func (dsm *DSMongo) IndexBuild() string {
+	dsm.indexMu.Lock()
+	defer dsm.indexMu.Unlock()
+	return dsm.indexBuild
+}
@@ -0,0 +1,68 @@
+package dsmongo
+
+import (
+	"net"
+	"os"
+	"strings"
+
+	"golang.org/x/xerrors"
+)
+
+// unixPath returns the socket path of a "unix:///run/mongods.sock",
+// "unix:mongods.sock" or plain "/run/mongods.sock" address
+func unixPath(addr string) (string, bool) {
+	switch {
+	case strings.HasPrefix(addr, "unix://"):
+		return strings.TrimPrefix(addr, "unix://"), true
+	case strings.HasPrefix(addr, "unix:"):
+		return strings.TrimPrefix(addr, "unix:"), true
+	case strings.HasPrefix(addr, "/"):
+		return addr, true
+	}
+	return "", false
+}
+
+// Listen opens a tcp "host:port" address or a unix socket address. The
+// socket file gets mode if it is not zero, a stale socket left by a previous
+// process is replaced.
+func Listen(addr string, mode os.FileMode) (net.Listener, error) {
+	path, ok := unixPath(addr)
+	if !ok {
+		return net.Listen("tcp", addr)
+	}
+	if path == "" {
+		return nil, xerrors.Errorf("invalid unix socket address %q", addr)
+	}
+	if fi, err := os.Lstat(path); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, xerrors.Errorf("%s exists and is not a socket", path)
+		}
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, xerrors.Errorf("%s is in use", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	lis, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if mode != 0 {
+		if err := os.Chmod(path, mode); err != nil {
+			lis.Close()
+			return nil, err
+		}
+	}
+	return lis, nil
+}
+
+// dialTarget turns a plain socket path into a target grpc resolves, other
+// addresses are passed through
+func dialTarget(srv string) string {
+	if strings.HasPrefix(srv, "/") {
+		return "unix://" + srv
+	}
+	return srv
+}
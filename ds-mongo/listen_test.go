@@ -0,0 +1,82 @@
+package dsmongo
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	dsrpc "github.com/beeleelee/go-ds-rpc"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestUnixSocket(t *testing.T) {
+	sock := filepath.Join(t.TempDir(), "mongods.sock")
+	lis, err := Listen("unix://"+sock, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0600 {
+		t.Errorf("socket mode: got %v", fi.Mode().Perm())
+	}
+	if _, err := Listen("unix://"+sock, 0); err == nil {
+		t.Error("listened on a socket in use")
+	}
+
+	srv := grpc.NewServer()
+	dsrpc.RegisterKVStoreServer(srv, &dsrpc.UnimplementedKVStoreServer{})
+	go srv.Serve(lis)
+
+	for _, addr := range []string{"unix://" + sock, sock} {
+		done := make(chan error, 1)
+		go func() {
+			client, err := NewMongoStoreClient(addr)
+			if err != nil {
+				done <- err
+				return
+			}
+			defer client.Close()
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			_, err = client.Get(ctx, &dsrpc.CommonRequest{Key: "/a"})
+			if status.Code(err) == codes.Unimplemented {
+				err = nil
+			}
+			done <- err
+		}()
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Errorf("%s: %v", addr, err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: dial timed out", addr)
+		}
+	}
+
+	// a socket left behind by a crashed process is replaced
+	lis.(*net.UnixListener).SetUnlinkOnClose(false)
+	srv.Stop()
+	if _, err := os.Stat(sock); err != nil {
+		t.Fatal(err)
+	}
+	if f, err := os.Create(sock + ".x"); err == nil {
+		f.Close()
+	}
+	if _, err := Listen("unix:"+sock+".x", 0); err == nil {
+		t.Error("replaced a regular file")
+	}
+	lis, err = Listen("unix://"+sock, 0)
+	if err != nil {
+		t.Fatalf("listen after stop: %v", err)
+	}
+	lis.Close()
+}
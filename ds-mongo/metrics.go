@@ -0,0 +1,189 @@
+package dsmongo
+
+import (
+	"context"
+	"path"
+	"strings"
+	"time"
+
+	dsrpc "github.com/beeleelee/go-ds-rpc"
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+)
+
+// Metrics instruments MongoStore and DSMongo. A nil *Metrics is valid and
+// records nothing.
+type Metrics struct {
+	requests      *prometheus.CounterVec
+	duration      *prometheus.HistogramVec
+	errors        *prometheus.CounterVec
+	bytesIn       *prometheus.CounterVec
+	bytesOut      *prometheus.CounterVec
+	activeQueries prometheus.Gauge
+	dedupHits     prometheus.Counter
+	auditDrops    prometheus.Counter
+}
+
+// NewMetrics creates the server collectors and registers them with reg.
+// Collectors that are already registered are shared.
+func NewMetrics(reg prometheus.Registerer) (*Metrics, error) {
+	m := &Metrics{}
+	err := dsrpc.RegisterCollectors(reg, []dsrpc.MetricCollector{
+		{Collector: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "dsrpc",
+			Subsystem: "server",
+			Name:      "requests_total",
+			Help:      "Number of KVStore requests handled.",
+		}, []string{"method"}), Set: func(c prometheus.Collector) { m.requests = c.(*prometheus.CounterVec) }},
+		{Collector: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: "dsrpc",
+			Subsystem: "server",
+			Name:      "request_duration_seconds",
+			Help:      "Latency of KVStore requests, query streams are measured until finished.",
+			Buckets:   prometheus.ExponentialBuckets(0.0005, 2, 16),
+		}, []string{"method"}), Set: func(c prometheus.Collector) { m.duration = c.(*prometheus.HistogramVec) }},
+		{Collector: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "dsrpc",
+			Subsystem: "server",
+			Name:      "errors_total",
+			Help:      "Number of failed KVStore requests by error code.",
+		}, []string{"method", "code"}), Set: func(c prometheus.Collector) { m.errors = c.(*prometheus.CounterVec) }},
+		{Collector: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "dsrpc",
+			Subsystem: "server",
+			Name:      "received_bytes_total",
+			Help:      "Value bytes received from clients.",
+		}, []string{"method"}), Set: func(c prometheus.Collector) { m.bytesIn = c.(*prometheus.CounterVec) }},
+		{Collector: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "dsrpc",
+			Subsystem: "server",
+			Name:      "sent_bytes_total",
+			Help:      "Value bytes sent to clients.",
+		}, []string{"method"}), Set: func(c prometheus.Collector) { m.bytesOut = c.(*prometheus.CounterVec) }},
+		{Collector: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: "dsrpc",
+			Subsystem: "server",
+			Name:      "active_queries",
+			Help:      "Number of open query streams.",
+		}), Set: func(c prometheus.Collector) { m.activeQueries = c.(prometheus.Gauge) }},
+		{Collector: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "dsrpc",
+			Subsystem: "mongo",
+			Name:      "dedup_hits_total",
+			Help:      "Number of puts whose content was already stored in the blocks collection.",
+		}), Set: func(c prometheus.Collector) { m.dedupHits = c.(prometheus.Counter) }},
+		{Collector: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "dsrpc",
+			Subsystem: "server",
+			Name:      "audit_dropped_total",
+			Help:      "Number of audit records lost to a full queue or a failed write.",
+		}), Set: func(c prometheus.Collector) { m.auditDrops = c.(prometheus.Counter) }},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (m *Metrics) dedupHit() {
+	if m != nil {
+		m.dedupHits.Inc()
+	}
+}
+
+func (m *Metrics) auditDropped() {
+	if m != nil {
+		m.auditDrops.Inc()
+	}
+}
+
+func (m *Metrics) observe(method string, start time.Time, code string, in, out int) {
+	if m == nil {
+		return
+	}
+	m.requests.WithLabelValues(method).Inc()
+	m.duration.WithLabelValues(method).Observe(time.Since(start).Seconds())
+	if code != "" {
+		m.errors.WithLabelValues(method, code).Inc()
+	}
+	if in > 0 {
+		m.bytesIn.WithLabelValues(method).Add(float64(in))
+	}
+	if out > 0 {
+		m.bytesOut.WithLabelValues(method).Add(float64(out))
+	}
+}
+
+// UnaryServerInterceptor records metrics of unary KVStore calls. Errors
+// reported through CommonReply.Code are counted by their ErrCode name, calls
+// of other services are not recorded.
+func (m *Metrics) UnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if m == nil || !strings.HasPrefix(info.FullMethod, "/dsrpc.KVStore/") {
+			return handler(ctx, req)
+		}
+		start := time.Now()
+		resp, err := handler(ctx, req)
+
+		in, out := 0, 0
+		if r, ok := req.(*dsrpc.CommonRequest); ok {
+			in = len(r.GetValue())
+		}
+		code := ""
+		if err != nil {
+			code = status.Code(err).String()
+		} else if r, ok := resp.(*dsrpc.CommonReply); ok {
+			out = len(r.GetValue())
+			if r.GetCode() != dsrpc.ErrCode_None {
+				code = r.GetCode().String()
+			}
+		}
+		m.observe(path.Base(info.FullMethod), start, code, in, out)
+		return resp, err
+	}
+}
+
+// StreamServerInterceptor records metrics of query streams, streams of
+// other services such as health watches are not recorded.
+func (m *Metrics) StreamServerInterceptor() grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if m == nil || !strings.HasPrefix(info.FullMethod, "/dsrpc.KVStore/") {
+			return handler(srv, ss)
+		}
+		start := time.Now()
+		m.activeQueries.Inc()
+		defer m.activeQueries.Dec()
+
+		cs := &countingStream{ServerStream: ss}
+		cs.ctx = context.WithValue(ss.Context(), sentKey{}, &cs.sent)
+		err := handler(srv, cs)
+		code := ""
+		if err != nil {
+			code = status.Code(err).String()
+		}
+		m.observe(path.Base(info.FullMethod), start, code, 0, cs.sent)
+		return err
+	}
+}
+
+type sentKey struct{}
+
+// countingStream sums the value bytes the handler reports with sentValue,
+// replies only carry them json encoded along with the keys
+type countingStream struct {
+	grpc.ServerStream
+	ctx  context.Context
+	sent int
+}
+
+func (s *countingStream) Context() context.Context {
+	return s.ctx
+}
+
+// sentValue counts n value bytes sent on the stream of ctx
+func sentValue(ctx context.Context, n int) {
+	if sent, ok := ctx.Value(sentKey{}).(*int); ok {
+		*sent += n
+	}
+}
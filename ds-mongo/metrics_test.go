@@ -0,0 +1,99 @@
+package dsmongo
+
+import (
+	"context"
+	"testing"
+
+	dsrpc "github.com/beeleelee/go-ds-rpc"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"google.golang.org/grpc"
+)
+
+func TestMetricsUnaryInterceptor(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	m, err := NewMetrics(reg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// registering twice shares the collectors
+	if _, err := NewMetrics(reg); err != nil {
+		t.Fatal(err)
+	}
+
+	intercept := m.UnaryServerInterceptor()
+	info := &grpc.UnaryServerInfo{FullMethod: "/dsrpc.KVStore/Get"}
+	found := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return &dsrpc.CommonReply{Value: []byte("hello")}, nil
+	}
+	missing := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return &dsrpc.CommonReply{Code: dsrpc.ErrCode_ErrNotFound}, nil
+	}
+	req := &dsrpc.CommonRequest{Key: "/a"}
+	if _, err := intercept(context.Background(), req, info, found); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := intercept(context.Background(), req, info, missing); err != nil {
+		t.Fatal(err)
+	}
+
+	if v := testutil.ToFloat64(m.requests.WithLabelValues("Get")); v != 2 {
+		t.Errorf("requests: got %v, want 2", v)
+	}
+	if v := testutil.ToFloat64(m.errors.WithLabelValues("Get", "ErrNotFound")); v != 1 {
+		t.Errorf("errors: got %v, want 1", v)
+	}
+	if v := testutil.ToFloat64(m.bytesOut.WithLabelValues("Get")); v != 5 {
+		t.Errorf("sent bytes: got %v, want 5", v)
+	}
+}
+
+func TestMetricsOtherServices(t *testing.T) {
+	m, err := NewMetrics(prometheus.NewRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ok := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return &dsrpc.CommonReply{}, nil
+	}
+	info := &grpc.UnaryServerInfo{FullMethod: "/grpc.health.v1.Health/Check"}
+	if _, err := m.UnaryServerInterceptor()(context.Background(), nil, info, ok); err != nil {
+		t.Fatal(err)
+	}
+	if v := testutil.ToFloat64(m.requests.WithLabelValues("Check")); v != 0 {
+		t.Errorf("health check requests: got %v, want 0", v)
+	}
+
+	active := -1.0
+	watch := func(srv interface{}, ss grpc.ServerStream) error {
+		active = testutil.ToFloat64(m.activeQueries)
+		return nil
+	}
+	sinfo := &grpc.StreamServerInfo{FullMethod: "/grpc.health.v1.Health/Watch", IsServerStream: true}
+	if err := m.StreamServerInterceptor()(nil, nil, sinfo, watch); err != nil {
+		t.Fatal(err)
+	}
+	if active != 0 {
+		t.Errorf("active queries during a health watch: got %v, want 0", active)
+	}
+}
+
+func TestMetricsQueryBytes(t *testing.T) {
+	m, err := NewMetrics(prometheus.NewRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+	info := &grpc.StreamServerInfo{FullMethod: methodQuery, IsServerStream: true}
+	// only the values count, not the keys and encoding around them
+	query := func(srv interface{}, ss grpc.ServerStream) error {
+		sentValue(ss.Context(), 5)
+		sentValue(ss.Context(), 0)
+		return nil
+	}
+	if err := m.StreamServerInterceptor()(nil, &testStream{ctx: context.Background()}, info, query); err != nil {
+		t.Fatal(err)
+	}
+	if v := testutil.ToFloat64(m.bytesOut.WithLabelValues("Query")); v != 5 {
+		t.Errorf("sent bytes: got %v, want 5", v)
+	}
+}
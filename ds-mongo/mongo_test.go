@@ -0,0 +1,798 @@
+package dsmongo
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	dsrpc "github.com/beeleelee/go-ds-rpc"
+	ds "github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// testMongo connects to DSRPC_TEST_MONGO_URI with fresh collections and no
+// indexes, tests needing a database are skipped without it
+func testMongo(t *testing.T, txn string) *DSMongo {
+	return testMongoIndexes(t, txn, IndexSkip)
+}
+
+func testMongoIndexes(t *testing.T, txn, indexes string) *DSMongo {
+	uri := os.Getenv("DSRPC_TEST_MONGO_URI")
+	if uri == "" {
+		t.Skip("DSRPC_TEST_MONGO_URI is not set")
+	}
+	suffix := fmt.Sprintf("%d", time.Now().UnixNano())
+	dsm, err := NewDSMongo(Options{
+		Uri:           uri,
+		DBName:        "dsrpc_test",
+		StoreName:     "blocks_" + suffix,
+		StoreRefsName: "refs_" + suffix,
+		Transactions:  txn,
+		Indexes:       indexes,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		ctx := context.Background()
+		dsm.ds().Drop(ctx)
+		dsm.refs().Drop(ctx)
+		dsm.chunks().Drop(ctx)
+		dsm.Close()
+	})
+	return dsm
+}
+
+func TestStatsAndMaintenance(t *testing.T) {
+	dsm := testMongo(t, TxnNever)
+	ctx := context.Background()
+	put := func(key, value string) {
+		err := dsm.Put(ctx, &StoreItem{ID: sha256String([]byte(value)), Value: []byte(value)}, &RefItem{ID: key})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	put("/blocks/A", "aaaa")
+	put("/blocks/B", "aaaa")
+	put("/pins/C", "cc")
+
+	st, err := dsm.Stats(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Refs != 3 || st.Blocks != 2 || st.LogicalBytes != 10 || st.PhysicalBytes != 6 {
+		t.Errorf("stats: got %+v", st)
+	}
+	want := []PrefixStats{{"/blocks", 2, 8}, {"/pins", 1, 2}}
+	if fmt.Sprint(st.Prefixes) != fmt.Sprint(want) {
+		t.Errorf("prefixes: got %v, want %v", st.Prefixes, want)
+	}
+	st, err = dsm.Stats(ctx, []string{"/pins"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(st.Prefixes) != fmt.Sprint(want[1:]) {
+		t.Errorf("prefix /pins: got %v", st.Prefixes)
+	}
+
+	if n, err := dsm.EnsureIndexes(ctx, false); err != nil || n != 5 {
+		t.Errorf("ensure indexes: got %d, %v", n, err)
+	}
+	if n, err := dsm.EnsureIndexes(ctx, true); err != nil || n != 0 {
+		t.Errorf("ensure indexes again: got %d, %v", n, err)
+	}
+
+	// an orphan left by an interrupted delete, and a fresh one of a put in
+	// progress
+	old := time.Now().Add(-2 * time.Hour)
+	dsm.ds().InsertOne(ctx, bson.M{"_id": "orphan", "value": []byte("x"), "created_at": old})
+	dsm.ds().InsertOne(ctx, bson.M{"_id": "fresh", "value": []byte("y"), "created_at": time.Now()})
+	if n, err := dsm.CleanupOrphans(ctx, time.Hour, true); err != nil || n != 1 {
+		t.Errorf("dry run: got %d, %v", n, err)
+	}
+	if n, err := dsm.CleanupOrphans(ctx, time.Hour, false); err != nil || n != 1 {
+		t.Errorf("cleanup: got %d, %v", n, err)
+	}
+	if n, _ := dsm.ds().CountDocuments(ctx, bson.M{}); n != 3 {
+		t.Errorf("blocks after cleanup: got %d, want 3", n)
+	}
+}
+
+// TestConcurrentPutDelete races puts and deletes of keys sharing blocks and
+// checks that no ref is left without its block, and with transactions that
+// no block is left without a ref.
+func TestConcurrentPutDelete(t *testing.T) {
+	for _, mode := range []string{TxnNever, TxnAlways} {
+		t.Run(mode, func(t *testing.T) {
+			dsm := testMongo(t, TxnNever)
+			if mode == TxnAlways {
+				if ok, _ := dsm.supportsTxn(context.Background()); !ok {
+					t.Skip("the deployment does not support transactions")
+				}
+				dsm.txn = true
+			}
+			testConcurrentPutDelete(t, dsm, mode == TxnAlways)
+		})
+	}
+}
+
+func testConcurrentPutDelete(t *testing.T, dsm *DSMongo, noOrphans bool) {
+	ctx := context.Background()
+	values := []string{"x", "yy", "zzz"}
+	var wg sync.WaitGroup
+	for w := 0; w < 16; w++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			rnd := rand.New(rand.NewSource(seed))
+			for i := 0; i < 200; i++ {
+				key := fmt.Sprintf("/blocks/K%d", rnd.Intn(8))
+				if rnd.Intn(2) == 0 {
+					v := []byte(values[rnd.Intn(len(values))])
+					err := dsm.Put(ctx, &StoreItem{ID: sha256String(v), Value: v}, &RefItem{ID: key})
+					if err != nil {
+						t.Errorf("put %s: %v", key, err)
+					}
+				} else if err := dsm.Delete(ctx, key); err != nil && err != mongo.ErrNoDocuments {
+					t.Errorf("delete %s: %v", key, err)
+				}
+			}
+		}(int64(w))
+	}
+	wg.Wait()
+
+	blocks := map[string]bool{}
+	cur, err := dsm.ds().Find(ctx, bson.M{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for cur.Next(ctx) {
+		b := StoreItem{}
+		if err := cur.Decode(&b); err != nil {
+			t.Fatal(err)
+		}
+		blocks[b.ID] = false
+	}
+	cur, err = dsm.refs().Find(ctx, bson.M{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for cur.Next(ctx) {
+		r := RefItem{}
+		if err := cur.Decode(&r); err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := blocks[r.Ref]; !ok {
+			t.Errorf("ref %s points to missing block %s", r.ID, r.Ref)
+		}
+		blocks[r.Ref] = true
+	}
+	if noOrphans {
+		for id, referenced := range blocks {
+			if !referenced {
+				t.Errorf("block %s has no ref", id)
+			}
+		}
+	}
+}
+
+func TestPutOverwrite(t *testing.T) {
+	dsm := testMongo(t, TxnNever)
+	ctx := context.Background()
+	put := func(key, value string) {
+		err := dsm.Put(ctx, &StoreItem{ID: sha256String([]byte(value)), Value: []byte(value)}, &RefItem{ID: key})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	hasBlock := func(value string) bool {
+		n, err := dsm.ds().CountDocuments(ctx, bson.M{"_id": sha256String([]byte(value))})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return n == 1
+	}
+	get := func(key string) string {
+		v, err := dsm.Get(ctx, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(v)
+	}
+
+	put("/K", "a")
+	put("/K", "a")
+	put("/K", "bb")
+	if v := get("/K"); v != "bb" {
+		t.Errorf("overwrite: got %q", v)
+	}
+	if size, _ := dsm.GetSize(ctx, "/K"); size != 2 {
+		t.Errorf("size after overwrite: got %d", size)
+	}
+	if hasBlock("a") {
+		t.Error("old block was not released")
+	}
+
+	// a block still referenced by another key is kept
+	put("/L", "bb")
+	put("/K", "a")
+	if !hasBlock("bb") || get("/L") != "bb" || get("/K") != "a" {
+		t.Error("shared block was released")
+	}
+}
+
+func TestPutManyDeleteMany(t *testing.T) {
+	for _, txn := range []string{TxnNever, TxnAuto} {
+		t.Run(txn, func(t *testing.T) {
+			dsm := testMongo(t, txn)
+			ctx := context.Background()
+			countBlocks := func() int64 {
+				n, err := dsm.ds().CountDocuments(ctx, bson.M{})
+				if err != nil {
+					t.Fatal(err)
+				}
+				return n
+			}
+
+			err := dsm.PutMany(ctx, []BatchPut{
+				{Key: "/a", Value: []byte("x")},
+				{Key: "/b", Value: []byte("x")},
+				{Key: "/c", Value: []byte("y")},
+				{Key: "/c", Value: []byte("z")},
+			}, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for k, want := range map[string]string{"/a": "x", "/b": "x", "/c": "z"} {
+				v, err := dsm.Get(ctx, k)
+				if err != nil || string(v) != want {
+					t.Errorf("get %s: %q, %v", k, v, err)
+				}
+			}
+			if n := countBlocks(); n != 2 {
+				t.Errorf("blocks after put: got %d, want 2", n)
+			}
+
+			// overwriting releases the old block once unreferenced
+			if err := dsm.PutMany(ctx, []BatchPut{{Key: "/c", Value: []byte("x")}}, false); err != nil {
+				t.Fatal(err)
+			}
+			if n := countBlocks(); n != 1 {
+				t.Errorf("blocks after overwrite: got %d, want 1", n)
+			}
+
+			err = dsm.DeleteMany(ctx, []string{"/a", "/missing", "/b"}, false)
+			be := &BatchError{}
+			if !errors.As(err, &be) {
+				t.Fatalf("delete: want a BatchError, got %v", err)
+			}
+			if txn == TxnNever {
+				if be.Errs[0] != nil || be.Errs[1] != mongo.ErrNoDocuments || be.Errs[2] != nil {
+					t.Errorf("delete errors: %v", be.Errs)
+				}
+				if has, _ := dsm.Has(ctx, "/b"); has {
+					t.Error("/b was not deleted")
+				}
+				if err := dsm.DeleteMany(ctx, []string{"/c"}, true); err != nil {
+					t.Fatal(err)
+				}
+				if n := countBlocks(); n != 0 {
+					t.Errorf("blocks after delete: got %d, want 0", n)
+				}
+			} else if dsm.txn {
+				if has, _ := dsm.Has(ctx, "/a"); !has {
+					t.Error("a failed transactional batch deleted /a")
+				}
+				for i, err := range be.Errs {
+					if err == nil {
+						t.Errorf("item %d of a rolled back batch reported as done", i)
+					}
+				}
+				if be.Errs[0] != ErrBatchAborted || be.Errs[1] != mongo.ErrNoDocuments {
+					t.Errorf("delete errors: %v", be.Errs)
+				}
+			}
+		})
+	}
+}
+
+func TestBatchError(t *testing.T) {
+	if err := batchResult(make([]error, 3)); err != nil {
+		t.Fatalf("no failures: got %v", err)
+	}
+	err := batchResult([]error{nil, mongo.ErrNoDocuments, ErrNotAttempted})
+	want := "2 of 3 batch items failed, item 1: " + mongo.ErrNoDocuments.Error()
+	if err == nil || err.Error() != want {
+		t.Errorf("got %v, want %q", err, want)
+	}
+}
+
+func TestChunkedValues(t *testing.T) {
+	dsm := testMongo(t, TxnNever)
+	dsm.opts.ChunkThreshold = 1 << 20
+	ctx := context.Background()
+	big := make([]byte, 2*chunkSize+123)
+	rand.Read(big)
+	hk := sha256String(big)
+	countChunks := func() int64 {
+		n, err := dsm.chunks().CountDocuments(ctx, bson.M{"block": hk})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+
+	for _, key := range []string{"/big/a", "/big/b"} {
+		if err := dsm.Put(ctx, &StoreItem{ID: hk, Value: big}, &RefItem{ID: key}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := countChunks(); n != 3 {
+		t.Fatalf("chunks: got %d, want 3", n)
+	}
+	v, err := dsm.Get(ctx, "/big/b")
+	if err != nil || string(v) != string(big) {
+		t.Fatalf("get: %d bytes, %v", len(v), err)
+	}
+	if size, _ := dsm.GetSize(ctx, "/big/a"); size != int64(len(big)) {
+		t.Errorf("size: got %d", size)
+	}
+	items, err := dsm.Query(ctx, dsq.Query{Prefix: "/big"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := 0
+	for ent := range items {
+		if ent.Error != nil {
+			t.Fatal(ent.Error)
+		}
+		if string(ent.Value) != string(big) {
+			t.Errorf("query %s: value differs", ent.Key)
+		}
+		got++
+	}
+	if got != 2 {
+		t.Errorf("query: got %d entries", got)
+	}
+
+	// chunks go with the last ref
+	if err := dsm.Delete(ctx, "/big/a"); err != nil {
+		t.Fatal(err)
+	}
+	if n := countChunks(); n != 3 {
+		t.Errorf("chunks after first delete: got %d", n)
+	}
+	if err := dsm.DeleteMany(ctx, []string{"/big/b"}, true); err != nil {
+		t.Fatal(err)
+	}
+	if n := countChunks(); n != 0 {
+		t.Errorf("chunks after last delete: got %d", n)
+	}
+
+	// chunks of a put that never wrote its block are orphans
+	if _, _, err := dsm.writeChunks(ctx, hk, big, time.Now().Add(-time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := dsm.CleanupOrphans(ctx, time.Minute, false); err != nil || n != 1 || countChunks() != 0 {
+		t.Errorf("cleanup: removed %d, %v", n, err)
+	}
+}
+
+func TestCompression(t *testing.T) {
+	dsm := testMongo(t, TxnNever)
+	ctx := context.Background()
+	text := bytes.Repeat([]byte("compressible "), 1000)
+	hk := sha256String(text)
+
+	// a block stored before compression was enabled
+	dsm.opts.Compression = CodecNone
+	if err := dsm.Put(ctx, &StoreItem{ID: hk, Value: text}, &RefItem{ID: "/old"}); err != nil {
+		t.Fatal(err)
+	}
+	dsm.opts.Compression = CodecZstd
+	if v, err := dsm.Get(ctx, "/old"); err != nil || !bytes.Equal(v, text) {
+		t.Fatalf("get uncompressed: %v", err)
+	}
+	// the hash is that of the raw value, so the block is shared
+	if err := dsm.PutMany(ctx, []BatchPut{{Key: "/new", Value: text}}, true); err != nil {
+		t.Fatal(err)
+	}
+	b := &StoreItem{}
+	if err := dsm.ds().FindOne(ctx, bson.M{"_id": hk}).Decode(b); err != nil {
+		t.Fatal(err)
+	}
+	if b.Codec != CodecNone || !bytes.Equal(b.Value, text) {
+		t.Errorf("shared block rewritten with codec %q", b.Codec)
+	}
+
+	other := append([]byte("other "), text...)
+	ohk := sha256String(other)
+	if err := dsm.Put(ctx, &StoreItem{ID: ohk, Value: other}, &RefItem{ID: "/zstd"}); err != nil {
+		t.Fatal(err)
+	}
+	b = &StoreItem{}
+	if err := dsm.ds().FindOne(ctx, bson.M{"_id": ohk}).Decode(b); err != nil {
+		t.Fatal(err)
+	}
+	if b.Codec != CodecZstd || len(b.Value) >= len(other) {
+		t.Errorf("block stored with codec %q in %d bytes", b.Codec, len(b.Value))
+	}
+	if v, err := dsm.Get(ctx, "/zstd"); err != nil || !bytes.Equal(v, other) {
+		t.Fatalf("get compressed: %v", err)
+	}
+	if size, _ := dsm.GetSize(ctx, "/zstd"); size != int64(len(other)) {
+		t.Errorf("size: got %d, want the raw %d", size, len(other))
+	}
+}
+
+func TestEncryption(t *testing.T) {
+	dsm := testMongo(t, TxnNever)
+	ctx := context.Background()
+	file := filepath.Join(t.TempDir(), "keys.json")
+	kf := KeysFile{HashKey: testKey(1), Current: "a", Keys: map[string]string{"a": testKey(2)}}
+	now := time.Now()
+	writeKeysFile(t, file, kf, now)
+	keys, err := NewFileKeyProvider(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a block stored before encryption was enabled
+	plain := []byte("stored in the clear")
+	if err := dsm.Put(ctx, &StoreItem{ID: sha256String(plain), Value: plain}, &RefItem{ID: "/plain"}); err != nil {
+		t.Fatal(err)
+	}
+	dsm.keys = keys
+
+	value := []byte("secret value")
+	hk, err := dsm.blockID(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := dsm.Put(ctx, &StoreItem{ID: hk, Value: value}, &RefItem{ID: "/a"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := dsm.PutMany(ctx, []BatchPut{{Key: "/b", Value: value}}, true); err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := dsm.ds().CountDocuments(ctx, bson.M{"_id": hk}); n != 1 {
+		t.Errorf("encrypted values not deduplicated: %d blocks", n)
+	}
+	b := &StoreItem{}
+	if err := dsm.ds().FindOne(ctx, bson.M{"_id": hk}).Decode(b); err != nil {
+		t.Fatal(err)
+	}
+	if b.Key == nil || b.Key.KeyID != "a" || bytes.Contains(b.Value, value) {
+		t.Fatalf("block not encrypted: %+v", b.Key)
+	}
+	for key, want := range map[string][]byte{"/a": value, "/b": value, "/plain": plain} {
+		if v, err := dsm.Get(ctx, key); err != nil || !bytes.Equal(v, want) {
+			t.Errorf("get %s: %q, %v", key, v, err)
+		}
+	}
+
+	kf.Keys["b"], kf.Current = testKey(3), "b"
+	writeKeysFile(t, file, kf, now.Add(time.Second))
+	if n, err := dsm.RewrapKeys(ctx, true); err != nil || n != 1 {
+		t.Errorf("rewrap dry run: %d, %v", n, err)
+	}
+	if n, err := dsm.RewrapKeys(ctx, false); err != nil || n != 1 {
+		t.Errorf("rewrap: %d, %v", n, err)
+	}
+	rewrapped := &StoreItem{}
+	if err := dsm.ds().FindOne(ctx, bson.M{"_id": hk}).Decode(rewrapped); err != nil {
+		t.Fatal(err)
+	}
+	if rewrapped.Key.KeyID != "b" || !bytes.Equal(rewrapped.Value, b.Value) {
+		t.Errorf("rewrap: key %s, value rewritten %v", rewrapped.Key.KeyID, !bytes.Equal(rewrapped.Value, b.Value))
+	}
+	// the old key is no longer needed
+	delete(kf.Keys, "a")
+	writeKeysFile(t, file, kf, now.Add(2*time.Second))
+	if v, err := dsm.Get(ctx, "/a"); err != nil || !bytes.Equal(v, value) {
+		t.Errorf("get after rotation: %q, %v", v, err)
+	}
+}
+
+func TestNodeOwnership(t *testing.T) {
+	dsm := testMongo(t, TxnNever)
+	ctx := context.Background()
+	a, b := WithNode(ctx, "a"), WithNode(ctx, "b")
+	value := []byte("held by nodes")
+	hk := sha256String(value)
+	put := func(ctx context.Context, key string) {
+		t.Helper()
+		if err := dsm.Put(ctx, &StoreItem{ID: hk, Value: value}, &RefItem{ID: key}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	has := func(ctx context.Context, key string) bool {
+		t.Helper()
+		ok, err := dsm.Has(ctx, key)
+		if err != nil && err != mongo.ErrNoDocuments {
+			t.Fatal(err)
+		}
+		return ok
+	}
+	keys := func(ctx context.Context) []string {
+		t.Helper()
+		res, err := dsm.Query(ctx, dsq.Query{Prefix: "/n", KeysOnly: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var out []string
+		for r := range res {
+			if r.Error != nil {
+				t.Fatal(r.Error)
+			}
+			out = append(out, r.Key)
+		}
+		return out
+	}
+
+	put(a, "/n/k")
+	if has(b, "/n/k") || !has(a, "/n/k") || !has(ctx, "/n/k") {
+		t.Fatal("a ref is only visible to its node and to calls without one")
+	}
+	put(b, "/n/k")
+	// the ref stays for b, so its size is still in use
+	if removed, err := dsm.deleteRef(a, "/n/k"); err != nil || removed {
+		t.Fatalf("delete of a ref b holds too: removed %v, %v", removed, err)
+	}
+	if has(a, "/n/k") || !has(b, "/n/k") {
+		t.Fatal("delete let go of more than node a")
+	}
+	if err := dsm.Delete(a, "/n/k"); err != mongo.ErrNoDocuments {
+		t.Errorf("delete of a ref the node does not hold: %v", err)
+	}
+
+	// refs written without a node are shared by every node, no node may
+	// delete them
+	put(ctx, "/n/shared")
+	if got := fmt.Sprint(keys(b)); got != "[/n/k /n/shared]" {
+		t.Errorf("query of b: %s", got)
+	}
+	if err := dsm.Delete(b, "/n/shared"); err != ErrSharedRef || !has(a, "/n/shared") {
+		t.Errorf("delete of a shared ref: %v", err)
+	}
+	// until a node claims them by putting them
+	put(a, "/n/shared")
+	if got := fmt.Sprint(keys(a)); got != "[/n/shared]" {
+		t.Errorf("query of a: %s", got)
+	}
+	if err := dsm.Delete(b, "/n/shared"); err != mongo.ErrNoDocuments || !has(a, "/n/shared") {
+		t.Errorf("delete of a ref claimed by a: %v", err)
+	}
+	if removed, err := dsm.deleteRef(a, "/n/shared"); err != nil || !removed || has(ctx, "/n/shared") {
+		t.Errorf("delete by the node holding the ref: removed %v, %v", removed, err)
+	}
+
+	// batches follow the same rules
+	if err := dsm.PutMany(a, []BatchPut{{Key: "/n/k", Value: value}, {Key: "/n/m", Value: value}}, true); err != nil {
+		t.Fatal(err)
+	}
+	err := dsm.DeleteMany(b, []string{"/n/k", "/n/m"}, false)
+	be := &BatchError{}
+	if !errors.As(err, &be) || be.Errs[0] != nil || be.Errs[1] != mongo.ErrNoDocuments {
+		t.Fatalf("delete many of b: %v", err)
+	}
+	if err := dsm.DeleteMany(a, []string{"/n/k", "/n/m"}, true); err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := dsm.refs().CountDocuments(ctx, bson.M{}); n != 0 {
+		t.Errorf("%d refs left after every node let go", n)
+	}
+	if n, _ := dsm.ds().CountDocuments(ctx, bson.M{"_id": hk}); n != 0 {
+		t.Error("block left after its last ref")
+	}
+}
+
+func TestIndexes(t *testing.T) {
+	dsm := testMongoIndexes(t, TxnNever, IndexEnsure)
+	ctx := context.Background()
+	st, err := dsm.Stats(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.IndexBuild != "done" || len(st.Indexes) != 5 {
+		t.Fatalf("index status: %s, %+v", st.IndexBuild, st.Indexes)
+	}
+	for _, idx := range st.Indexes {
+		if !idx.Present {
+			t.Errorf("index %s.%s is missing", idx.Collection, idx.Name)
+		}
+	}
+	if n, err := dsm.EnsureIndexes(ctx, true); err != nil || n != 0 {
+		t.Errorf("ensure indexes: got %d, %v", n, err)
+	}
+}
+
+var prefixKeys = []string{"/a", "/a/b", "/a/B", "/A/b", "/ab/c", "/a.b/c", "/a+/x", "/a+x/y", "/a/b/c"}
+
+var prefixCases = map[string][]string{
+	"/":    {"/A/b", "/a", "/a+/x", "/a+x/y", "/a.b/c", "/a/B", "/a/b", "/a/b/c", "/ab/c"},
+	"":     {"/A/b", "/a", "/a+/x", "/a+x/y", "/a.b/c", "/a/B", "/a/b", "/a/b/c", "/ab/c"},
+	"/a":   {"/a/B", "/a/b", "/a/b/c"},
+	"/a/":  {"/a/B", "/a/b", "/a/b/c"},
+	"/A":   {"/A/b"},
+	"/a+":  {"/a+/x"},
+	"/a.b": {"/a.b/c"},
+	"/a/b": {"/a/b/c"},
+	"/b":   nil,
+}
+
+func TestPrefixRange(t *testing.T) {
+	for prefix, want := range prefixCases {
+		r := prefixRange(prefix)
+		var got []string
+		for _, k := range prefixKeys {
+			if b, ok := r["_id"].(bson.M); ok && (k < b["$gte"].(string) || k >= b["$lt"].(string)) {
+				continue
+			}
+			got = append(got, k)
+		}
+		sort.Strings(got)
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("prefix %q: got %v, want %v", prefix, got, want)
+		}
+	}
+}
+
+func TestQueryPrefix(t *testing.T) {
+	dsm := testMongo(t, TxnNever)
+	ctx := context.Background()
+	for _, k := range prefixKeys {
+		if err := dsm.Put(ctx, &StoreItem{ID: sha256String([]byte(k)), Value: []byte(k)}, &RefItem{ID: k}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for prefix, want := range prefixCases {
+		items, err := dsm.Query(ctx, dsq.Query{Prefix: prefix})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for ent := range items {
+			if ent.Error != nil {
+				t.Fatal(ent.Error)
+			}
+			if string(ent.Value) != ent.Key {
+				t.Errorf("%s: value %q", ent.Key, ent.Value)
+			}
+			got = append(got, ent.Key)
+		}
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("prefix %q: got %v, want %v", prefix, got, want)
+		}
+	}
+}
+
+func TestQueryBatches(t *testing.T) {
+	dsm := testMongo(t, TxnNever)
+	dsm.opts.QueryBatchSize = 3
+	ctx := context.Background()
+	var keys, values []string
+	for i := 0; i < 10; i++ {
+		key := fmt.Sprintf("/q/%02d", i)
+		// every other key shares its block with the previous one
+		value := []byte(fmt.Sprint(i / 2))
+		if err := dsm.Put(ctx, &StoreItem{ID: sha256String(value), Value: value}, &RefItem{ID: key}); err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, key)
+		values = append(values, string(value))
+	}
+	for _, keysOnly := range []bool{false, true} {
+		items, err := dsm.Query(ctx, dsq.Query{Prefix: "/q", KeysOnly: keysOnly})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var gotKeys, gotValues []string
+		for ent := range items {
+			if ent.Error != nil {
+				t.Fatal(ent.Error)
+			}
+			gotKeys = append(gotKeys, ent.Key)
+			gotValues = append(gotValues, string(ent.Value))
+		}
+		if fmt.Sprint(gotKeys) != fmt.Sprint(keys) {
+			t.Errorf("keys only %v: got keys %v", keysOnly, gotKeys)
+		}
+		if !keysOnly && fmt.Sprint(gotValues) != fmt.Sprint(values) {
+			t.Errorf("got values %v, want %v", gotValues, values)
+		}
+	}
+}
+
+func TestQueryMissingBlock(t *testing.T) {
+	dsm := testMongo(t, TxnNever)
+	ctx := context.Background()
+	for _, k := range []string{"/m/a", "/m/b"} {
+		if err := dsm.Put(ctx, &StoreItem{ID: sha256String([]byte(k)), Value: []byte(k)}, &RefItem{ID: k}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	dsm.ds().DeleteOne(ctx, bson.M{"_id": sha256String([]byte("/m/b"))})
+
+	items, err := dsm.Query(ctx, dsq.Query{Prefix: "/m"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var results []dsq.Result
+	for res := range items {
+		results = append(results, res)
+	}
+	if len(results) != 2 || results[0].Key != "/m/a" || results[1].Error == nil {
+		t.Errorf("a dangling ref must end the stream with an error, got %v", results)
+	}
+}
+
+// TestQueryDifferential compares queries pushed down to Mongo with the same
+// queries on a MapDatastore
+func TestQueryDifferential(t *testing.T) {
+	dsm := testMongo(t, TxnNever)
+	ctx := context.Background()
+	mds := ds.NewMapDatastore()
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 60; i++ {
+		key := fmt.Sprintf("/%c/%c%02d", "abc"[r.Intn(3)], "xXy."[r.Intn(4)], i)
+		value := bytes.Repeat([]byte{byte('a' + r.Intn(4))}, r.Intn(4)+1)
+		mds.Put(ctx, ds.NewKey(key), value)
+		if err := dsm.Put(ctx, &StoreItem{ID: sha256String(value), Value: value}, &RefItem{ID: key}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	filters := [][]dsq.Filter{
+		nil,
+		{dsq.FilterKeyCompare{Op: dsq.GreaterThanOrEqual, Key: "/b"}},
+		{dsq.FilterKeyCompare{Op: dsq.NotEqual, Key: "/a/x00"}, dsq.FilterKeyPrefix{Prefix: "/a/x"}},
+		{dsq.FilterKeyPrefix{Prefix: "/c/X"}},
+		{dsrpc.FilterSizeCompare{Op: dsq.GreaterThan, Size: 2}},
+		{dsq.FilterValueCompare{Op: dsq.LessThan, Value: []byte("bb")}, dsq.FilterKeyCompare{Op: dsq.LessThan, Key: "/c"}},
+	}
+	orders := [][]dsq.Order{
+		{dsq.OrderByKey{}},
+		{dsq.OrderByKeyDescending{}},
+		{dsq.OrderByValue{}},
+		{dsq.OrderByValueDescending{}, dsq.OrderByKeyDescending{}},
+	}
+	for _, prefix := range []string{"", "/a", "/c"} {
+		for _, f := range filters {
+			for _, o := range orders {
+				for _, keysOnly := range []bool{false, true} {
+					q := dsq.Query{Prefix: prefix, Filters: f, Orders: o, KeysOnly: keysOnly, Offset: r.Intn(3), Limit: r.Intn(8)}
+					want, err := mds.Query(ctx, q)
+					if err != nil {
+						t.Fatal(err)
+					}
+					wantEntries, _ := want.Rest()
+					items, err := dsm.Query(ctx, q)
+					if err != nil {
+						t.Fatal(err)
+					}
+					var gotEntries []dsq.Entry
+					for res := range items {
+						if res.Error != nil {
+							t.Fatal(res.Error)
+						}
+						gotEntries = append(gotEntries, res.Entry)
+					}
+					if fmt.Sprint(gotEntries) != fmt.Sprint(wantEntries) {
+						t.Errorf("%s:\n got %v\nwant %v", q, gotEntries, wantEntries)
+					}
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package dsmongo
+
+import (
+	"context"
+
+	dsrpc "github.com/beeleelee/go-ds-rpc"
+	"go.mongodb.org/mongo-driver/bson"
+	"google.golang.org/grpc/metadata"
+)
+
+type nodeKey struct{}
+
+// WithNode makes the calls of ctx act for node nid when several nodes share
+// a store. A node only sees the refs it holds and the shared ones, its puts
+// claim shared refs and its deletes only let go of its own, see RefItem.NID.
+func WithNode(ctx context.Context, nid string) context.Context {
+	return context.WithValue(ctx, nodeKey{}, nid)
+}
+
+// NodeID returns the node ctx acts for, set with WithNode or sent by a
+// dsrpc client as dsrpc.MetadataNode, or "" for calls of no particular node.
+// The metadata is trusted as sent, unless the token of the call is bound to
+// a node, see TokenConfig.Node.
+func NodeID(ctx context.Context) string {
+	if nid, ok := ctx.Value(nodeKey{}).(string); ok {
+		return nid
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	if v := md.Get(dsrpc.MetadataNode); len(v) > 0 {
+		return v[0]
+	}
+	return ""
+}
+
+// nodeCond matches the refs nid holds, which includes the shared refs
+// written without a node
+func nodeCond(nid string) bson.M {
+	return bson.M{"$or": bson.A{bson.M{"nid": nid}, bson.M{"nid": nil}}}
+}
+
+// refFilter matches the ref id if the node of ctx holds it
+func refFilter(ctx context.Context, id string) bson.M {
+	nid := NodeID(ctx)
+	if nid == "" {
+		return bson.M{"_id": id}
+	}
+	return bson.M{"_id": id, "$or": nodeCond(nid)["$or"]}
+}
+
+func holds(nids []string, nid string) bool {
+	for _, n := range nids {
+		if n == nid {
+			return true
+		}
+	}
+	return false
+}
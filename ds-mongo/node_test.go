@@ -0,0 +1,26 @@
+package dsmongo
+
+import (
+	"context"
+	"testing"
+
+	dsrpc "github.com/beeleelee/go-ds-rpc"
+	"google.golang.org/grpc/metadata"
+)
+
+func TestNodeID(t *testing.T) {
+	ctx := context.Background()
+	if nid := NodeID(ctx); nid != "" {
+		t.Errorf("no node: got %q", nid)
+	}
+	ctx = metadata.NewIncomingContext(ctx, metadata.Pairs(dsrpc.MetadataNode, "b"))
+	if nid := NodeID(ctx); nid != "b" {
+		t.Errorf("metadata: got %q", nid)
+	}
+	if nid := NodeID(WithNode(ctx, "a")); nid != "a" {
+		t.Errorf("WithNode: got %q", nid)
+	}
+	if f := refFilter(WithNode(ctx, ""), "/k"); len(f) != 1 {
+		t.Errorf("filter without a node: %v", f)
+	}
+}
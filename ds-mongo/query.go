@@ -0,0 +1,147 @@
+package dsmongo
+
+import (
+	"context"
+
+	dsrpc "github.com/beeleelee/go-ds-rpc"
+	dsq "github.com/ipfs/go-datastore/query"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// mongoQuery is the part of a dsq.Query the refs collection evaluates,
+// residual is applied in Go to the entries it returns
+type mongoQuery struct {
+	filter      bson.M
+	sort        bson.D
+	skip, limit int64
+	residual    dsq.Query
+}
+
+var mongoOps = map[dsq.Op]string{
+	dsq.Equal:              "$eq",
+	dsq.NotEqual:           "$ne",
+	dsq.GreaterThan:        "$gt",
+	dsq.GreaterThanOrEqual: "$gte",
+	dsq.LessThan:           "$lt",
+	dsq.LessThanOrEqual:    "$lte",
+}
+
+// translateQuery pushes prefixes, key and size filters, key orders and, if
+// nothing is left to Go, offset and limit down to Mongo. Values live in the
+// blocks collection, so value filters and orders stay in Go.
+func translateQuery(q dsq.Query) mongoQuery {
+	mq := mongoQuery{}
+	conds := bson.A{}
+	if r := prefixRange(q.Prefix); len(r) > 0 {
+		conds = append(conds, r)
+	}
+	for _, f := range q.Filters {
+		if c, ok := filterCond(f); ok {
+			if len(c) > 0 {
+				conds = append(conds, c)
+			}
+		} else {
+			mq.residual.Filters = append(mq.residual.Filters, f)
+		}
+	}
+	switch len(conds) {
+	case 0:
+		mq.filter = bson.M{}
+	case 1:
+		mq.filter = conds[0].(bson.M)
+	default:
+		mq.filter = bson.M{"$and": conds}
+	}
+
+	// keys are unique, orders after a key order never apply
+	if len(q.Orders) > 0 {
+		switch q.Orders[0].(type) {
+		case dsq.OrderByKey:
+			mq.sort = bson.D{{Key: "_id", Value: 1}}
+		case dsq.OrderByKeyDescending:
+			mq.sort = bson.D{{Key: "_id", Value: -1}}
+		default:
+			mq.residual.Orders = q.Orders
+		}
+	}
+	if mq.sort == nil {
+		// the _id index serves both the range and the order, which keeps
+		// offsets stable
+		mq.sort = bson.D{{Key: "_id", Value: 1}}
+	}
+
+	if len(mq.residual.Filters) > 0 || len(mq.residual.Orders) > 0 {
+		mq.residual.Offset, mq.residual.Limit = q.Offset, q.Limit
+	} else {
+		mq.skip, mq.limit = int64(q.Offset), int64(q.Limit)
+	}
+	return mq
+}
+
+// filterCond translates f to a Mongo condition on the refs collection
+func filterCond(f dsq.Filter) (bson.M, bool) {
+	switch f := f.(type) {
+	case dsq.FilterKeyCompare:
+		op, ok := mongoOps[f.Op]
+		return bson.M{"_id": bson.M{op: f.Key}}, ok
+	case dsq.FilterKeyPrefix:
+		// a plain string prefix, unlike Query.Prefix
+		if f.Prefix == "" {
+			return bson.M{}, true
+		}
+		r := bson.M{"$gte": f.Prefix}
+		if end, ok := prefixEnd(f.Prefix); ok {
+			r["$lt"] = end
+		}
+		return bson.M{"_id": r}, true
+	case dsrpc.FilterSizeCompare:
+		op, ok := mongoOps[f.Op]
+		return bson.M{"size": bson.M{op: f.Size}}, ok
+	}
+	return nil, false
+}
+
+// prefixEnd is the least string above every string starting with prefix,
+// there is none if prefix only has 0xff bytes
+func prefixEnd(prefix string) (string, bool) {
+	b := []byte(prefix)
+	for i := len(b) - 1; i >= 0; i-- {
+		if b[i] < 0xff {
+			b[i]++
+			return string(b[:i+1]), true
+		}
+	}
+	return "", false
+}
+
+// applyResidual applies the part of q Mongo could not evaluate to in, as
+// NaiveQueryApply would. Like the datastores NaiveQueryApply serves, value
+// filters and orders see no values if q is KeysOnly.
+func applyResidual(ctx context.Context, residual dsq.Query, in chan dsq.Result) chan dsq.Result {
+	if len(residual.Filters) == 0 && len(residual.Orders) == 0 {
+		return in
+	}
+	res := dsq.NaiveQueryApply(residual, dsq.ResultsFromIterator(residual, dsq.Iterator{
+		Next: func() (dsq.Result, bool) {
+			r, ok := <-in
+			return r, ok
+		},
+	}))
+	out := make(chan dsq.Result)
+	go func() {
+		defer close(out)
+		defer res.Close()
+		for {
+			r, ok := res.NextSync()
+			if !ok {
+				return
+			}
+			select {
+			case out <- r:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out
+}
@@ -0,0 +1,73 @@
+package dsmongo
+
+import (
+	"fmt"
+	"testing"
+
+	dsrpc "github.com/beeleelee/go-ds-rpc"
+	dsq "github.com/ipfs/go-datastore/query"
+)
+
+type customFilter struct{}
+
+func (customFilter) Filter(e dsq.Entry) bool {
+	return true
+}
+
+func TestTranslateQuery(t *testing.T) {
+	cases := []struct {
+		q                   dsq.Query
+		filter, sort        string
+		skip, limit         int64
+		residual            string
+		residualOffsetLimit [2]int
+	}{{
+		q:      dsq.Query{Prefix: "/a", Offset: 1, Limit: 2},
+		filter: `map[_id:map[$gte:/a/ $lt:/a0]]`, sort: `[{_id 1}]`, skip: 1, limit: 2,
+	}, {
+		q: dsq.Query{
+			Filters: []dsq.Filter{dsq.FilterKeyCompare{Op: dsq.LessThan, Key: "/k"}, dsrpc.FilterSizeCompare{Op: dsq.NotEqual, Size: 3}},
+			Orders:  []dsq.Order{dsq.OrderByKeyDescending{}, dsq.OrderByValue{}},
+			Limit:   5,
+		},
+		filter: `map[$and:[map[_id:map[$lt:/k]] map[size:map[$ne:3]]]]`, sort: `[{_id -1}]`, limit: 5,
+	}, {
+		q: dsq.Query{
+			Prefix:  "/",
+			Filters: []dsq.Filter{dsq.FilterKeyPrefix{Prefix: "/x\xff"}, dsq.FilterValueCompare{Op: dsq.Equal, Value: []byte("v")}},
+			Offset:  3,
+		},
+		filter: `map[_id:map[$gte:/x` + "\xff" + ` $lt:/y]]`, sort: `[{_id 1}]`,
+		residual: `[VALUE == "v"]`, residualOffsetLimit: [2]int{3, 0},
+	}, {
+		q:      dsq.Query{Filters: []dsq.Filter{customFilter{}}, Orders: []dsq.Order{dsq.OrderByValueDescending{}}, Limit: 4},
+		filter: `map[]`, sort: `[{_id 1}]`,
+		residual: `[{}] [desc(VALUE)]`, residualOffsetLimit: [2]int{0, 4},
+	}}
+	for i, c := range cases {
+		mq := translateQuery(c.q)
+		if got := fmt.Sprint(mq.filter); got != c.filter {
+			t.Errorf("%d: filter %s, want %s", i, got, c.filter)
+		}
+		if got := fmt.Sprint(mq.sort); got != c.sort {
+			t.Errorf("%d: sort %s, want %s", i, got, c.sort)
+		}
+		if mq.skip != c.skip || mq.limit != c.limit {
+			t.Errorf("%d: skip %d, limit %d", i, mq.skip, mq.limit)
+		}
+		residual := ""
+		if len(mq.residual.Filters) > 0 {
+			residual = fmt.Sprint(mq.residual.Filters)
+		}
+		if len(mq.residual.Orders) > 0 {
+			residual += " " + fmt.Sprint(mq.residual.Orders)
+		}
+		if residual != c.residual || mq.residual.Offset != c.residualOffsetLimit[0] || mq.residual.Limit != c.residualOffsetLimit[1] {
+			t.Errorf("%d: residual %q offset %d limit %d", i, residual, mq.residual.Offset, mq.residual.Limit)
+		}
+	}
+
+	if end, ok := prefixEnd("\xff\xff"); ok {
+		t.Errorf("prefix of 0xff bytes has end %q", end)
+	}
+}
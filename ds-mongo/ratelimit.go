@@ -0,0 +1,372 @@
+package dsmongo
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	dsrpc "github.com/beeleelee/go-ds-rpc"
+	"golang.org/x/time/rate"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+// RateLimitOptions bounds what a single client may ask of the server. A
+// client is the token it authenticated with, or its address when
+// authentication is disabled. Zero rates are unlimited.
+type RateLimitOptions struct {
+	RequestsPerSecond float64
+	// RequestBurst defaults to one second worth of requests
+	RequestBurst int
+	// BytesPerSecond covers value bytes in both directions
+	BytesPerSecond float64
+	// ByteBurst defaults to one second worth of bytes
+	ByteBurst int
+	// NamespaceQuotas caps the logical bytes stored below the first key
+	// component, e.g. {"/blocks": 1 << 40}
+	NamespaceQuotas map[string]int64
+}
+
+// clientIdleTimeout is how long the limiters of an idle client are kept
+const clientIdleTimeout = 10 * time.Minute
+
+type clientLimits struct {
+	requests *rate.Limiter
+	bytes    *rate.Limiter
+	lastSeen time.Time
+}
+
+// RateLimiter enforces the per-client rates of RateLimitOptions. A nil
+// *RateLimiter lets everything through.
+type RateLimiter struct {
+	opts RateLimitOptions
+
+	mu        sync.Mutex
+	clients   map[string]*clientLimits
+	lastSweep time.Time
+}
+
+// NewRateLimiter returns nil if opts sets no rate.
+func NewRateLimiter(opts RateLimitOptions) *RateLimiter {
+	if opts.RequestsPerSecond <= 0 && opts.BytesPerSecond <= 0 {
+		return nil
+	}
+	if opts.RequestBurst <= 0 {
+		opts.RequestBurst = int(opts.RequestsPerSecond)
+		if opts.RequestBurst < 1 {
+			opts.RequestBurst = 1
+		}
+	}
+	if opts.ByteBurst <= 0 {
+		opts.ByteBurst = int(opts.BytesPerSecond)
+		if opts.ByteBurst < 1 {
+			opts.ByteBurst = 1
+		}
+	}
+	return &RateLimiter{
+		opts:    opts,
+		clients: map[string]*clientLimits{},
+	}
+}
+
+func (rl *RateLimiter) limits(id string) *clientLimits {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	now := time.Now()
+	if now.Sub(rl.lastSweep) > clientIdleTimeout {
+		for k, c := range rl.clients {
+			if now.Sub(c.lastSeen) > clientIdleTimeout {
+				delete(rl.clients, k)
+			}
+		}
+		rl.lastSweep = now
+	}
+	c, ok := rl.clients[id]
+	if !ok {
+		c = &clientLimits{
+			requests: rate.NewLimiter(rate.Inf, 0),
+			bytes:    rate.NewLimiter(rate.Inf, 0),
+		}
+		if rl.opts.RequestsPerSecond > 0 {
+			c.requests = rate.NewLimiter(rate.Limit(rl.opts.RequestsPerSecond), rl.opts.RequestBurst)
+		}
+		if rl.opts.BytesPerSecond > 0 {
+			c.bytes = rate.NewLimiter(rate.Limit(rl.opts.BytesPerSecond), rl.opts.ByteBurst)
+		}
+		rl.clients[id] = c
+	}
+	c.lastSeen = now
+	return c
+}
+
+// admit takes one request and in bytes from the budget of id, or returns
+// a ResourceExhausted error telling when to retry
+func (rl *RateLimiter) admit(id string, in int) error {
+	c := rl.limits(id)
+	now := time.Now()
+	r := c.requests.ReserveN(now, 1)
+	if d := r.DelayFrom(now); d > 0 {
+		r.Cancel()
+		return exhausted(d, "request rate of %s exceeded", id)
+	}
+	// values larger than the burst are let through once the bucket is full
+	b := c.bytes.ReserveN(now, clampBurst(c.bytes, in))
+	if d := b.DelayFrom(now); d > 0 {
+		b.Cancel()
+		r.Cancel()
+		return exhausted(d, "byte rate of %s exceeded", id)
+	}
+	return nil
+}
+
+// charge takes bytes sent to id from its budget. The debt is paid by the
+// next requests.
+func (rl *RateLimiter) charge(id string, out int) {
+	if out <= 0 {
+		return
+	}
+	c := rl.limits(id)
+	now := time.Now()
+	// a reservation cannot exceed the burst, larger debts are booked in parts
+	for out > 0 {
+		n := clampBurst(c.bytes, out)
+		c.bytes.ReserveN(now, n)
+		out -= n
+	}
+}
+
+func clampBurst(l *rate.Limiter, n int) int {
+	if l.Limit() != rate.Inf && n > l.Burst() {
+		return l.Burst()
+	}
+	return n
+}
+
+// exhausted builds a ResourceExhausted status carrying a RetryInfo detail
+func exhausted(retryAfter time.Duration, format string, args ...interface{}) error {
+	s := status.New(codes.ResourceExhausted, fmt.Sprintf(format, args...)+fmt.Sprintf(", retry after %v", retryAfter.Round(time.Millisecond)))
+	sd, err := s.WithDetails(&errdetails.RetryInfo{RetryDelay: durationpb.New(retryAfter)})
+	if err != nil {
+		return s.Err()
+	}
+	return sd.Err()
+}
+
+// UnaryServerInterceptor applies the request and byte rates to dsrpc calls.
+func (rl *RateLimiter) UnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if rl == nil || !strings.HasPrefix(info.FullMethod, "/dsrpc.KVStore/") {
+			return handler(ctx, req)
+		}
+		id := ClientID(ctx)
+		in := 0
+		if r, ok := req.(*dsrpc.CommonRequest); ok {
+			in = len(r.GetValue())
+		}
+		if err := rl.admit(id, in); err != nil {
+			return nil, err
+		}
+		resp, err := handler(ctx, req)
+		if r, ok := resp.(*dsrpc.CommonReply); ok {
+			rl.charge(id, len(r.GetValue()))
+		}
+		return resp, err
+	}
+}
+
+// StreamServerInterceptor counts a query as one request and slows the
+// stream down to the byte rate instead of failing it half way.
+func (rl *RateLimiter) StreamServerInterceptor() grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if rl == nil || !strings.HasPrefix(info.FullMethod, "/dsrpc.KVStore/") {
+			return handler(srv, ss)
+		}
+		id := ClientID(ss.Context())
+		if err := rl.admit(id, 0); err != nil {
+			return err
+		}
+		return handler(srv, &throttledStream{ServerStream: ss, limits: rl.limits(id)})
+	}
+}
+
+type throttledStream struct {
+	grpc.ServerStream
+	limits *clientLimits
+}
+
+func (s *throttledStream) SendMsg(m interface{}) error {
+	if r, ok := m.(*dsrpc.QueryReply); ok {
+		n := clampBurst(s.limits.bytes, len(r.GetRes()))
+		if err := s.limits.bytes.WaitN(s.Context(), n); err != nil {
+			return status.FromContextError(err).Err()
+		}
+	}
+	return s.ServerStream.SendMsg(m)
+}
+
+// quotaRefresh is how often namespace usage is recounted from the refs
+// collection, in between usage is tracked from the puts and deletes of this
+// process
+const quotaRefresh = time.Minute
+
+// quotaSource reports the logical sizes quotas are enforced on, a DSMongo
+type quotaSource interface {
+	NamespaceSize(ctx context.Context, ns string) (int64, error)
+	refSize(ctx context.Context, id string) (int64, error)
+}
+
+// quotaTracker enforces RateLimitOptions.NamespaceQuotas on Put, charging
+// the growth of the sizes recorded in RefItem.Size
+type quotaTracker struct {
+	db     quotaSource
+	quotas map[string]int64
+
+	mu    sync.Mutex
+	usage map[string]*namespaceUsage
+}
+
+type namespaceUsage struct {
+	bytes     int64
+	refreshed time.Time
+	// counting is set while a recount runs, counted is closed when it ends
+	// and sinceCount sums what was booked meanwhile
+	counting   bool
+	counted    chan struct{}
+	sinceCount int64
+}
+
+func newQuotaTracker(db quotaSource, quotas map[string]int64) *quotaTracker {
+	if len(quotas) == 0 {
+		return nil
+	}
+	q := &quotaTracker{
+		db:     db,
+		quotas: map[string]int64{},
+		usage:  map[string]*namespaceUsage{},
+	}
+	for ns, limit := range quotas {
+		q.quotas[cleanKey(ns)] = limit
+	}
+	return q
+}
+
+// namespace returns the first component of key, "/blocks" for "/blocks/CIQ..."
+func namespace(key string) string {
+	key = cleanKey(key)
+	if i := strings.IndexByte(key[1:], '/'); i >= 0 {
+		return key[:i+1]
+	}
+	return key
+}
+
+// reserve books size bytes in place of the value key has now, checking that
+// any growth fits into the quota of the namespace of key. Deletes reserve 0.
+// The caller releases the booking if the call fails.
+func (q *quotaTracker) reserve(ctx context.Context, key string, size int64) (func(), error) {
+	if q == nil {
+		return func() {}, nil
+	}
+	ns := namespace(key)
+	limit, ok := q.quotas[ns]
+	if !ok {
+		return func() {}, nil
+	}
+	old, err := q.db.refSize(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	u, err := q.namespaceUsage(ctx, ns)
+	if err != nil {
+		return nil, err
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	delta := size - old
+	if delta > 0 && u.bytes+delta > limit {
+		return nil, quotaExceeded(ns, u.bytes, limit)
+	}
+	u.bytes += delta
+	u.sinceCount += delta
+	return func() {
+		q.mu.Lock()
+		defer q.mu.Unlock()
+		u.bytes -= delta
+		u.sinceCount -= delta
+	}, nil
+}
+
+// quotaExceeded is the ResourceExhausted error of a put not fitting into the
+// quota of ns. Unlike a rate rejection it carries a QuotaFailure, and the
+// retry delay is when usage is recounted, which only helps once keys were
+// deleted.
+func quotaExceeded(ns string, used, limit int64) error {
+	s := status.Newf(codes.ResourceExhausted, "quota of %s exceeded: %d of %d bytes used", ns, used, limit)
+	sd, err := s.WithDetails(
+		&errdetails.QuotaFailure{Violations: []*errdetails.QuotaFailure_Violation{{
+			Subject:     ns,
+			Description: fmt.Sprintf("%d of %d bytes used", used, limit),
+		}}},
+		&errdetails.RetryInfo{RetryDelay: durationpb.New(quotaRefresh)},
+	)
+	if err != nil {
+		return s.Err()
+	}
+	return sd.Err()
+}
+
+// namespaceUsage returns the usage of ns, recounting it once it is stale.
+// The recount runs outside the lock, only the first one of a namespace is
+// waited for and puts meanwhile go on with the stale usage.
+func (q *quotaTracker) namespaceUsage(ctx context.Context, ns string) (*namespaceUsage, error) {
+	q.mu.Lock()
+	u, ok := q.usage[ns]
+	if !ok {
+		u = &namespaceUsage{}
+		q.usage[ns] = u
+	}
+	for {
+		counted := !u.refreshed.IsZero()
+		if counted && (u.counting || time.Since(u.refreshed) <= quotaRefresh) {
+			q.mu.Unlock()
+			return u, nil
+		}
+		if !u.counting {
+			break
+		}
+		done := u.counted
+		q.mu.Unlock()
+		select {
+		case <-done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		q.mu.Lock()
+	}
+	u.counting = true
+	u.counted = make(chan struct{})
+	u.sinceCount = 0
+	q.mu.Unlock()
+
+	used, err := q.db.NamespaceSize(ctx, ns)
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	u.counting = false
+	close(u.counted)
+	if err != nil {
+		if u.refreshed.IsZero() {
+			return nil, err
+		}
+		logging.Warnf("recount usage of %s: %s", ns, err)
+		return u, nil
+	}
+	u.bytes = used + u.sinceCount
+	u.refreshed = time.Now()
+	return u, nil
+}
@@ -0,0 +1,174 @@
+package dsmongo
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestRateLimiter(t *testing.T) {
+	if NewRateLimiter(RateLimitOptions{}) != nil {
+		t.Fatal("limiter without rates should be nil")
+	}
+
+	rl := NewRateLimiter(RateLimitOptions{RequestsPerSecond: 2, BytesPerSecond: 100})
+	for i := 0; i < 2; i++ {
+		if err := rl.admit("a", 10); err != nil {
+			t.Fatalf("request %d: %v", i, err)
+		}
+	}
+	err := rl.admit("a", 10)
+	if status.Code(err) != codes.ResourceExhausted {
+		t.Fatalf("third request: got %v", err)
+	}
+	details := status.Convert(err).Details()
+	if len(details) != 1 {
+		t.Fatalf("got details %v", details)
+	}
+	if ri, ok := details[0].(*errdetails.RetryInfo); !ok || ri.GetRetryDelay().AsDuration() <= 0 {
+		t.Fatalf("got details %v", details)
+	}
+
+	// clients are limited independently
+	if err := rl.admit("b", 0); err != nil {
+		t.Fatal(err)
+	}
+	// bytes sent are charged to the next request
+	rl.charge("b", 1000)
+	if err := rl.admit("b", 0); status.Code(err) != codes.ResourceExhausted {
+		t.Fatalf("after charge: got %v", err)
+	}
+}
+
+func TestNamespace(t *testing.T) {
+	for key, want := range map[string]string{
+		"/blocks/CIQA":      "/blocks",
+		"/pins/state/dirty": "/pins",
+		"/local":            "/local",
+		"local/filesroot":   "/local",
+		"/":                 "/",
+	} {
+		if got := namespace(key); got != want {
+			t.Errorf("namespace(%q) = %q, want %q", key, got, want)
+		}
+	}
+}
+
+// fakeSizes serves quota sizes, NamespaceSize blocks while block is open
+type fakeSizes struct {
+	mu    sync.Mutex
+	used  int64
+	refs  map[string]int64
+	block chan struct{}
+}
+
+func (f *fakeSizes) NamespaceSize(ctx context.Context, ns string) (int64, error) {
+	if f.block != nil {
+		<-f.block
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.used, nil
+}
+
+func (f *fakeSizes) refSize(ctx context.Context, id string) (int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.refs[id], nil
+}
+
+func TestQuotaTracker(t *testing.T) {
+	ctx := context.Background()
+	src := &fakeSizes{used: 60, refs: map[string]int64{"/pins/a": 60}}
+	q := newQuotaTracker(src, map[string]int64{"/pins": 100})
+	// put books size for key and, as the store would, records it
+	put := func(key string, size int64) error {
+		if _, err := q.reserve(ctx, key, size); err != nil {
+			return err
+		}
+		src.mu.Lock()
+		src.refs[key] = size
+		src.mu.Unlock()
+		return nil
+	}
+	usage := func() int64 {
+		q.mu.Lock()
+		defer q.mu.Unlock()
+		return q.usage["/pins"].bytes
+	}
+
+	// putting a key again only charges the difference
+	for i := 0; i < 3; i++ {
+		if err := put("/pins/a", 80); err != nil {
+			t.Fatalf("put %d of the same key: %v", i, err)
+		}
+	}
+	if u := usage(); u != 80 {
+		t.Errorf("usage after puts: got %d, want 80", u)
+	}
+	err := put("/pins/b", 50)
+	if status.Code(err) != codes.ResourceExhausted {
+		t.Fatal("put above the quota accepted")
+	}
+	details := status.Convert(err).Details()
+	if len(details) != 2 {
+		t.Fatalf("quota error details: got %v", details)
+	}
+	if qf, ok := details[0].(*errdetails.QuotaFailure); !ok || qf.GetViolations()[0].GetSubject() != "/pins" {
+		t.Errorf("quota failure: got %v", details[0])
+	}
+	if ri, ok := details[1].(*errdetails.RetryInfo); !ok || ri.GetRetryDelay().AsDuration() != quotaRefresh {
+		t.Errorf("quota retry info: got %v", details[1])
+	}
+	// a delete gives the value back
+	if err := put("/pins/a", 0); err != nil {
+		t.Fatal(err)
+	}
+	if u := usage(); u != 0 {
+		t.Errorf("usage after delete: got %d, want 0", u)
+	}
+	release, err := q.reserve(ctx, "/pins/b", 30)
+	if err != nil {
+		t.Fatal(err)
+	}
+	release()
+	if u := usage(); u != 0 {
+		t.Errorf("usage after a released booking: got %d", u)
+	}
+
+	// puts go on with the stale usage while a recount runs
+	src.used = 0
+	src.block = make(chan struct{})
+	q.mu.Lock()
+	q.usage["/pins"].refreshed = time.Now().Add(-2 * quotaRefresh)
+	q.mu.Unlock()
+	recounted := make(chan error)
+	go func() {
+		recounted <- put("/pins/c", 1)
+	}()
+	for {
+		q.mu.Lock()
+		counting := q.usage["/pins"].counting
+		q.mu.Unlock()
+		if counting {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if err := put("/pins/d", 1); err != nil {
+		t.Fatal(err)
+	}
+	close(src.block)
+	if err := <-recounted; err != nil {
+		t.Fatal(err)
+	}
+	// the put during the recount is added to what it counted
+	if u := usage(); u != 2 {
+		t.Errorf("usage after recount: got %d, want 2", u)
+	}
+}
@@ -0,0 +1,276 @@
+package dsmongo
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// StoreStats summarises the content of the store
+type StoreStats struct {
+	Refs   int64
+	Blocks int64
+	// LogicalBytes sums the values of all refs, PhysicalBytes the unique
+	// values actually stored
+	LogicalBytes  int64
+	PhysicalBytes int64
+	// StorageBytes is the on disk size of the collections
+	StorageBytes int64
+	Prefixes     []PrefixStats
+	// Indexes and IndexBuild report the indexes the store relies on, see
+	// DSMongo.IndexBuild
+	Indexes    []IndexStatus
+	IndexBuild string
+}
+
+type PrefixStats struct {
+	Prefix       string
+	Keys         int64
+	LogicalBytes int64
+}
+
+// Stats counts refs and blocks. Without prefixes, keys are counted per first
+// key component. Physical bytes need MongoDB 4.4 or later, they are 0 before.
+func (dsm *DSMongo) Stats(ctx context.Context, prefixes []string) (*StoreStats, error) {
+	dstore := dsm.ds()
+	refstore := dsm.refs()
+	st := &StoreStats{}
+
+	var err error
+	sctx, span := mongoSpan(ctx, "CountDocuments", refstore)
+	st.Refs, err = refstore.CountDocuments(sctx, bson.M{})
+	endMongoSpan(span, err)
+	if err != nil {
+		return nil, err
+	}
+	sctx, span = mongoSpan(ctx, "CountDocuments", dstore)
+	st.Blocks, err = dstore.CountDocuments(sctx, bson.M{})
+	endMongoSpan(span, err)
+	if err != nil {
+		return nil, err
+	}
+
+	totals := struct {
+		Total int64 `bson:"total"`
+	}{}
+	err = aggregateOne(ctx, refstore, mongo.Pipeline{
+		{{Key: "$group", Value: bson.M{"_id": nil, "total": bson.M{"$sum": "$size"}}}},
+	}, &totals)
+	if err != nil {
+		return nil, err
+	}
+	st.LogicalBytes = totals.Total
+	st.PhysicalBytes, err = dsm.physicalBytes(ctx)
+	if err != nil {
+		// $binarySize is optional, it needs MongoDB 4.4
+		logging.Warnf("physical bytes: %s", err)
+		st.PhysicalBytes = 0
+	}
+
+	for _, coll := range []*mongo.Collection{dstore, refstore, dsm.chunks()} {
+		res := struct {
+			StorageSize int64 `bson:"storageSize"`
+		}{}
+		err := dsm.client.Database(dsm.opts.DBName).RunCommand(ctx, bson.D{{Key: "collStats", Value: coll.Name()}}).Decode(&res)
+		if err != nil {
+			// collStats is optional, e.g. not granted to the store user
+			logging.Warnf("collStats %s: %s", coll.Name(), err)
+			continue
+		}
+		st.StorageBytes += res.StorageSize
+	}
+	st.Indexes, err = dsm.IndexStatus(ctx)
+	if err != nil {
+		return nil, err
+	}
+	st.IndexBuild = dsm.IndexBuild()
+
+	if len(prefixes) == 0 {
+		st.Prefixes, err = dsm.namespaceStats(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return st, nil
+	}
+	for _, p := range prefixes {
+		p = cleanKey(p)
+		match := prefixRange(p)
+		ps := struct {
+			Keys  int64 `bson:"keys"`
+			Bytes int64 `bson:"bytes"`
+		}{}
+		err := aggregateOne(ctx, refstore, mongo.Pipeline{
+			{{Key: "$match", Value: match}},
+			{{Key: "$group", Value: bson.M{"_id": nil, "keys": bson.M{"$sum": 1}, "bytes": bson.M{"$sum": "$size"}}}},
+		}, &ps)
+		if err != nil {
+			return nil, err
+		}
+		st.Prefixes = append(st.Prefixes, PrefixStats{Prefix: p, Keys: ps.Keys, LogicalBytes: ps.Bytes})
+	}
+	return st, nil
+}
+
+// namespaceStats groups the refs by their first key component
+func (dsm *DSMongo) namespaceStats(ctx context.Context) ([]PrefixStats, error) {
+	refstore := dsm.refs()
+	sctx, span := mongoSpan(ctx, "Aggregate", refstore)
+	cur, err := refstore.Aggregate(sctx, mongo.Pipeline{
+		{{Key: "$group", Value: bson.M{
+			"_id":   bson.M{"$arrayElemAt": bson.A{bson.M{"$split": bson.A{"$_id", "/"}}, 1}},
+			"keys":  bson.M{"$sum": 1},
+			"bytes": bson.M{"$sum": "$size"},
+		}}},
+		{{Key: "$sort", Value: bson.M{"_id": 1}}},
+	})
+	endMongoSpan(span, err)
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+	var out []PrefixStats
+	for cur.Next(ctx) {
+		ns := struct {
+			ID    string `bson:"_id"`
+			Keys  int64  `bson:"keys"`
+			Bytes int64  `bson:"bytes"`
+		}{}
+		if err := cur.Decode(&ns); err != nil {
+			return nil, err
+		}
+		out = append(out, PrefixStats{Prefix: "/" + ns.ID, Keys: ns.Keys, LogicalBytes: ns.Bytes})
+	}
+	return out, cur.Err()
+}
+
+// physicalBytes sums the stored values and chunks
+func (dsm *DSMongo) physicalBytes(ctx context.Context) (int64, error) {
+	var n int64
+	for _, c := range []struct {
+		coll  *mongo.Collection
+		field string
+	}{{dsm.ds(), "$value"}, {dsm.chunks(), "$data"}} {
+		totals := struct {
+			Total int64 `bson:"total"`
+		}{}
+		err := aggregateOne(ctx, c.coll, mongo.Pipeline{
+			{{Key: "$group", Value: bson.M{"_id": nil, "total": bson.M{"$sum": bson.M{"$binarySize": c.field}}}}},
+		}, &totals)
+		if err != nil {
+			return 0, err
+		}
+		n += totals.Total
+	}
+	return n, nil
+}
+
+// aggregateOne decodes the first result of pipeline into v, leaving v
+// untouched if there is none
+func aggregateOne(ctx context.Context, coll *mongo.Collection, pipeline mongo.Pipeline, v interface{}) error {
+	sctx, span := mongoSpan(ctx, "Aggregate", coll)
+	cur, err := coll.Aggregate(sctx, pipeline)
+	endMongoSpan(span, err)
+	if err != nil {
+		return err
+	}
+	defer cur.Close(ctx)
+	if cur.Next(ctx) {
+		if err := cur.Decode(v); err != nil {
+			return err
+		}
+	}
+	return cur.Err()
+}
+
+// orphanBatch bounds the blocks checked and removed at once
+const orphanBatch = 1000
+
+// CleanupOrphans removes blocks no ref points to and that were neither
+// created nor linked within minAge, which spares blocks of puts in progress,
+// and then the chunks no block points to. Returns the number of orphaned
+// blocks and chunked values removed, or found with dryRun.
+func (dsm *DSMongo) CleanupOrphans(ctx context.Context, minAge time.Duration, dryRun bool) (int64, error) {
+	dstore := dsm.ds()
+	refstore := dsm.refs()
+
+	cutoff := time.Now().Add(-minAge)
+	sctx, span := mongoSpan(ctx, "Aggregate", dstore)
+	cur, err := dstore.Aggregate(sctx, mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{
+			"created_at": bson.M{"$lt": cutoff},
+			"$or":        bson.A{bson.M{"linked_at": bson.M{"$exists": false}}, bson.M{"linked_at": bson.M{"$lt": cutoff}}},
+		}}},
+		{{Key: "$lookup", Value: bson.M{"from": refstore.Name(), "localField": "_id", "foreignField": "ref", "as": "refs"}}},
+		{{Key: "$match", Value: bson.M{"refs": bson.M{"$size": 0}}}},
+		{{Key: "$project", Value: bson.M{"_id": 1}}},
+	})
+	endMongoSpan(span, err)
+	if err != nil {
+		return 0, err
+	}
+	defer cur.Close(ctx)
+
+	var removed int64
+	batch := make([]string, 0, orphanBatch)
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		defer func() { batch = batch[:0] }()
+		// a put may have referenced the block since the lookup
+		sctx, span := mongoSpan(ctx, "Distinct", refstore)
+		referenced, err := refstore.Distinct(sctx, "ref", bson.M{"ref": bson.M{"$in": batch}})
+		endMongoSpan(span, err)
+		if err != nil {
+			return err
+		}
+		skip := map[string]bool{}
+		for _, r := range referenced {
+			if s, ok := r.(string); ok {
+				skip[s] = true
+			}
+		}
+		ids := bson.A{}
+		for _, id := range batch {
+			if !skip[id] {
+				ids = append(ids, id)
+			}
+		}
+		if dryRun {
+			removed += int64(len(ids))
+			return nil
+		}
+		sctx, span = mongoSpan(ctx, "DeleteMany", dstore)
+		res, err := dstore.DeleteMany(sctx, bson.M{"_id": bson.M{"$in": ids}, "linked_at": bson.M{"$not": bson.M{"$gte": cutoff}}})
+		endMongoSpan(span, err)
+		if err != nil {
+			return err
+		}
+		removed += res.DeletedCount
+		return nil
+	}
+	for cur.Next(ctx) {
+		b := struct {
+			ID string `bson:"_id"`
+		}{}
+		if err := cur.Decode(&b); err != nil {
+			return removed, err
+		}
+		batch = append(batch, b.ID)
+		if len(batch) == orphanBatch {
+			if err := flush(); err != nil {
+				return removed, err
+			}
+		}
+	}
+	if err := cur.Err(); err != nil {
+		return removed, err
+	}
+	if err := flush(); err != nil {
+		return removed, err
+	}
+	chunks, err := dsm.cleanupChunks(ctx, cutoff, dryRun)
+	return removed + chunks, err
+}
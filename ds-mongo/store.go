@@ -7,13 +7,32 @@ import (
 	"fmt"
 
 	dsrpc "github.com/beeleelee/go-ds-rpc"
-	dsq "github.com/ipfs/go-datastore/query"
 	"go.mongodb.org/mongo-driver/mongo"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	methodPut     = "/dsrpc.KVStore/Put"
+	methodDelete  = "/dsrpc.KVStore/Delete"
+	methodGet     = "/dsrpc.KVStore/Get"
+	methodHas     = "/dsrpc.KVStore/Has"
+	methodGetSize = "/dsrpc.KVStore/GetSize"
+	methodQuery   = "/dsrpc.KVStore/Query"
 )
 
 type MongoStore struct {
 	dsrpc.UnimplementedKVStoreServer
 	client *DSMongo
+	fence  *writeFence
+	auth   *Authenticator
+	admin  *Authenticator
+	conns  *connTracker
+	limits *RateLimiter
+	quotas *quotaTracker
+	drain  *drainer
+	audit  *auditLog
 }
 
 func NewMongoStore(opts Options) (*MongoStore, error) {
@@ -21,13 +40,81 @@ func NewMongoStore(opts Options) (*MongoStore, error) {
 	if err != nil {
 		return nil, err
 	}
+	var auth, admin *Authenticator
+	if opts.TokensFile != "" {
+		auth, err = LoadAuthenticator(opts.TokensFile)
+		if err != nil {
+			cl.Close()
+			return nil, err
+		}
+	}
+	if opts.AdminTokensFile != "" {
+		admin, err = LoadAuthenticator(opts.AdminTokensFile)
+		if err != nil {
+			cl.Close()
+			return nil, err
+		}
+		admin.service = "dsrpc.Admin"
+		if auth != nil {
+			auth.service = "dsrpc.KVStore"
+		}
+	}
+	audit, err := newAuditLog(cl, opts.Audit)
+	if err != nil {
+		cl.Close()
+		return nil, err
+	}
 	return &MongoStore{
 		client: cl,
+		fence:  &writeFence{readOnly: opts.ReadOnly},
+		auth:   auth,
+		admin:  admin,
+		conns:  newConnTracker(),
+		limits: NewRateLimiter(opts.RateLimit),
+		quotas: newQuotaTracker(cl, opts.RateLimit.NamespaceQuotas),
+		drain:  newDrainer(),
+		audit:  audit,
 	}, nil
 }
 
+// ServerOptions returns the interceptors a grpc.Server serving ms should be
+// created with.
+func (ms *MongoStore) ServerOptions() []grpc.ServerOption {
+	m := ms.client.metrics
+	return []grpc.ServerOption{
+		grpc.MaxRecvMsgSize(ms.client.opts.MaxMessageSize),
+		grpc.MaxSendMsgSize(ms.client.opts.MaxMessageSize),
+		grpc.StatsHandler(ms.conns),
+		grpc.ChainUnaryInterceptor(
+			TracingUnaryServerInterceptor(),
+			m.UnaryServerInterceptor(),
+			ms.audit.UnaryServerInterceptor(),
+			ms.drain.UnaryServerInterceptor(),
+			ms.adminGuard(),
+			ms.auth.UnaryServerInterceptor(),
+			ms.admin.UnaryServerInterceptor(),
+			ms.limits.UnaryServerInterceptor(),
+			ms.fence.UnaryServerInterceptor(),
+		),
+		grpc.ChainStreamInterceptor(
+			TracingStreamServerInterceptor(),
+			m.StreamServerInterceptor(),
+			ms.drain.StreamServerInterceptor(),
+			ms.auth.StreamServerInterceptor(),
+			ms.admin.StreamServerInterceptor(),
+			ms.limits.StreamServerInterceptor(),
+		),
+	}
+}
+
 func (ms *MongoStore) Put(ctx context.Context, req *dsrpc.CommonRequest) (*dsrpc.CommonReply, error) {
-	hk := sha256String(req.GetValue())
+	hk, err := ms.client.blockID(req.GetValue())
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "block id: %s", err)
+	}
+	if rec := auditRecordFrom(ctx); rec != nil {
+		rec.Hash = hk
+	}
 
 	refItem := &RefItem{
 		ID:  req.GetKey(),
@@ -37,8 +124,13 @@ func (ms *MongoStore) Put(ctx context.Context, req *dsrpc.CommonRequest) (*dsrpc
 		ID:    hk,
 		Value: req.GetValue(),
 	}
-	err := ms.client.Put(ctx, storeItem, refItem)
+	release, err := ms.quotas.reserve(ctx, req.GetKey(), int64(len(req.GetValue())))
 	if err != nil {
+		return nil, err
+	}
+	err = ms.client.Put(ctx, storeItem, refItem)
+	if err != nil {
+		release()
 		r := &dsrpc.CommonReply{
 			Msg:  err.Error(),
 			Code: dsrpc.ErrCode_Others,
@@ -52,7 +144,15 @@ func (ms *MongoStore) Put(ctx context.Context, req *dsrpc.CommonRequest) (*dsrpc
 }
 
 func (ms *MongoStore) Delete(ctx context.Context, req *dsrpc.CommonRequest) (*dsrpc.CommonReply, error) {
-	err := ms.client.Delete(ctx, req.GetKey())
+	release, err := ms.quotas.reserve(ctx, req.GetKey(), 0)
+	if err != nil {
+		return nil, err
+	}
+	removed, err := ms.client.deleteRef(ctx, req.GetKey())
+	if !removed {
+		// other nodes still hold the ref, its size stays in use
+		release()
+	}
 	if err != nil {
 		r := &dsrpc.CommonReply{
 			Msg:  err.Error(),
@@ -114,18 +214,24 @@ func (ms *MongoStore) GetSize(ctx context.Context, req *dsrpc.CommonRequest) (*d
 }
 
 func (ms *MongoStore) Query(req *dsrpc.QueryRequest, reply dsrpc.KVStore_QueryServer) error {
-	re := dsq.Query{}
-	err := json.Unmarshal(req.GetQ(), &re)
+	re, err := dsrpc.DecodeQuery(req.GetQ())
 	if err != nil {
-		return err
+		return status.Errorf(codes.InvalidArgument, "decode query: %s", err)
 	}
 	logging.Infof("query: %s", re)
-	items, err := ms.client.Query(context.Background(), re)
+	// the stream context carries the client's deadline and is cancelled
+	// when the client goes away
+	items, err := ms.client.Query(reply.Context(), re)
 	if err != nil {
 		return err
 	}
-	for ent := range items {
-		b, err := json.Marshal(ent)
+	for res := range items {
+		if res.Error != nil {
+			// the client must not take the entries sent so far as the
+			// whole result
+			return status.Errorf(codes.Internal, "query: %s", res.Error)
+		}
+		b, err := json.Marshal(res.Entry)
 		if err != nil {
 			return err
 		}
@@ -135,11 +241,23 @@ func (ms *MongoStore) Query(req *dsrpc.QueryRequest, reply dsrpc.KVStore_QuerySe
 		if err != nil {
 			return err
 		}
+		sentValue(reply.Context(), len(res.Entry.Value))
+	}
+	// a cancelled stream closes items early, the result is incomplete
+	if err := reply.Context().Err(); err != nil {
+		return status.FromContextError(err).Err()
 	}
 	return nil
 }
 
-func (ms *MongoStore) Close(context.Context) error {
+// Close drains ms, cancelling query streams when ctx is done, and then
+// disconnects from Mongo once no mutation is in flight and the audit log is
+// written.
+func (ms *MongoStore) Close(ctx context.Context) error {
+	ms.drain.drain(ctx)
+	if err := ms.audit.close(); err != nil {
+		logging.Errorf("close audit log: %s", err)
+	}
 	return ms.client.Close()
 }
 
@@ -0,0 +1,211 @@
+package dsmongo
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/xerrors"
+)
+
+// TLSOptions configures the server side of TLS. Certificates are read from
+// disk again whenever a file changes, so rotation needs no restart.
+type TLSOptions struct {
+	CertFile string
+	KeyFile  string
+	// ClientCAFile enables mutual TLS, clients must present a certificate
+	// signed by one of these CAs
+	ClientCAFile string
+}
+
+// ClientTLSOptions configures the client side of TLS.
+type ClientTLSOptions struct {
+	// CAFile verifies the server certificate, system roots are used if empty
+	CAFile string
+	// CertFile and KeyFile are presented to servers requiring mutual TLS
+	CertFile string
+	KeyFile  string
+	// ServerName overrides the name checked against the server certificate
+	ServerName string
+}
+
+// ServerTLSConfig builds a reloading tls.Config for the KVStore server.
+func ServerTLSConfig(opts TLSOptions) (*tls.Config, error) {
+	if opts.CertFile == "" || opts.KeyFile == "" {
+		return nil, xerrors.New("tls needs both a certificate and a key file")
+	}
+	certs := &keyPairReloader{certFile: opts.CertFile, keyFile: opts.KeyFile}
+	if _, err := certs.get(); err != nil {
+		return nil, err
+	}
+	cfg := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return certs.get()
+		},
+	}
+	if opts.ClientCAFile == "" {
+		return cfg, nil
+	}
+
+	cas := &certPoolReloader{file: opts.ClientCAFile}
+	if _, err := cas.get(); err != nil {
+		return nil, err
+	}
+	cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	cfg.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		pool, err := cas.get()
+		if err != nil {
+			return nil, err
+		}
+		c := cfg.Clone()
+		c.ClientCAs = pool
+		return c, nil
+	}
+	return cfg, nil
+}
+
+// ClientTLSConfig builds a reloading tls.Config for dialing the KVStore server.
+func ClientTLSConfig(opts ClientTLSOptions) (*tls.Config, error) {
+	cfg := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ServerName: opts.ServerName,
+	}
+	if opts.CertFile != "" || opts.KeyFile != "" {
+		certs := &keyPairReloader{certFile: opts.CertFile, keyFile: opts.KeyFile}
+		if _, err := certs.get(); err != nil {
+			return nil, err
+		}
+		cfg.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return certs.get()
+		}
+	}
+	if opts.CAFile == "" {
+		return cfg, nil
+	}
+
+	cas := &certPoolReloader{file: opts.CAFile}
+	if _, err := cas.get(); err != nil {
+		return nil, err
+	}
+	// RootCAs would be read once for the lifetime of the connection, so the
+	// chain is verified by hand against the current CA file instead. The
+	// standard verification is only skipped in favour of this one.
+	cfg.InsecureSkipVerify = true
+	cfg.VerifyConnection = func(cs tls.ConnectionState) error {
+		pool, err := cas.get()
+		if err != nil {
+			return err
+		}
+		if len(cs.PeerCertificates) == 0 {
+			return xerrors.New("server presented no certificate")
+		}
+		inter := x509.NewCertPool()
+		for _, c := range cs.PeerCertificates[1:] {
+			inter.AddCert(c)
+		}
+		_, err = cs.PeerCertificates[0].Verify(x509.VerifyOptions{
+			DNSName:       cs.ServerName,
+			Roots:         pool,
+			Intermediates: inter,
+		})
+		return err
+	}
+	return cfg, nil
+}
+
+// keyPairReloader loads a certificate and key, reloading them when the
+// modification time of either file changes.
+type keyPairReloader struct {
+	certFile string
+	keyFile  string
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	certMod time.Time
+	keyMod  time.Time
+}
+
+func (r *keyPairReloader) get() (*tls.Certificate, error) {
+	certMod, err := modTime(r.certFile)
+	if err != nil {
+		return nil, err
+	}
+	keyMod, err := modTime(r.keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.cert != nil && certMod.Equal(r.certMod) && keyMod.Equal(r.keyMod) {
+		return r.cert, nil
+	}
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		if r.cert != nil {
+			// keep serving the old pair while the files are half written
+			logging.Warnf("reload tls key pair: %s", err)
+			return r.cert, nil
+		}
+		return nil, err
+	}
+	if r.cert != nil {
+		logging.Infof("reloaded tls certificate %s", r.certFile)
+	}
+	r.cert = &cert
+	r.certMod = certMod
+	r.keyMod = keyMod
+	return r.cert, nil
+}
+
+// certPoolReloader loads a PEM bundle of CA certificates, reloading it when
+// the file changes.
+type certPoolReloader struct {
+	file string
+
+	mu   sync.Mutex
+	pool *x509.CertPool
+	mod  time.Time
+}
+
+func (r *certPoolReloader) get() (*x509.CertPool, error) {
+	mod, err := modTime(r.file)
+	if err != nil {
+		return nil, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.pool != nil && mod.Equal(r.mod) {
+		return r.pool, nil
+	}
+	pem, err := os.ReadFile(r.file)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		if r.pool != nil {
+			logging.Warnf("reload ca bundle %s: no certificate found", r.file)
+			return r.pool, nil
+		}
+		return nil, xerrors.Errorf("no certificate found in %s", r.file)
+	}
+	if r.pool != nil {
+		logging.Infof("reloaded ca bundle %s", r.file)
+	}
+	r.pool = pool
+	r.mod = mod
+	return r.pool, nil
+}
+
+func modTime(file string) (time.Time, error) {
+	fi, err := os.Stat(file)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return fi.ModTime(), nil
+}
@@ -0,0 +1,166 @@
+package dsmongo
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	dsrpc "github.com/beeleelee/go-ds-rpc"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
+)
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCA(t *testing.T) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCA{cert: cert, key: key}
+}
+
+func (ca *testCA) writeCA(t *testing.T, file string) {
+	writePEM(t, file, "CERTIFICATE", ca.cert.Raw)
+}
+
+// issue writes a leaf certificate and its key to certFile and keyFile
+func (ca *testCA) issue(t *testing.T, serial int64, certFile, keyFile string, usage x509.ExtKeyUsage) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writePEM(t, certFile, "CERTIFICATE", der)
+	writePEM(t, keyFile, "EC PRIVATE KEY", keyDer)
+}
+
+func writePEM(t *testing.T, file, typ string, der []byte) {
+	err := os.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMutualTLSWithRotation(t *testing.T) {
+	dir := t.TempDir()
+	file := func(name string) string { return filepath.Join(dir, name) }
+
+	ca := newTestCA(t)
+	ca.writeCA(t, file("ca.pem"))
+	ca.issue(t, 2, file("server.pem"), file("server.key"), x509.ExtKeyUsageServerAuth)
+	ca.issue(t, 3, file("client.pem"), file("client.key"), x509.ExtKeyUsageClientAuth)
+
+	srvCfg, err := ServerTLSConfig(TLSOptions{
+		CertFile:     file("server.pem"),
+		KeyFile:      file("server.key"),
+		ClientCAFile: file("ca.pem"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := grpc.NewServer(grpc.Creds(credentials.NewTLS(srvCfg)))
+	dsrpc.RegisterKVStoreServer(srv, &dsrpc.UnimplementedKVStoreServer{})
+	go srv.Serve(lis)
+	defer srv.Stop()
+
+	// a handshake succeeded if the call reaches the unimplemented handler
+	call := func(opts ClientTLSOptions) error {
+		cfg, err := ClientTLSConfig(opts)
+		if err != nil {
+			return err
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		conn, err := grpc.DialContext(ctx, lis.Addr().String(), grpc.WithTransportCredentials(credentials.NewTLS(cfg)))
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		_, err = dsrpc.NewKVStoreClient(conn).Get(ctx, &dsrpc.CommonRequest{Key: "/a"})
+		if status.Code(err) == codes.Unimplemented {
+			return nil
+		}
+		return err
+	}
+	clientOpts := ClientTLSOptions{
+		CAFile:     file("ca.pem"),
+		CertFile:   file("client.pem"),
+		KeyFile:    file("client.key"),
+		ServerName: "localhost",
+	}
+
+	if err := call(clientOpts); err != nil {
+		t.Fatalf("mutual tls: %v", err)
+	}
+	if err := call(ClientTLSOptions{CAFile: file("ca.pem"), ServerName: "localhost"}); err == nil {
+		t.Fatal("client without certificate was accepted")
+	}
+
+	// rotate the whole chain, the running server must pick it up
+	rotated := newTestCA(t)
+	rotated.writeCA(t, file("ca.pem"))
+	rotated.issue(t, 4, file("server.pem"), file("server.key"), x509.ExtKeyUsageServerAuth)
+	rotated.issue(t, 5, file("client.pem"), file("client.key"), x509.ExtKeyUsageClientAuth)
+	future := time.Now().Add(time.Minute)
+	for _, f := range []string{"ca.pem", "server.pem", "server.key", "client.pem", "client.key"} {
+		if err := os.Chtimes(file(f), future, future); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := call(clientOpts); err != nil {
+		t.Fatalf("mutual tls after rotation: %v", err)
+	}
+}
@@ -0,0 +1,74 @@
+package dsmongo
+
+import (
+	"context"
+
+	dsrpc "github.com/beeleelee/go-ds-rpc"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/xerrors"
+	"google.golang.org/grpc"
+)
+
+// TracingUnaryServerInterceptor continues the client's trace and wraps each
+// unary call in a server span.
+func TracingUnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		attrs := []attribute.KeyValue{attribute.String("rpc.method", info.FullMethod)}
+		if r, ok := req.(*dsrpc.CommonRequest); ok {
+			attrs = append(attrs, attribute.String("dsrpc.key", r.GetKey()))
+		}
+		ctx, span := dsrpc.StartSpan(dsrpc.ExtractTraceContext(ctx), info.FullMethod, trace.SpanKindServer, attrs...)
+		resp, err := handler(ctx, req)
+
+		spanErr := err
+		if r, ok := resp.(*dsrpc.CommonReply); ok && spanErr == nil {
+			if r.GetCode() == dsrpc.ErrCode_Others {
+				spanErr = xerrors.New(r.GetMsg())
+			}
+		}
+		dsrpc.EndSpan(span, spanErr)
+		return resp, err
+	}
+}
+
+// TracingStreamServerInterceptor is the streaming counterpart of
+// TracingUnaryServerInterceptor.
+func TracingStreamServerInterceptor() grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		ctx, span := dsrpc.StartSpan(dsrpc.ExtractTraceContext(ss.Context()), info.FullMethod, trace.SpanKindServer,
+			attribute.String("rpc.method", info.FullMethod))
+		err := handler(srv, &contextStream{ServerStream: ss, ctx: ctx})
+		dsrpc.EndSpan(span, err)
+		return err
+	}
+}
+
+// contextStream overrides the context of a grpc.ServerStream
+type contextStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *contextStream) Context() context.Context {
+	return s.ctx
+}
+
+// mongoSpan starts a child span for a single operation on coll
+func mongoSpan(ctx context.Context, op string, coll *mongo.Collection) (context.Context, trace.Span) {
+	return dsrpc.StartSpan(ctx, "mongo."+op+" "+coll.Name(), trace.SpanKindClient,
+		attribute.String("db.system", "mongodb"),
+		attribute.String("db.name", coll.Database().Name()),
+		attribute.String("db.mongodb.collection", coll.Name()),
+		attribute.String("db.operation", op),
+	)
+}
+
+// endMongoSpan ends span, a missing document is not recorded as an error
+func endMongoSpan(span trace.Span, err error) {
+	if err == mongo.ErrNoDocuments {
+		err = nil
+	}
+	dsrpc.EndSpan(span, err)
+}
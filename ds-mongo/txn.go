@@ -0,0 +1,95 @@
+package dsmongo
+
+import (
+	"context"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"golang.org/x/xerrors"
+)
+
+// Transaction modes of Options.Transactions
+const (
+	// TxnAuto uses transactions if the deployment is a replica set or a
+	// sharded cluster recent enough to support them
+	TxnAuto = "auto"
+	// TxnAlways fails to connect to deployments without transactions
+	TxnAlways = "always"
+	// TxnNever runs Put and Delete as ordered single document writes
+	TxnNever = "never"
+)
+
+func validTxnMode(mode string) error {
+	switch mode {
+	case "", TxnAuto, TxnAlways, TxnNever:
+		return nil
+	}
+	return xerrors.Errorf("invalid transaction mode %q, want auto, always or never", mode)
+}
+
+// supportsTxn asks the deployment whether it runs multi-document
+// transactions: replica sets from MongoDB 4.0, sharded clusters from 4.2
+func (dsm *DSMongo) supportsTxn(ctx context.Context) (bool, error) {
+	res := struct {
+		SetName        string `bson:"setName"`
+		Msg            string `bson:"msg"`
+		MaxWireVersion int    `bson:"maxWireVersion"`
+	}{}
+	err := dsm.client.Database("admin").RunCommand(ctx, bson.D{{Key: "isMaster", Value: 1}}).Decode(&res)
+	if err != nil {
+		return false, err
+	}
+	switch {
+	case res.SetName != "":
+		return res.MaxWireVersion >= 7, nil
+	case res.Msg == "isdbgrid":
+		return res.MaxWireVersion >= 8, nil
+	}
+	return false, nil
+}
+
+// setupTxn decides whether Put and Delete run in transactions
+func (dsm *DSMongo) setupTxn(ctx context.Context) error {
+	mode := dsm.opts.Transactions
+	if mode == TxnNever {
+		return nil
+	}
+	ok, err := dsm.supportsTxn(ctx)
+	if err != nil {
+		return xerrors.Errorf("detect transaction support: %w", err)
+	}
+	if !ok {
+		if mode == TxnAlways {
+			return xerrors.New("the deployment does not support transactions, it must be a replica set or a sharded cluster")
+		}
+		logging.Warn("transactions are not supported by the deployment, concurrent writes may leave orphaned blocks")
+		return nil
+	}
+	dsm.txn = true
+	return nil
+}
+
+// withTxn runs fn in a transaction if the deployment supports them, fn is
+// retried on transient transaction errors such as write conflicts.
+//
+// Without transactions the steps of fn are ordered so that concurrent puts
+// and deletes never leave a ref without its block, but they may leave blocks
+// without refs, which CleanupOrphans removes.
+func (dsm *DSMongo) withTxn(ctx context.Context, fn func(context.Context) error) error {
+	if !dsm.txn {
+		return fn(ctx)
+	}
+	sess, err := dsm.client.StartSession()
+	if err != nil {
+		return err
+	}
+	defer sess.EndSession(ctx)
+	_, err = sess.WithTransaction(ctx, func(sc mongo.SessionContext) (interface{}, error) {
+		return nil, fn(sc)
+	})
+	return err
+}
+
+func inTxn(ctx context.Context) bool {
+	return mongo.SessionFromContext(ctx) != nil
+}
@@ -3,32 +3,173 @@ package dsrpc
 import (
 	context "context"
 	"encoding/json"
+	"errors"
+	"io"
+	"sync"
+	"time"
 
 	ds "github.com/ipfs/go-datastore"
 	dsq "github.com/ipfs/go-datastore/query"
 	log "github.com/ipfs/go-log/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"golang.org/x/xerrors"
+	"google.golang.org/grpc/metadata"
 )
 
 var logging = log.Logger("dsrpc")
 
+// Timeouts holds the default deadline of every KVStore method. It is only
+// applied when the caller's context carries no deadline of its own, zero
+// means no default deadline.
+type Timeouts struct {
+	Put     time.Duration
+	Get     time.Duration
+	Has     time.Duration
+	GetSize time.Duration
+	Delete  time.Duration
+	// Query bounds the whole result stream, not a single entry
+	Query time.Duration
+}
+
+type Options struct {
+	Timeouts Timeouts
+	// Registerer receives the client metrics, nil disables them
+	Registerer prometheus.Registerer
+	// ReadOnly rejects Put, Delete and Batch locally with a *ReadOnlyError
+	ReadOnly bool
+	// Token is sent as bearer token with every call
+	Token string
+	// Node names this node when several share a store, which then only
+	// shows it the keys it put and keeps them until it deletes them
+	Node string
+}
+
+// gRPC metadata keys carrying the client token
+const (
+	MetadataAuthorization = "authorization"
+	MetadataAPIKey        = "x-api-key"
+)
+
+// MetadataNode is the gRPC metadata key carrying Options.Node
+const MetadataNode = "x-dsrpc-node"
+
+func DefaultOptions() Options {
+	return Options{
+		Timeouts: Timeouts{
+			Put:     30 * time.Second,
+			Get:     30 * time.Second,
+			Has:     10 * time.Second,
+			GetSize: 10 * time.Second,
+			Delete:  30 * time.Second,
+		},
+	}
+}
+
+// ErrReadOnly matches every *ReadOnlyError with errors.Is
+var ErrReadOnly = xerrors.New("dsrpc: datastore is read-only")
+
+// ReadOnlyError is returned by mutations on a read-only DataStore
+type ReadOnlyError struct {
+	Op  string
+	Key ds.Key
+}
+
+func (e *ReadOnlyError) Error() string {
+	if e.Key == (ds.Key{}) {
+		return "dsrpc: " + e.Op + " rejected, datastore is read-only"
+	}
+	return "dsrpc: " + e.Op + " " + e.Key.String() + " rejected, datastore is read-only"
+}
+
+func (e *ReadOnlyError) Is(target error) bool {
+	return target == ErrReadOnly
+}
+
 type DataStore struct {
-	client KVStoreClient
+	client  KVStoreClient
+	opts    Options
+	metrics *ClientMetrics
 }
 
 var _ds DataStore
 var _ ds.Batching = _ds
 
 func NewDataStore(client KVStoreClient) (*DataStore, error) {
+	return NewDataStoreWithOptions(client, DefaultOptions())
+}
+
+func NewDataStoreWithOptions(client KVStoreClient, opts Options) (*DataStore, error) {
 	if client == nil {
 		return nil, xerrors.New("missing KVStoreClient instance")
 	}
+	var metrics *ClientMetrics
+	if opts.Registerer != nil {
+		var err error
+		metrics, err = NewClientMetrics(opts.Registerer)
+		if err != nil {
+			return nil, err
+		}
+	}
 	return &DataStore{
-		client: client,
+		client:  client,
+		opts:    opts,
+		metrics: metrics,
 	}, nil
 }
 
-func (d DataStore) Put(ctx context.Context, k ds.Key, value []byte) error {
+// withTimeout applies the default deadline d unless ctx already has one
+func withTimeout(ctx context.Context, d time.Duration) (context.Context, context.CancelFunc) {
+	if _, ok := ctx.Deadline(); ok || d <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, d)
+}
+
+// op tracks a single KVStore call from start to finish
+type op struct {
+	method  string
+	start   time.Time
+	cancel  context.CancelFunc
+	span    trace.Span
+	metrics *ClientMetrics
+}
+
+func (d DataStore) startOp(ctx context.Context, method string, timeout time.Duration, key string) (context.Context, *op) {
+	ctx, cancel := withTimeout(ctx, timeout)
+	ctx, span := StartSpan(ctx, "dsrpc.DataStore/"+method, trace.SpanKindClient, attribute.String("dsrpc.key", key))
+	if d.opts.Token != "" {
+		ctx = metadata.AppendToOutgoingContext(ctx, MetadataAuthorization, "Bearer "+d.opts.Token)
+	}
+	if d.opts.Node != "" {
+		ctx = metadata.AppendToOutgoingContext(ctx, MetadataNode, d.opts.Node)
+	}
+	return InjectTraceContext(ctx), &op{
+		method:  method,
+		start:   time.Now(),
+		cancel:  cancel,
+		span:    span,
+		metrics: d.metrics,
+	}
+}
+
+func (o *op) finish(err error, sent, received int) {
+	o.cancel()
+	o.metrics.observe(o.method, o.start, err, sent, received)
+	// a missing key is an answer, not a failure of the call
+	if errors.Is(err, ds.ErrNotFound) {
+		err = nil
+	}
+	EndSpan(o.span, err)
+}
+
+func (d DataStore) Put(ctx context.Context, k ds.Key, value []byte) (err error) {
+	if d.opts.ReadOnly {
+		return &ReadOnlyError{Op: "Put", Key: k}
+	}
+	ctx, op := d.startOp(ctx, "Put", d.opts.Timeouts.Put, k.String())
+	defer func() { op.finish(err, len(value), 0) }()
 	r, err := d.client.Put(ctx, &CommonRequest{
 		Key:   k.String(),
 		Value: value,
@@ -42,7 +183,9 @@ func (d DataStore) Put(ctx context.Context, k ds.Key, value []byte) error {
 	return nil
 }
 
-func (d DataStore) Get(ctx context.Context, k ds.Key) ([]byte, error) {
+func (d DataStore) Get(ctx context.Context, k ds.Key) (value []byte, err error) {
+	ctx, op := d.startOp(ctx, "Get", d.opts.Timeouts.Get, k.String())
+	defer func() { op.finish(err, 0, len(value)) }()
 	r, err := d.client.Get(ctx, &CommonRequest{
 		Key: k.String(),
 	})
@@ -58,7 +201,9 @@ func (d DataStore) Get(ctx context.Context, k ds.Key) ([]byte, error) {
 	return r.GetValue(), nil
 }
 
-func (d DataStore) Has(ctx context.Context, k ds.Key) (bool, error) {
+func (d DataStore) Has(ctx context.Context, k ds.Key) (exists bool, err error) {
+	ctx, op := d.startOp(ctx, "Has", d.opts.Timeouts.Has, k.String())
+	defer func() { op.finish(err, 0, 0) }()
 	r, err := d.client.Has(ctx, &CommonRequest{
 		Key: k.String(),
 	})
@@ -74,7 +219,9 @@ func (d DataStore) Has(ctx context.Context, k ds.Key) (bool, error) {
 	return r.GetSuccess(), nil
 }
 
-func (d DataStore) GetSize(ctx context.Context, k ds.Key) (int, error) {
+func (d DataStore) GetSize(ctx context.Context, k ds.Key) (size int, err error) {
+	ctx, op := d.startOp(ctx, "GetSize", d.opts.Timeouts.GetSize, k.String())
+	defer func() { op.finish(err, 0, 0) }()
 	r, err := d.client.GetSize(ctx, &CommonRequest{
 		Key: k.String(),
 	})
@@ -90,7 +237,12 @@ func (d DataStore) GetSize(ctx context.Context, k ds.Key) (int, error) {
 	return int(r.GetSize()), nil
 }
 
-func (d DataStore) Delete(ctx context.Context, k ds.Key) error {
+func (d DataStore) Delete(ctx context.Context, k ds.Key) (err error) {
+	if d.opts.ReadOnly {
+		return &ReadOnlyError{Op: "Delete", Key: k}
+	}
+	ctx, op := d.startOp(ctx, "Delete", d.opts.Timeouts.Delete, k.String())
+	defer func() { op.finish(err, 0, 0) }()
 	r, err := d.client.Delete(ctx, &CommonRequest{
 		Key: k.String(),
 	})
@@ -117,43 +269,84 @@ func (d DataStore) Close() error {
 }
 
 func (d DataStore) Query(ctx context.Context, q dsq.Query) (dsq.Results, error) {
-	b, err := json.Marshal(q)
+	// the server evaluates what it can, the rest is applied here
+	remote, local := SplitQuery(q)
+	b, err := EncodeQuery(remote)
 	if err != nil {
 		return nil, err
 	}
+	// the stream outlives this call, op is finished by the iterator
+	ctx, op := d.startOp(ctx, "Query", d.opts.Timeouts.Query, q.Prefix)
 	r, err := d.client.Query(ctx, &QueryRequest{
 		Q: b,
 	})
 	if err != nil {
-		r.CloseSend()
+		op.finish(err, 0, 0)
 		return nil, err
 	}
+	d.metrics.queryOpened()
+
+	var (
+		once     sync.Once
+		received int
+		lastErr  error
+	)
+	closeQuery := func() error {
+		err := r.CloseSend()
+		once.Do(func() {
+			d.metrics.queryClosed()
+			op.finish(lastErr, 0, received)
+		})
+		return err
+	}
 
+	// an error is returned as the last result, so that callers see that
+	// the listing is incomplete instead of a short one
+	done := false
 	nextValue := func() (dsq.Result, bool) {
+		if done {
+			return dsq.Result{}, false
+		}
 		ritem, err := r.Recv()
-		// if err == io.EOF {
-		// 	return dsq.Result{}, false
-		// }
+		if err == io.EOF {
+			done = true
+			return dsq.Result{}, false
+		}
 		if err != nil {
-			return dsq.Result{Error: err}, false
+			done = true
+			lastErr = err
+			return dsq.Result{Error: err}, true
 		}
 
 		ent := dsq.Entry{}
 		err = json.Unmarshal(ritem.GetRes(), &ent)
 		if err != nil {
-			return dsq.Result{Error: err}, false
+			done = true
+			lastErr = err
+			return dsq.Result{Error: err}, true
 		}
+		received += len(ent.Value)
 		return dsq.Result{Entry: ent}, true
 	}
 
-	return dsq.ResultsFromIterator(q, dsq.Iterator{
-		Close: func() error {
-			return r.CloseSend()
-		},
-		Next: nextValue,
-	}), nil
+	res := dsq.ResultsFromIterator(q, dsq.Iterator{
+		Close: closeQuery,
+		Next:  nextValue,
+	})
+	if len(local.Filters) > 0 || len(local.Orders) > 0 || local.Offset > 0 || local.Limit > 0 {
+		// keep reporting q as the query of the results
+		applied := dsq.NaiveQueryApply(local, res)
+		res = dsq.ResultsFromIterator(q, dsq.Iterator{
+			Next:  applied.NextSync,
+			Close: applied.Close,
+		})
+	}
+	return res, nil
 }
 
 func (d DataStore) Batch(ctx context.Context) (ds.Batch, error) {
+	if d.opts.ReadOnly {
+		return nil, &ReadOnlyError{Op: "Batch"}
+	}
 	return ds.NewBasicBatch(d), nil
 }
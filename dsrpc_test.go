@@ -0,0 +1,167 @@
+package dsrpc_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	dsrpc "github.com/beeleelee/go-ds-rpc"
+	ds "github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func TestReadOnlyDataStore(t *testing.T) {
+	opts := dsrpc.DefaultOptions()
+	opts.ReadOnly = true
+	// mutations must be rejected before the client is ever used
+	d, err := dsrpc.NewDataStoreWithOptions(dsrpc.NewKVStoreClient(nil), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	err = d.Put(ctx, ds.NewKey("/a"), []byte("v"))
+	roErr := &dsrpc.ReadOnlyError{}
+	if !errors.As(err, &roErr) || roErr.Op != "Put" || !errors.Is(err, dsrpc.ErrReadOnly) {
+		t.Fatalf("put: got %v", err)
+	}
+	if err := d.Delete(ctx, ds.NewKey("/a")); !errors.Is(err, dsrpc.ErrReadOnly) {
+		t.Fatalf("delete: got %v", err)
+	}
+	if _, err := d.Batch(ctx); !errors.Is(err, dsrpc.ErrReadOnly) {
+		t.Fatalf("batch: got %v", err)
+	}
+}
+
+// errStream sends the given entries and then fails
+type errStream struct {
+	grpc.ClientStream
+	entries []dsq.Entry
+}
+
+func (s *errStream) Recv() (*dsrpc.QueryReply, error) {
+	if len(s.entries) == 0 {
+		return nil, status.Error(codes.Internal, "query: block is missing")
+	}
+	b, err := json.Marshal(s.entries[0])
+	s.entries = s.entries[1:]
+	return &dsrpc.QueryReply{Res: b}, err
+}
+
+func (s *errStream) CloseSend() error {
+	return nil
+}
+
+type errQueryClient struct {
+	dsrpc.KVStoreClient
+}
+
+func (errQueryClient) Query(ctx context.Context, in *dsrpc.QueryRequest, opts ...grpc.CallOption) (dsrpc.KVStore_QueryClient, error) {
+	return &errStream{entries: []dsq.Entry{{Key: "/a"}, {Key: "/b"}}}, nil
+}
+
+func TestQueryStreamError(t *testing.T) {
+	d, err := dsrpc.NewDataStoreWithOptions(errQueryClient{}, dsrpc.DefaultOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := d.Query(context.Background(), dsq.Query{Prefix: "/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := res.Rest()
+	if status.Code(err) != codes.Internal {
+		t.Errorf("a failed stream must not end as a complete result, got %v", err)
+	}
+	if len(entries) != 2 {
+		t.Errorf("got %d entries before the error", len(entries))
+	}
+}
+
+// nodeClient records the node sent with Has
+type nodeClient struct {
+	dsrpc.KVStoreClient
+	node []string
+}
+
+func (c *nodeClient) Has(ctx context.Context, in *dsrpc.CommonRequest, opts ...grpc.CallOption) (*dsrpc.CommonReply, error) {
+	md, _ := metadata.FromOutgoingContext(ctx)
+	c.node = md.Get(dsrpc.MetadataNode)
+	return &dsrpc.CommonReply{}, nil
+}
+
+func TestNodeMetadata(t *testing.T) {
+	c := &nodeClient{}
+	opts := dsrpc.DefaultOptions()
+	opts.Node = "node-a"
+	d, err := dsrpc.NewDataStoreWithOptions(c, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Has(context.Background(), ds.NewKey("/a")); err != nil {
+		t.Fatal(err)
+	}
+	if len(c.node) != 1 || c.node[0] != "node-a" {
+		t.Errorf("node metadata: got %v", c.node)
+	}
+}
+
+// deadlineClient records the deadline Get is called with
+type deadlineClient struct {
+	dsrpc.KVStoreClient
+	deadline time.Time
+	ok       bool
+}
+
+func (c *deadlineClient) Get(ctx context.Context, in *dsrpc.CommonRequest, opts ...grpc.CallOption) (*dsrpc.CommonReply, error) {
+	c.deadline, c.ok = ctx.Deadline()
+	return &dsrpc.CommonReply{}, nil
+}
+
+func TestDefaultTimeout(t *testing.T) {
+	c := &deadlineClient{}
+	opts := dsrpc.DefaultOptions()
+	opts.Timeouts.Get = time.Minute
+	d, err := dsrpc.NewDataStoreWithOptions(c, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	get := func(ctx context.Context) {
+		if _, err := d.Get(ctx, ds.NewKey("/a")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	start := time.Now()
+	get(context.Background())
+	if !c.ok || c.deadline.Before(start.Add(time.Minute)) || c.deadline.After(time.Now().Add(time.Minute)) {
+		t.Errorf("default deadline: got %v, %v", c.deadline, c.ok)
+	}
+
+	// a deadline of the caller wins, whether shorter or longer
+	for _, timeout := range []time.Duration{time.Second, time.Hour} {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		want, _ := ctx.Deadline()
+		get(ctx)
+		cancel()
+		if !c.ok || !c.deadline.Equal(want) {
+			t.Errorf("caller deadline %v: got %v, %v", timeout, c.deadline, c.ok)
+		}
+	}
+
+	opts.Timeouts.Get = 0
+	d, err = dsrpc.NewDataStoreWithOptions(c, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	get(context.Background())
+	if c.ok {
+		t.Errorf("zero timeout: got deadline %v", c.deadline)
+	}
+}
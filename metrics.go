@@ -0,0 +1,136 @@
+package dsrpc
+
+import (
+	"errors"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc/status"
+)
+
+// ClientMetrics instruments DataStore calls. A nil *ClientMetrics is valid
+// and records nothing.
+type ClientMetrics struct {
+	requests      *prometheus.CounterVec
+	duration      *prometheus.HistogramVec
+	errors        *prometheus.CounterVec
+	bytesSent     *prometheus.CounterVec
+	bytesReceived *prometheus.CounterVec
+	activeQueries prometheus.Gauge
+}
+
+// NewClientMetrics creates the client collectors and registers them with reg.
+// Collectors already registered by another DataStore are shared.
+func NewClientMetrics(reg prometheus.Registerer) (*ClientMetrics, error) {
+	m := &ClientMetrics{}
+	err := RegisterCollectors(reg, []MetricCollector{
+		{Collector: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "dsrpc",
+			Subsystem: "client",
+			Name:      "requests_total",
+			Help:      "Number of KVStore requests issued.",
+		}, []string{"method"}), Set: func(c prometheus.Collector) { m.requests = c.(*prometheus.CounterVec) }},
+		{Collector: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: "dsrpc",
+			Subsystem: "client",
+			Name:      "request_duration_seconds",
+			Help:      "Latency of KVStore requests, query streams are measured until closed.",
+			Buckets:   prometheus.ExponentialBuckets(0.0005, 2, 16),
+		}, []string{"method"}), Set: func(c prometheus.Collector) { m.duration = c.(*prometheus.HistogramVec) }},
+		{Collector: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "dsrpc",
+			Subsystem: "client",
+			Name:      "errors_total",
+			Help:      "Number of failed KVStore requests by error code.",
+		}, []string{"method", "code"}), Set: func(c prometheus.Collector) { m.errors = c.(*prometheus.CounterVec) }},
+		{Collector: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "dsrpc",
+			Subsystem: "client",
+			Name:      "sent_bytes_total",
+			Help:      "Value bytes sent to the server.",
+		}, []string{"method"}), Set: func(c prometheus.Collector) { m.bytesSent = c.(*prometheus.CounterVec) }},
+		{Collector: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "dsrpc",
+			Subsystem: "client",
+			Name:      "received_bytes_total",
+			Help:      "Value bytes received from the server.",
+		}, []string{"method"}), Set: func(c prometheus.Collector) { m.bytesReceived = c.(*prometheus.CounterVec) }},
+		{Collector: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: "dsrpc",
+			Subsystem: "client",
+			Name:      "active_queries",
+			Help:      "Number of open query streams.",
+		}), Set: func(c prometheus.Collector) { m.activeQueries = c.(prometheus.Gauge) }},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// MetricCollector is a collector for RegisterCollectors and the setter of
+// the field keeping it
+type MetricCollector struct {
+	Collector prometheus.Collector
+	Set       func(prometheus.Collector)
+}
+
+// RegisterCollectors registers every collector with reg and passes it to its
+// setter. Collectors that are already registered are shared, so several
+// clients or servers in one process report into the same series.
+func RegisterCollectors(reg prometheus.Registerer, collectors []MetricCollector) error {
+	for _, col := range collectors {
+		c := col.Collector
+		if err := reg.Register(c); err != nil {
+			are := prometheus.AlreadyRegisteredError{}
+			if !errors.As(err, &are) {
+				return err
+			}
+			c = are.ExistingCollector
+		}
+		col.Set(c)
+	}
+	return nil
+}
+
+func (m *ClientMetrics) observe(method string, start time.Time, err error, sent, received int) {
+	if m == nil {
+		return
+	}
+	m.requests.WithLabelValues(method).Inc()
+	m.duration.WithLabelValues(method).Observe(time.Since(start).Seconds())
+	if err != nil {
+		m.errors.WithLabelValues(method, ErrorCode(err)).Inc()
+	}
+	if sent > 0 {
+		m.bytesSent.WithLabelValues(method).Add(float64(sent))
+	}
+	if received > 0 {
+		m.bytesReceived.WithLabelValues(method).Add(float64(received))
+	}
+}
+
+func (m *ClientMetrics) queryOpened() {
+	if m != nil {
+		m.activeQueries.Inc()
+	}
+}
+
+func (m *ClientMetrics) queryClosed() {
+	if m != nil {
+		m.activeQueries.Dec()
+	}
+}
+
+// ErrorCode classifies err for metric labels: ErrCode names for errors
+// reported in replies, gRPC code names for transport errors.
+func ErrorCode(err error) string {
+	if errors.Is(err, ds.ErrNotFound) {
+		return ErrCode_ErrNotFound.String()
+	}
+	if s, ok := status.FromError(err); ok {
+		return s.Code().String()
+	}
+	return ErrCode_Others.String()
+}
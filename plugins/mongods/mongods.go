@@ -1,11 +1,16 @@
 package mongods
 
 import (
+	"context"
 	"fmt"
+	"time"
 
 	"github.com/ipfs/go-ipfs/plugin"
 	"github.com/ipfs/go-ipfs/repo"
 	"github.com/ipfs/go-ipfs/repo/fsrepo"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
 
 	dsrpc "github.com/beeleelee/go-ds-rpc"
 	dsmongo "github.com/beeleelee/go-ds-rpc/ds-mongo"
@@ -37,7 +42,15 @@ func (*mongodsPlugin) DatastoreTypeName() string {
 }
 
 type datastoreConfig struct {
-	uri string
+	// uri is "host:port" or a unix socket, "unix:///run/mongods.sock"
+	uri      string
+	timeouts dsrpc.Timeouts
+	tracing  dsrpc.TracingOptions
+	readOnly bool
+	tls      *dsmongo.ClientTLSOptions
+	token    string
+	// node names this node when several share one mongods
+	node string
 }
 
 func (*mongodsPlugin) DatastoreConfigParser() fsrepo.ConfigFromMap {
@@ -49,21 +62,212 @@ func (*mongodsPlugin) DatastoreConfigParser() fsrepo.ConfigFromMap {
 		if !ok {
 			return nil, fmt.Errorf("'uri' field is missing or not string")
 		}
+
+		c.timeouts = dsrpc.DefaultOptions().Timeouts
+		if v, has := params["timeouts"]; has {
+			m, ok := v.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("'timeouts' field is not a map")
+			}
+			if err := parseTimeouts(m, &c.timeouts); err != nil {
+				return nil, err
+			}
+		}
+		if v, has := params["read-only"]; has {
+			c.readOnly, ok = v.(bool)
+			if !ok {
+				return nil, fmt.Errorf("'read-only' field is not bool")
+			}
+		}
+		if v, has := params["token"]; has {
+			c.token, ok = v.(string)
+			if !ok {
+				return nil, fmt.Errorf("'token' field is not string")
+			}
+		}
+		if v, has := params["node"]; has {
+			c.node, ok = v.(string)
+			if !ok {
+				return nil, fmt.Errorf("'node' field is not string")
+			}
+		}
+		if v, has := params["tls"]; has {
+			m, ok := v.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("'tls' field is not a map")
+			}
+			c.tls = &dsmongo.ClientTLSOptions{}
+			if err := parseTLS(m, c.tls); err != nil {
+				return nil, err
+			}
+		}
+		if v, has := params["tracing"]; has {
+			m, ok := v.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("'tracing' field is not a map")
+			}
+			if err := parseTracing(m, &c.tracing); err != nil {
+				return nil, err
+			}
+		}
 		return &c, nil
 	}
 }
 
 func (c *datastoreConfig) DiskSpec() fsrepo.DiskSpec {
-	return map[string]interface{}{
+	spec := map[string]interface{}{
 		"type": "mongods",
 		"uri":  c.uri,
 	}
+	// another node sees other keys
+	if c.node != "" {
+		spec["node"] = c.node
+	}
+	return spec
 }
 
 func (c *datastoreConfig) Create(path string) (repo.Datastore, error) {
-	client, err := dsmongo.NewMongoStoreClient(c.uri)
+	tp, err := dsrpc.NewTracerProvider(context.Background(), c.tracing)
+	if err != nil {
+		return nil, err
+	}
+	if tp != nil {
+		otel.SetTracerProvider(tp)
+	}
+
+	client, err := dsmongo.NewMongoStoreClientWithOptions(c.uri, dsmongo.ClientOptions{
+		TLS: c.tls,
+	})
 	if err != nil {
+		shutdownTracing(tp)
 		return nil, err
 	}
-	return dsrpc.NewDataStore(client)
+	opts := dsrpc.DefaultOptions()
+	opts.Timeouts = c.timeouts
+	// go-ipfs serves the default registry on /debug/metrics/prometheus
+	opts.Registerer = prometheus.DefaultRegisterer
+	opts.ReadOnly = c.readOnly
+	opts.Token = c.token
+	opts.Node = c.node
+	d, err := dsrpc.NewDataStoreWithOptions(client, opts)
+	if err != nil {
+		shutdownTracing(tp)
+		return nil, err
+	}
+	if tp == nil {
+		return d, nil
+	}
+	return &tracedDatastore{DataStore: d, tp: tp}, nil
+}
+
+// tracedDatastore shuts the tracer provider down when go-ipfs closes the
+// datastore, which exports the spans still buffered
+type tracedDatastore struct {
+	*dsrpc.DataStore
+	tp *sdktrace.TracerProvider
+}
+
+var _ repo.Datastore = (*tracedDatastore)(nil)
+
+func (d *tracedDatastore) Close() error {
+	err := d.DataStore.Close()
+	if serr := d.tp.Shutdown(context.Background()); err == nil {
+		err = serr
+	}
+	return err
+}
+
+func shutdownTracing(tp *sdktrace.TracerProvider) {
+	if tp != nil {
+		tp.Shutdown(context.Background())
+	}
+}
+
+// parseTimeouts reads per-method durations such as {"get": "5s", "query": "10m"}
+func parseTimeouts(m map[string]interface{}, t *dsrpc.Timeouts) error {
+	fields := map[string]*time.Duration{
+		"put":     &t.Put,
+		"get":     &t.Get,
+		"has":     &t.Has,
+		"getsize": &t.GetSize,
+		"delete":  &t.Delete,
+		"query":   &t.Query,
+	}
+	for k, v := range m {
+		f, ok := fields[k]
+		if !ok {
+			return fmt.Errorf("unknown method %q in 'timeouts'", k)
+		}
+		str, ok := v.(string)
+		if !ok {
+			return fmt.Errorf("'timeouts.%s' is not string", k)
+		}
+		d, err := time.ParseDuration(str)
+		if err != nil {
+			return fmt.Errorf("'timeouts.%s': %w", k, err)
+		}
+		*f = d
+	}
+	return nil
+}
+
+// parseTracing reads the span exporter settings, e.g.
+// {"exporter": "file", "file": "/var/log/ipfs-traces.json"}
+func parseTracing(m map[string]interface{}, t *dsrpc.TracingOptions) error {
+	for k, v := range m {
+		switch k {
+		case "exporter", "file", "endpoint":
+			str, ok := v.(string)
+			if !ok {
+				return fmt.Errorf("'tracing.%s' is not string", k)
+			}
+			switch k {
+			case "exporter":
+				t.Exporter = str
+			case "file":
+				t.File = str
+			case "endpoint":
+				t.Endpoint = str
+			}
+		case "insecure":
+			b, ok := v.(bool)
+			if !ok {
+				return fmt.Errorf("'tracing.insecure' is not bool")
+			}
+			t.Insecure = b
+		case "sample-ratio":
+			f, ok := v.(float64)
+			if !ok {
+				return fmt.Errorf("'tracing.sample-ratio' is not number")
+			}
+			t.SampleRatio = f
+		default:
+			return fmt.Errorf("unknown field %q in 'tracing'", k)
+		}
+	}
+	t.ServiceName = "go-ipfs"
+	return nil
+}
+
+// parseTLS reads the client tls settings, e.g.
+// {"ca": "/etc/ipfs/ca.pem", "cert": "/etc/ipfs/node.pem", "key": "/etc/ipfs/node.key"}
+func parseTLS(m map[string]interface{}, t *dsmongo.ClientTLSOptions) error {
+	fields := map[string]*string{
+		"ca":          &t.CAFile,
+		"cert":        &t.CertFile,
+		"key":         &t.KeyFile,
+		"server-name": &t.ServerName,
+	}
+	for k, v := range m {
+		f, ok := fields[k]
+		if !ok {
+			return fmt.Errorf("unknown field %q in 'tls'", k)
+		}
+		str, ok := v.(string)
+		if !ok {
+			return fmt.Errorf("'tls.%s' is not string", k)
+		}
+		*f = str
+	}
+	return nil
 }
@@ -0,0 +1,35 @@
+package mongods
+
+import (
+	"testing"
+	"time"
+
+	dsrpc "github.com/beeleelee/go-ds-rpc"
+)
+
+func TestParseTimeouts(t *testing.T) {
+	cases := []struct {
+		name string
+		m    map[string]interface{}
+		want dsrpc.Timeouts
+		ok   bool
+	}{
+		{"durations", map[string]interface{}{"get": "5s", "getsize": "1s", "query": "10m"},
+			dsrpc.Timeouts{Put: time.Minute, Get: 5 * time.Second, GetSize: time.Second, Query: 10 * time.Minute}, true},
+		{"unknown method", map[string]interface{}{"batch": "5s"}, dsrpc.Timeouts{}, false},
+		{"not a string", map[string]interface{}{"get": 5}, dsrpc.Timeouts{}, false},
+		{"bad duration", map[string]interface{}{"put": "5 seconds"}, dsrpc.Timeouts{}, false},
+	}
+	for _, c := range cases {
+		// fields left out keep their value
+		got := dsrpc.Timeouts{Put: time.Minute}
+		err := parseTimeouts(c.m, &got)
+		if (err == nil) != c.ok {
+			t.Errorf("%s: got error %v", c.name, err)
+			continue
+		}
+		if c.ok && got != c.want {
+			t.Errorf("%s: got %+v, want %+v", c.name, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,220 @@
+package dsrpc
+
+import (
+	"encoding/json"
+	"fmt"
+
+	dsq "github.com/ipfs/go-datastore/query"
+)
+
+// FilterSizeCompare compares the size of the value of entries, which mongods
+// evaluates without reading the values.
+type FilterSizeCompare struct {
+	Op   dsq.Op
+	Size int
+}
+
+func (f FilterSizeCompare) Filter(e dsq.Entry) bool {
+	switch f.Op {
+	case dsq.Equal:
+		return e.Size == f.Size
+	case dsq.NotEqual:
+		return e.Size != f.Size
+	case dsq.GreaterThan:
+		return e.Size > f.Size
+	case dsq.GreaterThanOrEqual:
+		return e.Size >= f.Size
+	case dsq.LessThan:
+		return e.Size < f.Size
+	case dsq.LessThanOrEqual:
+		return e.Size <= f.Size
+	default:
+		panic(fmt.Errorf("unknown op '%s'", f.Op))
+	}
+}
+
+func (f FilterSizeCompare) String() string {
+	return fmt.Sprintf("SIZE %s %d", f.Op, f.Size)
+}
+
+// wireQuery is the encoding of dsq.Query in QueryRequest.Q. It keeps the
+// json field names of dsq.Query, whose filters and orders json can't decode.
+type wireQuery struct {
+	Prefix            string
+	Filters           []wireFilter `json:",omitempty"`
+	Orders            []string     `json:",omitempty"`
+	Limit             int
+	Offset            int
+	KeysOnly          bool
+	ReturnExpirations bool
+	ReturnsSizes      bool
+}
+
+type wireFilter struct {
+	// Type is key, prefix, value or size
+	Type  string
+	Op    dsq.Op `json:",omitempty"`
+	Key   string `json:",omitempty"`
+	Value []byte `json:",omitempty"`
+	Size  int    `json:",omitempty"`
+}
+
+var validOps = map[dsq.Op]bool{
+	dsq.Equal:              true,
+	dsq.NotEqual:           true,
+	dsq.GreaterThan:        true,
+	dsq.GreaterThanOrEqual: true,
+	dsq.LessThan:           true,
+	dsq.LessThanOrEqual:    true,
+}
+
+func encodeFilter(f dsq.Filter) (wireFilter, bool) {
+	switch f := f.(type) {
+	case dsq.FilterKeyCompare:
+		return wireFilter{Type: "key", Op: f.Op, Key: f.Key}, validOps[f.Op]
+	case dsq.FilterKeyPrefix:
+		return wireFilter{Type: "prefix", Key: f.Prefix}, true
+	case dsq.FilterValueCompare:
+		return wireFilter{Type: "value", Op: f.Op, Value: f.Value}, validOps[f.Op]
+	case FilterSizeCompare:
+		return wireFilter{Type: "size", Op: f.Op, Size: f.Size}, validOps[f.Op]
+	}
+	return wireFilter{}, false
+}
+
+func (f wireFilter) decode() (dsq.Filter, error) {
+	if f.Type != "prefix" && !validOps[f.Op] {
+		return nil, fmt.Errorf("invalid op %q in %s filter", f.Op, f.Type)
+	}
+	switch f.Type {
+	case "key":
+		return dsq.FilterKeyCompare{Op: f.Op, Key: f.Key}, nil
+	case "prefix":
+		return dsq.FilterKeyPrefix{Prefix: f.Key}, nil
+	case "value":
+		return dsq.FilterValueCompare{Op: f.Op, Value: f.Value}, nil
+	case "size":
+		return FilterSizeCompare{Op: f.Op, Size: f.Size}, nil
+	}
+	return nil, fmt.Errorf("unknown filter type %q", f.Type)
+}
+
+func encodeOrder(o dsq.Order) (string, bool) {
+	switch o.(type) {
+	case dsq.OrderByKey:
+		return "key", true
+	case dsq.OrderByKeyDescending:
+		return "key-desc", true
+	case dsq.OrderByValue:
+		return "value", true
+	case dsq.OrderByValueDescending:
+		return "value-desc", true
+	}
+	return "", false
+}
+
+func decodeOrder(s string) (dsq.Order, error) {
+	switch s {
+	case "key":
+		return dsq.OrderByKey{}, nil
+	case "key-desc":
+		return dsq.OrderByKeyDescending{}, nil
+	case "value":
+		return dsq.OrderByValue{}, nil
+	case "value-desc":
+		return dsq.OrderByValueDescending{}, nil
+	}
+	return nil, fmt.Errorf("unknown order %q", s)
+}
+
+// SplitQuery splits q into the part a server can evaluate and the rest,
+// which NaiveQueryApply applies to the results of the remote part. Filters
+// and orders outside this package and go-datastore, such as
+// OrderByFunction, can't be sent. Offset and limit then stay local too.
+func SplitQuery(q dsq.Query) (remote, local dsq.Query) {
+	remote = q
+	remote.Filters, remote.Orders = nil, nil
+	for _, f := range q.Filters {
+		if _, ok := encodeFilter(f); ok {
+			remote.Filters = append(remote.Filters, f)
+		} else {
+			local.Filters = append(local.Filters, f)
+		}
+	}
+	ordersOK := true
+	for _, o := range q.Orders {
+		if _, ok := encodeOrder(o); !ok {
+			ordersOK = false
+		}
+	}
+	if ordersOK {
+		remote.Orders = q.Orders
+	} else {
+		local.Orders = q.Orders
+	}
+	if len(local.Filters) > 0 || !ordersOK {
+		remote.Offset, remote.Limit = 0, 0
+		local.Offset, local.Limit = q.Offset, q.Limit
+	}
+	return remote, local
+}
+
+// EncodeQuery encodes q for QueryRequest.Q, see SplitQuery for the queries
+// it can encode.
+func EncodeQuery(q dsq.Query) ([]byte, error) {
+	w := wireQuery{
+		Prefix:            q.Prefix,
+		Limit:             q.Limit,
+		Offset:            q.Offset,
+		KeysOnly:          q.KeysOnly,
+		ReturnExpirations: q.ReturnExpirations,
+		ReturnsSizes:      q.ReturnsSizes,
+	}
+	for _, f := range q.Filters {
+		wf, ok := encodeFilter(f)
+		if !ok {
+			return nil, fmt.Errorf("filter %v can't be sent", f)
+		}
+		w.Filters = append(w.Filters, wf)
+	}
+	for _, o := range q.Orders {
+		wo, ok := encodeOrder(o)
+		if !ok {
+			return nil, fmt.Errorf("order %v can't be sent", o)
+		}
+		w.Orders = append(w.Orders, wo)
+	}
+	return json.Marshal(w)
+}
+
+// DecodeQuery decodes QueryRequest.Q, including the queries of clients that
+// send dsq.Query as json.
+func DecodeQuery(b []byte) (dsq.Query, error) {
+	w := wireQuery{}
+	if err := json.Unmarshal(b, &w); err != nil {
+		return dsq.Query{}, err
+	}
+	q := dsq.Query{
+		Prefix:            w.Prefix,
+		Limit:             w.Limit,
+		Offset:            w.Offset,
+		KeysOnly:          w.KeysOnly,
+		ReturnExpirations: w.ReturnExpirations,
+		ReturnsSizes:      w.ReturnsSizes,
+	}
+	for _, wf := range w.Filters {
+		f, err := wf.decode()
+		if err != nil {
+			return dsq.Query{}, err
+		}
+		q.Filters = append(q.Filters, f)
+	}
+	for _, wo := range w.Orders {
+		o, err := decodeOrder(wo)
+		if err != nil {
+			return dsq.Query{}, err
+		}
+		q.Orders = append(q.Orders, o)
+	}
+	return q, nil
+}
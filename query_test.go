@@ -0,0 +1,156 @@
+package dsrpc_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"testing"
+
+	dsrpc "github.com/beeleelee/go-ds-rpc"
+	ds "github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
+	"google.golang.org/grpc"
+)
+
+// mapServer answers queries from a MapDatastore as mongods would, after a
+// trip through the wire encoding
+type mapServer struct {
+	dsrpc.KVStoreClient
+	ds *ds.MapDatastore
+}
+
+type entryStream struct {
+	grpc.ClientStream
+	res dsq.Results
+}
+
+func (s *entryStream) Recv() (*dsrpc.QueryReply, error) {
+	r, ok := s.res.NextSync()
+	if !ok {
+		return nil, io.EOF
+	}
+	if r.Error != nil {
+		return nil, r.Error
+	}
+	b, err := json.Marshal(r.Entry)
+	return &dsrpc.QueryReply{Res: b}, err
+}
+
+func (s *entryStream) CloseSend() error {
+	return s.res.Close()
+}
+
+func (m mapServer) Query(ctx context.Context, in *dsrpc.QueryRequest, opts ...grpc.CallOption) (dsrpc.KVStore_QueryClient, error) {
+	q, err := dsrpc.DecodeQuery(in.GetQ())
+	if err != nil {
+		return nil, err
+	}
+	res, err := m.ds.Query(ctx, q)
+	return &entryStream{res: res}, err
+}
+
+type oddSize struct{}
+
+func (oddSize) Filter(e dsq.Entry) bool {
+	return e.Size%2 == 1
+}
+
+func TestQueryDifferential(t *testing.T) {
+	ctx := context.Background()
+	mds := ds.NewMapDatastore()
+	for i := 0; i < 40; i++ {
+		v := bytes.Repeat([]byte{byte('a' + i%7)}, i%5+1)
+		mds.Put(ctx, ds.NewKey(fmt.Sprintf("/%c/%02d", 'a'+i%3, i)), v)
+	}
+	d, err := dsrpc.NewDataStoreWithOptions(mapServer{ds: mds}, dsrpc.DefaultOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// dsq.Less only understands -1, 0 and 1
+	byValueLen := dsq.OrderByFunction(func(a, b dsq.Entry) int {
+		switch {
+		case len(a.Value) < len(b.Value):
+			return -1
+		case len(a.Value) > len(b.Value):
+			return 1
+		}
+		return 0
+	})
+
+	queries := []dsq.Query{
+		{Prefix: "/a"},
+		{Prefix: "/b", Filters: []dsq.Filter{dsq.FilterKeyCompare{Op: dsq.GreaterThan, Key: "/b/10"}}},
+		{Filters: []dsq.Filter{dsq.FilterKeyPrefix{Prefix: "/c/1"}}, Orders: []dsq.Order{dsq.OrderByKeyDescending{}}, Limit: 3},
+		{Filters: []dsq.Filter{dsrpc.FilterSizeCompare{Op: dsq.LessThanOrEqual, Size: 2}}, Orders: []dsq.Order{dsq.OrderByKey{}}, Offset: 4},
+		{Filters: []dsq.Filter{dsq.FilterValueCompare{Op: dsq.Equal, Value: []byte("bb")}}},
+		{Orders: []dsq.Order{dsq.OrderByValue{}, dsq.OrderByKeyDescending{}}, Offset: 2, Limit: 10},
+		// custom filters and orders can't be sent
+		{Filters: []dsq.Filter{oddSize{}, dsq.FilterKeyCompare{Op: dsq.NotEqual, Key: "/a/03"}}, Orders: []dsq.Order{dsq.OrderByKey{}}, Offset: 1, Limit: 5},
+		{Prefix: "/a", Orders: []dsq.Order{byValueLen}, Limit: 4},
+		{KeysOnly: true, Filters: []dsq.Filter{dsq.FilterValueCompare{Op: dsq.Equal, Value: nil}}, Orders: []dsq.Order{dsq.OrderByKey{}}},
+	}
+	for _, q := range queries {
+		want := queryEntries(t, mds, q)
+		got := queryEntries(t, d, q)
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("%s:\n got %v\nwant %v", q, got, want)
+		}
+	}
+}
+
+// queryEntries lists the results of q, in key order unless q orders them
+func queryEntries(t *testing.T, d ds.Datastore, q dsq.Query) []string {
+	res, err := d.Query(context.Background(), q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := res.Rest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out []string
+	for _, e := range entries {
+		out = append(out, fmt.Sprintf("%s=%s", e.Key, e.Value))
+	}
+	if len(q.Orders) == 0 {
+		sort.Strings(out)
+	}
+	return out
+}
+
+func TestQueryEncoding(t *testing.T) {
+	q := dsq.Query{
+		Prefix:   "/a",
+		Filters:  []dsq.Filter{dsq.FilterKeyPrefix{Prefix: "/a/b"}, dsrpc.FilterSizeCompare{Op: dsq.GreaterThan, Size: 3}},
+		Orders:   []dsq.Order{dsq.OrderByValueDescending{}, dsq.OrderByKey{}},
+		Limit:    2,
+		KeysOnly: true,
+	}
+	b, err := dsrpc.EncodeQuery(q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := dsrpc.DecodeQuery(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.String() != q.String() {
+		t.Errorf("got %s, want %s", got, q)
+	}
+
+	// queries of clients sending dsq.Query as json
+	old, _ := json.Marshal(dsq.Query{Prefix: "/p", Limit: 1})
+	if got, err := dsrpc.DecodeQuery(old); err != nil || got.Prefix != "/p" || got.Limit != 1 {
+		t.Errorf("plain query: got %s, %v", got, err)
+	}
+
+	if _, err := dsrpc.EncodeQuery(dsq.Query{Filters: []dsq.Filter{oddSize{}}}); err == nil {
+		t.Error("a custom filter was encoded")
+	}
+	if _, err := dsrpc.DecodeQuery([]byte(`{"Filters": [{"Type": "key", "Op": "~"}]}`)); err == nil {
+		t.Error("an unknown op was decoded")
+	}
+}
@@ -307,3 +307,343 @@ var KVStore_ServiceDesc = grpc.ServiceDesc{
 	},
 	Metadata: "store.proto",
 }
+
+// AdminClient is the client API for Admin service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type AdminClient interface {
+	FenceWrites(ctx context.Context, in *FenceRequest, opts ...grpc.CallOption) (*FenceReply, error)
+	UnfenceWrites(ctx context.Context, in *FenceRequest, opts ...grpc.CallOption) (*FenceReply, error)
+	WriteFence(ctx context.Context, in *FenceRequest, opts ...grpc.CallOption) (*FenceReply, error)
+	Stats(ctx context.Context, in *StatsRequest, opts ...grpc.CallOption) (*StatsReply, error)
+	Connections(ctx context.Context, in *ConnectionsRequest, opts ...grpc.CallOption) (*ConnectionsReply, error)
+	EnsureIndexes(ctx context.Context, in *MaintenanceRequest, opts ...grpc.CallOption) (*MaintenanceReply, error)
+	CleanupOrphans(ctx context.Context, in *MaintenanceRequest, opts ...grpc.CallOption) (*MaintenanceReply, error)
+	// RewrapKeys wraps data keys of encrypted blocks with the current key
+	RewrapKeys(ctx context.Context, in *MaintenanceRequest, opts ...grpc.CallOption) (*MaintenanceReply, error)
+}
+
+type adminClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewAdminClient(cc grpc.ClientConnInterface) AdminClient {
+	return &adminClient{cc}
+}
+
+func (c *adminClient) FenceWrites(ctx context.Context, in *FenceRequest, opts ...grpc.CallOption) (*FenceReply, error) {
+	out := new(FenceReply)
+	err := c.cc.Invoke(ctx, "/dsrpc.Admin/FenceWrites", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *adminClient) UnfenceWrites(ctx context.Context, in *FenceRequest, opts ...grpc.CallOption) (*FenceReply, error) {
+	out := new(FenceReply)
+	err := c.cc.Invoke(ctx, "/dsrpc.Admin/UnfenceWrites", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *adminClient) WriteFence(ctx context.Context, in *FenceRequest, opts ...grpc.CallOption) (*FenceReply, error) {
+	out := new(FenceReply)
+	err := c.cc.Invoke(ctx, "/dsrpc.Admin/WriteFence", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *adminClient) Stats(ctx context.Context, in *StatsRequest, opts ...grpc.CallOption) (*StatsReply, error) {
+	out := new(StatsReply)
+	err := c.cc.Invoke(ctx, "/dsrpc.Admin/Stats", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *adminClient) Connections(ctx context.Context, in *ConnectionsRequest, opts ...grpc.CallOption) (*ConnectionsReply, error) {
+	out := new(ConnectionsReply)
+	err := c.cc.Invoke(ctx, "/dsrpc.Admin/Connections", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *adminClient) EnsureIndexes(ctx context.Context, in *MaintenanceRequest, opts ...grpc.CallOption) (*MaintenanceReply, error) {
+	out := new(MaintenanceReply)
+	err := c.cc.Invoke(ctx, "/dsrpc.Admin/EnsureIndexes", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *adminClient) CleanupOrphans(ctx context.Context, in *MaintenanceRequest, opts ...grpc.CallOption) (*MaintenanceReply, error) {
+	out := new(MaintenanceReply)
+	err := c.cc.Invoke(ctx, "/dsrpc.Admin/CleanupOrphans", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *adminClient) RewrapKeys(ctx context.Context, in *MaintenanceRequest, opts ...grpc.CallOption) (*MaintenanceReply, error) {
+	out := new(MaintenanceReply)
+	err := c.cc.Invoke(ctx, "/dsrpc.Admin/RewrapKeys", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// AdminServer is the server API for Admin service.
+// All implementations must embed UnimplementedAdminServer
+// for forward compatibility
+type AdminServer interface {
+	FenceWrites(context.Context, *FenceRequest) (*FenceReply, error)
+	UnfenceWrites(context.Context, *FenceRequest) (*FenceReply, error)
+	WriteFence(context.Context, *FenceRequest) (*FenceReply, error)
+	Stats(context.Context, *StatsRequest) (*StatsReply, error)
+	Connections(context.Context, *ConnectionsRequest) (*ConnectionsReply, error)
+	EnsureIndexes(context.Context, *MaintenanceRequest) (*MaintenanceReply, error)
+	CleanupOrphans(context.Context, *MaintenanceRequest) (*MaintenanceReply, error)
+	// RewrapKeys wraps data keys of encrypted blocks with the current key
+	RewrapKeys(context.Context, *MaintenanceRequest) (*MaintenanceReply, error)
+	mustEmbedUnimplementedAdminServer()
+}
+
+// UnimplementedAdminServer must be embedded to have forward compatible implementations.
+type UnimplementedAdminServer struct {
+}
+
+func (UnimplementedAdminServer) FenceWrites(context.Context, *FenceRequest) (*FenceReply, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method FenceWrites not implemented")
+}
+func (UnimplementedAdminServer) UnfenceWrites(context.Context, *FenceRequest) (*FenceReply, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method UnfenceWrites not implemented")
+}
+func (UnimplementedAdminServer) WriteFence(context.Context, *FenceRequest) (*FenceReply, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method WriteFence not implemented")
+}
+func (UnimplementedAdminServer) Stats(context.Context, *StatsRequest) (*StatsReply, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Stats not implemented")
+}
+func (UnimplementedAdminServer) Connections(context.Context, *ConnectionsRequest) (*ConnectionsReply, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Connections not implemented")
+}
+func (UnimplementedAdminServer) EnsureIndexes(context.Context, *MaintenanceRequest) (*MaintenanceReply, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method EnsureIndexes not implemented")
+}
+func (UnimplementedAdminServer) CleanupOrphans(context.Context, *MaintenanceRequest) (*MaintenanceReply, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method CleanupOrphans not implemented")
+}
+func (UnimplementedAdminServer) RewrapKeys(context.Context, *MaintenanceRequest) (*MaintenanceReply, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method RewrapKeys not implemented")
+}
+func (UnimplementedAdminServer) mustEmbedUnimplementedAdminServer() {}
+
+// UnsafeAdminServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to AdminServer will
+// result in compilation errors.
+type UnsafeAdminServer interface {
+	mustEmbedUnimplementedAdminServer()
+}
+
+func RegisterAdminServer(s grpc.ServiceRegistrar, srv AdminServer) {
+	s.RegisterService(&Admin_ServiceDesc, srv)
+}
+
+func _Admin_FenceWrites_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(FenceRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AdminServer).FenceWrites(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/dsrpc.Admin/FenceWrites",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AdminServer).FenceWrites(ctx, req.(*FenceRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Admin_UnfenceWrites_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(FenceRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AdminServer).UnfenceWrites(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/dsrpc.Admin/UnfenceWrites",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AdminServer).UnfenceWrites(ctx, req.(*FenceRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Admin_WriteFence_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(FenceRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AdminServer).WriteFence(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/dsrpc.Admin/WriteFence",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AdminServer).WriteFence(ctx, req.(*FenceRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Admin_Stats_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(StatsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AdminServer).Stats(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/dsrpc.Admin/Stats",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AdminServer).Stats(ctx, req.(*StatsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Admin_Connections_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ConnectionsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AdminServer).Connections(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/dsrpc.Admin/Connections",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AdminServer).Connections(ctx, req.(*ConnectionsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Admin_EnsureIndexes_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(MaintenanceRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AdminServer).EnsureIndexes(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/dsrpc.Admin/EnsureIndexes",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AdminServer).EnsureIndexes(ctx, req.(*MaintenanceRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Admin_CleanupOrphans_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(MaintenanceRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AdminServer).CleanupOrphans(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/dsrpc.Admin/CleanupOrphans",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AdminServer).CleanupOrphans(ctx, req.(*MaintenanceRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Admin_RewrapKeys_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(MaintenanceRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AdminServer).RewrapKeys(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/dsrpc.Admin/RewrapKeys",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AdminServer).RewrapKeys(ctx, req.(*MaintenanceRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// Admin_ServiceDesc is the grpc.ServiceDesc for Admin service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Admin_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "dsrpc.Admin",
+	HandlerType: (*AdminServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "FenceWrites",
+			Handler:    _Admin_FenceWrites_Handler,
+		},
+		{
+			MethodName: "UnfenceWrites",
+			Handler:    _Admin_UnfenceWrites_Handler,
+		},
+		{
+			MethodName: "WriteFence",
+			Handler:    _Admin_WriteFence_Handler,
+		},
+		{
+			MethodName: "Stats",
+			Handler:    _Admin_Stats_Handler,
+		},
+		{
+			MethodName: "Connections",
+			Handler:    _Admin_Connections_Handler,
+		},
+		{
+			MethodName: "EnsureIndexes",
+			Handler:    _Admin_EnsureIndexes_Handler,
+		},
+		{
+			MethodName: "CleanupOrphans",
+			Handler:    _Admin_CleanupOrphans_Handler,
+		},
+		{
+			MethodName: "RewrapKeys",
+			Handler:    _Admin_RewrapKeys_Handler,
+		},
+	},
+	Streams:  []grpc.StreamDesc{},
+	Metadata: "store.proto",
+}
@@ -0,0 +1,183 @@
+package dsrpc
+
+import (
+	"context"
+	"os"
+	"strings"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpgrpc"
+	"go.opentelemetry.io/otel/exporters/stdout"
+	"go.opentelemetry.io/otel/propagation"
+	sdkresource "go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/semconv"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/xerrors"
+	"google.golang.org/grpc/metadata"
+)
+
+// TracerName is the instrumentation name of every span created by dsrpc and
+// ds-mongo. Spans go to the global TracerProvider.
+const TracerName = "github.com/beeleelee/go-ds-rpc"
+
+// propagator carries the trace context in gRPC metadata independently of the
+// global propagator, which is a no-op unless the host process configures one.
+var propagator = propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{})
+
+// StartSpan starts a span from the global TracerProvider.
+func StartSpan(ctx context.Context, name string, kind trace.SpanKind, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return otel.Tracer(TracerName).Start(ctx, name, trace.WithSpanKind(kind), trace.WithAttributes(attrs...))
+}
+
+// EndSpan records err, if any, on span and ends it.
+func EndSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// InjectTraceContext adds the span context of ctx to the outgoing gRPC metadata.
+func InjectTraceContext(ctx context.Context) context.Context {
+	md, ok := metadata.FromOutgoingContext(ctx)
+	if ok {
+		md = md.Copy()
+	} else {
+		md = metadata.MD{}
+	}
+	propagator.Inject(ctx, metadataCarrier(md))
+	return metadata.NewOutgoingContext(ctx, md)
+}
+
+// ExtractTraceContext returns ctx with the remote span context found in the
+// incoming gRPC metadata.
+func ExtractTraceContext(ctx context.Context) context.Context {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return ctx
+	}
+	return propagator.Extract(ctx, metadataCarrier(md))
+}
+
+type metadataCarrier metadata.MD
+
+func (c metadataCarrier) Get(key string) string {
+	v := metadata.MD(c).Get(key)
+	if len(v) == 0 {
+		return ""
+	}
+	return v[0]
+}
+
+func (c metadataCarrier) Set(key, value string) {
+	metadata.MD(c).Set(key, value)
+}
+
+func (c metadataCarrier) Keys() []string {
+	keys := make([]string, 0, len(c))
+	for k := range c {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+const (
+	TraceExporterNone   = ""
+	TraceExporterStdout = "stdout"
+	TraceExporterFile   = "file"
+	TraceExporterOTLP   = "otlp"
+)
+
+type TracingOptions struct {
+	// Exporter is one of "", "stdout", "file" or "otlp", empty disables tracing
+	Exporter string
+	// File is the output of the file exporter, spans are appended as JSON
+	File string
+	// Endpoint is the host:port of the OTLP gRPC collector
+	Endpoint string
+	// Insecure disables TLS towards the OTLP collector
+	Insecure bool
+	// SampleRatio is the fraction of root spans sampled, 0 means all
+	SampleRatio float64
+	ServiceName string
+}
+
+// NewTracerProvider builds a TracerProvider exporting spans as configured by
+// opts. It returns nil when opts.Exporter is empty. Callers usually install
+// it with otel.SetTracerProvider and must Shutdown it before exiting.
+func NewTracerProvider(ctx context.Context, opts TracingOptions) (*sdktrace.TracerProvider, error) {
+	var (
+		exp sdktrace.SpanExporter
+		err error
+	)
+	switch strings.ToLower(opts.Exporter) {
+	case TraceExporterNone:
+		return nil, nil
+	case TraceExporterStdout:
+		exp, err = stdout.NewExporter(stdout.WithWriter(os.Stdout), stdout.WithoutMetricExport())
+	case TraceExporterFile:
+		if opts.File == "" {
+			return nil, xerrors.New("file trace exporter needs a file path")
+		}
+		var f *os.File
+		f, err = os.OpenFile(opts.File, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			return nil, err
+		}
+		var fexp *stdout.Exporter
+		fexp, err = stdout.NewExporter(stdout.WithWriter(f), stdout.WithoutMetricExport())
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		exp = &fileExporter{SpanExporter: fexp, f: f}
+	case TraceExporterOTLP:
+		dopts := []otlpgrpc.Option{}
+		if opts.Endpoint != "" {
+			dopts = append(dopts, otlpgrpc.WithEndpoint(opts.Endpoint))
+		}
+		if opts.Insecure {
+			dopts = append(dopts, otlpgrpc.WithInsecure())
+		}
+		exp, err = otlp.NewExporter(ctx, otlpgrpc.NewDriver(dopts...))
+	default:
+		return nil, xerrors.Errorf("unknown trace exporter %q", opts.Exporter)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	sampler := sdktrace.AlwaysSample()
+	if opts.SampleRatio > 0 && opts.SampleRatio < 1 {
+		sampler = sdktrace.TraceIDRatioBased(opts.SampleRatio)
+	}
+	serviceName := opts.ServiceName
+	if serviceName == "" {
+		serviceName = "dsrpc"
+	}
+	return sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exp),
+		sdktrace.WithSampler(sdktrace.ParentBased(sampler)),
+		sdktrace.WithResource(sdkresource.NewWithAttributes(semconv.ServiceNameKey.String(serviceName))),
+	), nil
+}
+
+// fileExporter closes the file of the file exporter on Shutdown, which the
+// stdout exporter leaves open
+type fileExporter struct {
+	sdktrace.SpanExporter
+	f *os.File
+}
+
+func (e *fileExporter) Shutdown(ctx context.Context) error {
+	err := e.SpanExporter.Shutdown(ctx)
+	if cerr := e.f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
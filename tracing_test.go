@@ -0,0 +1,58 @@
+package dsrpc_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	dsrpc "github.com/beeleelee/go-ds-rpc"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc/metadata"
+)
+
+func TestTraceContextPropagation(t *testing.T) {
+	tp := sdktrace.NewTracerProvider()
+	ctx, span := tp.Tracer("test").Start(context.Background(), "client")
+	defer span.End()
+
+	ctx = dsrpc.InjectTraceContext(ctx)
+	md, ok := metadata.FromOutgoingContext(ctx)
+	if !ok || len(md.Get("traceparent")) == 0 {
+		t.Fatalf("traceparent missing from outgoing metadata: %v", md)
+	}
+
+	srvCtx := dsrpc.ExtractTraceContext(metadata.NewIncomingContext(context.Background(), md))
+	remote := trace.SpanContextFromContext(srvCtx)
+	if !remote.IsRemote() || remote.TraceID() != span.SpanContext().TraceID() {
+		t.Fatalf("got span context %v, want trace %v", remote, span.SpanContext().TraceID())
+	}
+}
+
+func TestFileExporterShutdown(t *testing.T) {
+	fds := func() int {
+		entries, err := os.ReadDir("/proc/self/fd")
+		if err != nil {
+			t.Skip("open files are not listed in /proc")
+		}
+		return len(entries)
+	}
+	file := filepath.Join(t.TempDir(), "traces.json")
+	before := fds()
+	tp, err := dsrpc.NewTracerProvider(context.Background(), dsrpc.TracingOptions{Exporter: dsrpc.TraceExporterFile, File: file})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, span := tp.Tracer("test").Start(context.Background(), "put")
+	span.End()
+	if err := tp.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if after := fds(); after != before {
+		t.Errorf("open files: %d before, %d after shutdown", before, after)
+	}
+	if b, err := os.ReadFile(file); err != nil || len(b) == 0 {
+		t.Errorf("spans were not written: %q, %v", b, err)
+	}
+}